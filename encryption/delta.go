@@ -0,0 +1,68 @@
+package encryption
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ldsec/lattigo/v2/ckks"
+)
+
+// Model deltas: participants send their weights minus the global model, and
+// the server adds learningRate times the average delta to the global model.
+// Average and learning rate are a single scaling multiplication followed by a
+// rescale, so the global model stays at the same level round after round.
+
+// AddDeltasNew returns global + learningRate * mean(deltas)
+func (s *Server) AddDeltasNew(global *EncryptedVector, deltas []*EncryptedVector, learningRate float64) (*EncryptedVector, error) {
+	step, err := s.scaledSum(deltas, learningRate)
+	if err != nil {
+		return nil, err
+	}
+	return s.AddVectorsNew(global, step)
+}
+
+// AddDeltasToPlainNew returns global + learningRate * mean(deltas), the global
+// model being known in the clear, such as before the first round.
+func (s *Server) AddDeltasToPlainNew(global []float64, deltas []*EncryptedVector, learningRate float64) (*EncryptedVector, error) {
+	step, err := s.scaledSum(deltas, learningRate)
+	if err != nil {
+		return nil, err
+	}
+	if len(global) != step.Length {
+		return nil, fmt.Errorf("[encryption.AddDeltasToPlainNew]: model of %d weights, deltas of %d", len(global), step.Length)
+	}
+	plaintexts := step.encode(ckks.NewEncoder(s.Params), s.Params, global, step.Chunks[0].Level(), step.Chunks[0].Scale)
+	res := &EncryptedVector{Length: step.Length, Encoding: step.Encoding, LogSlots: step.LogSlots, Chunks: make([]*ckks.Ciphertext, len(step.Chunks))}
+	for i := range step.Chunks {
+		res.Chunks[i] = s.AddNew(step.Chunks[i], plaintexts[i])
+	}
+	return res, nil
+}
+
+// learningRate/len(deltas) * sum(deltas), rescaled to the default scale
+func (s *Server) scaledSum(deltas []*EncryptedVector, learningRate float64) (*EncryptedVector, error) {
+	if len(deltas) == 0 {
+		return nil, errors.New("[encryption.scaledSum]: no delta")
+	}
+	sum := deltas[0]
+	for _, d := range deltas[1:] {
+		var err error
+		sum, err = s.AddVectorsNew(sum, d)
+		if err != nil {
+			return nil, err
+		}
+	}
+	step := s.MultVectorByConstNew(sum, learningRate/float64(len(deltas)))
+	for _, c := range step.Chunks {
+		if c.Scale > s.Params.DefaultScale() {
+			if c.Level() == 0 {
+				return nil, errors.New("[encryption.scaledSum]: no level left to rescale")
+			}
+			err := s.Rescale(c, s.Params.DefaultScale(), c)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return step, nil
+}
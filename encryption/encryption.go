@@ -5,6 +5,7 @@ import (
 	"encoding"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 
@@ -17,27 +18,68 @@ type Client struct {
 	ckks.Encryptor
 	ckks.Decryptor
 
-	Params ckks.Parameters
+	Params    ckks.Parameters
+	SecretKey *rlwe.SecretKey // own key, share of the collective one, nil if encrypting only
+	PublicKey *rlwe.PublicKey // collective or distributed key, if any
+
+	// Threshold decryption: sum of the Shamir shares received, and the
+	// key pair these shares are sealed with
+	ThresholdKey     *rlwe.SecretKey
+	SharingPublicKey *[32]byte
+	sharingKey       *[32]byte
+
+	// Norm keys generation, ephemeral key between the two rounds of the
+	// relinearization key
+	relinEphemeral *rlwe.SecretKey
+
+	// How weight vectors are encoded, coefficients if empty
+	Encoding string
+	LogSlots int
 }
 
+// Encodings of weight vectors
+const (
+	CoeffsEncoding = "coeffs" // one value per polynomial coefficient
+	SlotsEncoding  = "slots"  // one value per slot, allows rotations
+)
+
 type Server struct {
 	Participants []string
+	Params       ckks.Parameters
 	ckks.Evaluator
 	Responses []*ckks.Ciphertext
 	Result    *ckks.Ciphertext
+
+	// Weights vectors of the current round and their average
+	Updates   []*EncryptedVector
+	Aggregate *EncryptedVector
+
+	// Collective key generation, nil if never started
+	KeyGeneration *KeyGeneration
+
+	RelinearizationKey *rlwe.RelinearizationKey
+	RotationKeys       *rlwe.RotationKeySet // nil until SetNormKeys
+
+	// Collective generation of the norm keys, nil if never started
+	NormKeyGeneration *NormKeyGeneration
 }
 
 func NewClient() Client {
+	return NewClientWithParameters(DefaultParameters())
+}
+
+// NewClientWithParameters returns a client with the given parameters,
+// such as chosen by SelectParameters or advertised by a server.
+func NewClientWithParameters(params ckks.Parameters) Client {
 
 	client := Client{}
 
-	p := ckks.DefaultParams[1]
-	params, _ := ckks.NewParametersFromLiteral(p)
 	client.Params = params
 	//keyGenerator := bfv.NewKeyGenerator(params)
 	client.Encoder = ckks.NewEncoder(params)
 
 	sk := ckks.NewSecretKey(params)
+	client.SecretKey = sk
 	client.Encryptor = ckks.NewEncryptor(params, sk)
 	client.Decryptor = ckks.NewDecryptor(params, sk)
 
@@ -53,20 +95,54 @@ func NewClient() Client {
 // }
 
 func NewServer() Server {
+	return NewServerWithParameters(DefaultParameters())
+}
 
-	p := ckks.DefaultParams[1]
-	params, _ := ckks.NewParametersFromLiteral(p)
+// NewServerWithParameters returns a server computing with the given parameters
+func NewServerWithParameters(params ckks.Parameters) Server {
 	evaluationKey := rlwe.EvaluationKey{
 		Rlk: ckks.NewRelinearizationKey(params),
 	}
 	return Server{
-		Evaluator:    ckks.NewEvaluator(params, evaluationKey),
-		Responses:    make([]*ckks.Ciphertext, 0),
-		Participants: make([]string, 0),
+		Params:             params,
+		Evaluator:          ckks.NewEvaluator(params, evaluationKey),
+		Responses:          make([]*ckks.Ciphertext, 0),
+		Updates:            make([]*EncryptedVector, 0),
+		Participants:       make([]string, 0),
+		RelinearizationKey: evaluationKey.Rlk,
 	}
 }
 
-// Not used
+// SetEncoding chooses how weight vectors are encoded,
+// logSlots is only used by slots encoding, 0 meaning the parameters default.
+func (client *Client) SetEncoding(encoding string, logSlots int) error {
+	switch encoding {
+	case CoeffsEncoding, "":
+		client.Encoding = encoding
+		client.LogSlots = 0
+	case SlotsEncoding:
+		if logSlots == 0 {
+			logSlots = client.Params.LogSlots()
+		}
+		if logSlots < 0 || logSlots > client.Params.MaxLogSlots() {
+			return fmt.Errorf("[encryption.SetEncoding]: logSlots must be in [0, %d]", client.Params.MaxLogSlots())
+		}
+		client.Encoding = encoding
+		client.LogSlots = logSlots
+	default:
+		return errors.New("[encryption.SetEncoding]: unknown encoding " + encoding)
+	}
+	return nil
+}
+
+func (client *Client) encoding() string {
+	if client.Encoding == "" {
+		return CoeffsEncoding
+	}
+	return client.Encoding
+}
+
+// Encrypt returns the coefficients encrypted in a single ciphertext, in base64
 func (client *Client) Encrypt(coeffs []float64) (string, error) {
 	plaintext := ckks.NewPlaintext(client.Params, client.Params.MaxLevel(), client.Params.DefaultScale())
 
@@ -77,10 +153,17 @@ func (client *Client) Encrypt(coeffs []float64) (string, error) {
 	return output, nil
 }
 
-// Not used
+// Decrypt returns the coefficients of a ciphertext in base64, see Encrypt
 func (client *Client) Decrypt(input string) ([]float64, error) {
-	cipher := ckks.NewCiphertext(client.Params, 1, 1, 0.01)
-	UnmarshalFromBase64(cipher, input)
+	if !client.CanDecrypt() {
+		return nil, errors.New("[encryption.Decrypt]: no secret key")
+	}
+	// Level and scale are read with the ciphertext
+	cipher := new(ckks.Ciphertext)
+	err := UnmarshalFromBase64(cipher, input)
+	if err != nil {
+		return nil, err
+	}
 
 	text := client.DecryptNew(cipher)
 
@@ -135,6 +218,8 @@ func (s *Server) AddParticipants(ps ...string) {
 	}
 }
 
+// Deprecated: drops legitimate near-zero and negative values,
+// use EncryptVector and DecryptVector to keep the exact length.
 func RemoveZerosCoeffs(coeffs []float64) []float64 {
 	newCoeffs := make([]float64, 0)
 	for _, c := range coeffs {
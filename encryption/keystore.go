@@ -0,0 +1,289 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ldsec/lattigo/v2/ckks"
+	"github.com/ldsec/lattigo/v2/rlwe"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Version of the key file format
+const KeystoreVersion = 1
+
+// Key files are only readable by their owner
+const KeyFileMode = 0600
+
+// scrypt cost, as recommended for interactive logins
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptSaltLen = 16
+)
+
+// Keys is the key material of a node, nil keys are not saved
+type Keys struct {
+	Params             ckks.Parameters
+	SecretKey          *rlwe.SecretKey
+	PublicKey          *rlwe.PublicKey
+	ThresholdKey       *rlwe.SecretKey
+	RelinearizationKey *rlwe.RelinearizationKey
+	Identity           ed25519.PrivateKey // signs the packets of the node
+}
+
+// KeyFile is the content of a key file. Keys are JSON then base64 encoded,
+// and sealed with a key derived from the passphrase if there is one.
+type KeyFile struct {
+	Version   int
+	Params    string
+	Encrypted bool
+	Salt      []byte `json:",omitempty"`
+	Nonce     []byte `json:",omitempty"`
+	Keys      []byte
+}
+
+type keysContent struct {
+	SecretKey          string
+	PublicKey          string
+	ThresholdKey       string
+	RelinearizationKey string
+	Identity           []byte `json:",omitempty"`
+}
+
+// Keys returns the key material of the client
+func (client *Client) Keys() Keys {
+	return Keys{
+		Params:       client.Params,
+		SecretKey:    client.SecretKey,
+		PublicKey:    client.PublicKey,
+		ThresholdKey: client.ThresholdKey,
+	}
+}
+
+// SetKeys makes the client encrypt and decrypt with the keys,
+// under the public key if there is one.
+func (client *Client) SetKeys(keys Keys) error {
+	if !keys.Params.Equals(client.Params) {
+		return errors.New("[encryption.SetKeys]: keys of other parameters")
+	}
+	client.SecretKey = keys.SecretKey
+	client.PublicKey = keys.PublicKey
+	client.ThresholdKey = keys.ThresholdKey
+	client.Decryptor = nil
+	if keys.SecretKey != nil {
+		client.Decryptor = ckks.NewDecryptor(client.Params, keys.SecretKey)
+	}
+	switch {
+	case keys.PublicKey != nil:
+		client.Encryptor = ckks.NewEncryptor(client.Params, keys.PublicKey)
+	case keys.SecretKey != nil:
+		client.Encryptor = ckks.NewEncryptor(client.Params, keys.SecretKey)
+	default:
+		return errors.New("[encryption.SetKeys]: neither secret nor public key")
+	}
+	return nil
+}
+
+// SetRelinearizationKey makes the server relinearize with rlk
+func (s *Server) SetRelinearizationKey(rlk *rlwe.RelinearizationKey) {
+	s.RelinearizationKey = rlk
+	s.Evaluator = ckks.NewEvaluator(s.Params, rlwe.EvaluationKey{Rlk: rlk})
+}
+
+// SaveKeys writes the keys to path, only readable by the owner. With a
+// non-empty passphrase, keys are encrypted with XChaCha20-Poly1305 under
+// a key derived from it with scrypt.
+func SaveKeys(path string, keys Keys, passphrase []byte) error {
+	params, err := MarshalParameters(keys.Params)
+	if err != nil {
+		return err
+	}
+	content := keysContent{
+		SecretKey:          MarshalToBase64String(keys.SecretKey),
+		PublicKey:          MarshalToBase64String(keys.PublicKey),
+		ThresholdKey:       MarshalToBase64String(keys.ThresholdKey),
+		RelinearizationKey: MarshalToBase64String(keys.RelinearizationKey),
+		Identity:           keys.Identity,
+	}
+	plain, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+
+	file := KeyFile{Version: KeystoreVersion, Params: params, Keys: plain}
+	if len(passphrase) > 0 {
+		file.Encrypted = true
+		file.Salt = make([]byte, scryptSaltLen)
+		file.Nonce = make([]byte, chacha20poly1305.NonceSizeX)
+		_, err = rand.Read(file.Salt)
+		if err == nil {
+			_, err = rand.Read(file.Nonce)
+		}
+		if err != nil {
+			return err
+		}
+		aead, err := keystoreCipher(passphrase, file.Salt)
+		if err != nil {
+			return err
+		}
+		// Parameters and version are authenticated too
+		file.Keys = aead.Seal(nil, file.Nonce, plain, keystoreAdditionalData(file))
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = tmp.Chmod(KeyFileMode)
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadKeys reads keys saved by SaveKeys, refusing files other users can read
+func LoadKeys(path string, passphrase []byte) (Keys, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Keys{}, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return Keys{}, fmt.Errorf("[encryption.LoadKeys]: %s is accessible by other users (%o)", path, info.Mode().Perm())
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Keys{}, err
+	}
+	file := KeyFile{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return Keys{}, err
+	}
+	if file.Version != KeystoreVersion {
+		return Keys{}, fmt.Errorf("[encryption.LoadKeys]: unsupported key file version %d", file.Version)
+	}
+
+	plain := file.Keys
+	if file.Encrypted {
+		if len(passphrase) == 0 {
+			return Keys{}, errors.New("[encryption.LoadKeys]: keys are encrypted, passphrase needed")
+		}
+		aead, err := keystoreCipher(passphrase, file.Salt)
+		if err != nil {
+			return Keys{}, err
+		}
+		if len(file.Nonce) != aead.NonceSize() {
+			return Keys{}, errors.New("[encryption.LoadKeys]: invalid nonce")
+		}
+		plain, err = aead.Open(nil, file.Nonce, file.Keys, keystoreAdditionalData(file))
+		if err != nil {
+			return Keys{}, errors.New("[encryption.LoadKeys]: wrong passphrase or corrupted file")
+		}
+	}
+
+	keys := Keys{}
+	keys.Params, err = UnmarshalParameters(file.Params)
+	if err != nil {
+		return Keys{}, err
+	}
+	content := keysContent{}
+	err = json.Unmarshal(plain, &content)
+	if err != nil {
+		return Keys{}, err
+	}
+	if content.SecretKey != "nil" {
+		keys.SecretKey, err = unmarshalSecretKey(keys.Params, content.SecretKey)
+		if err != nil {
+			return Keys{}, err
+		}
+	}
+	if content.PublicKey != "nil" {
+		keys.PublicKey, err = UnmarshalPublicKey(keys.Params, content.PublicKey)
+		if err != nil {
+			return Keys{}, err
+		}
+	}
+	if content.ThresholdKey != "nil" {
+		keys.ThresholdKey, err = unmarshalSecretKey(keys.Params, content.ThresholdKey)
+		if err != nil {
+			return Keys{}, err
+		}
+	}
+	if content.RelinearizationKey != "nil" {
+		keys.RelinearizationKey = new(rlwe.RelinearizationKey)
+		err = UnmarshalFromBase64(keys.RelinearizationKey, content.RelinearizationKey)
+		if err != nil {
+			return Keys{}, err
+		}
+	}
+	if content.Identity != nil {
+		if len(content.Identity) != ed25519.PrivateKeySize {
+			return Keys{}, errors.New("[encryption.LoadKeys]: invalid identity key")
+		}
+		keys.Identity = content.Identity
+	}
+	return keys, nil
+}
+
+// Reads a secret key, checking it matches the parameters as
+// UnmarshalPublicKey does
+func unmarshalSecretKey(params ckks.Parameters, input string) (*rlwe.SecretKey, error) {
+	b, err := base64.StdEncoding.DecodeString(input)
+	if err != nil {
+		return nil, err
+	}
+	sk := ckks.NewSecretKey(params)
+	if len(b) != sk.GetDataLen(true) {
+		return nil, errors.New("[encryption.LoadKeys]: secret key doesn't match the parameters")
+	}
+	err = sk.UnmarshalBinary(b)
+	if err != nil {
+		return nil, err
+	}
+	if sk.Value.Q.Degree() != params.N() || sk.Value.Q.Level() != params.QCount()-1 || sk.Value.P.Level() != params.PCount()-1 {
+		return nil, errors.New("[encryption.LoadKeys]: secret key doesn't match the parameters")
+	}
+	return sk, nil
+}
+
+func keystoreCipher(passphrase []byte, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+func keystoreAdditionalData(file KeyFile) []byte {
+	return []byte(fmt.Sprintf("%d/%s", file.Version, file.Params))
+}
@@ -0,0 +1,431 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Secure aggregation by pairwise masking (Bonawitz et al., Practical Secure
+// Aggregation for Privacy-Preserving Machine Learning), an alternative to CKKS
+// when ciphertexts are too large: vectors travel as integers, masked with
+//   - a pairwise mask per peer, agreed by Diffie-Hellman, that cancels in the sum,
+//   - a self mask drawn from a seed.
+// Both the mask key and the seed are Shamir-shared among the peers. For each
+// participant, the server asks the survivors for the shares of its seed if it
+// uploaded its vector, of its mask key otherwise, never both.
+
+// Bits of the fixed-point encoding of masked values
+const MaskingScaleBits = 24
+
+// Prime field of the Shamir shares, 2^521 - 1
+var maskingField = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 521), big.NewInt(1))
+
+// MaskingKeys are the public keys a participant advertises
+type MaskingKeys struct {
+	ShareKey [32]byte // shares for this participant are sealed with it
+	MaskKey  [32]byte // pairwise masks are agreed with it
+}
+
+// Shares of the secrets of From, for To
+type maskingShare struct {
+	From    uint64
+	To      uint64
+	MaskKey []byte
+	Seed    []byte
+}
+
+// MaskingClient is the participant side of one masked aggregation
+type MaskingClient struct {
+	ID        uint64
+	Threshold int
+	Keys      MaskingKeys
+
+	shareKey *[32]byte
+	maskKey  *[32]byte
+	seed     []byte // of the self mask
+
+	peers        map[uint64]MaskingKeys
+	received     map[uint64]maskingShare // shares of the peers' secrets, by peer
+	participants []uint64                // peers that shared their secrets
+	revealed     bool
+}
+
+// NewMaskingClient draws the keys of a participant for one aggregation.
+// Keys must not be reused, a mask key being revealed if the participant drops.
+func NewMaskingClient() (*MaskingClient, error) {
+	c := &MaskingClient{}
+	sharePub, sharePriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	maskPub, maskPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	c.Keys = MaskingKeys{ShareKey: *sharePub, MaskKey: *maskPub}
+	c.shareKey = sharePriv
+	c.maskKey = maskPriv
+	return c, nil
+}
+
+// ShareSecrets draws the self-mask seed and splits it, with the mask key,
+// among the peers (the client included). Returns the shares sealed for each peer.
+func (c *MaskingClient) ShareSecrets(id uint64, threshold int, peers map[uint64]MaskingKeys) (map[uint64][]byte, error) {
+	if _, ok := peers[id]; !ok || id == 0 {
+		return nil, fmt.Errorf("[encryption.ShareSecrets]: %d is not a valid peer", id)
+	}
+	if peers[id] != c.Keys {
+		return nil, errors.New("[encryption.ShareSecrets]: peers don't have the client's keys")
+	}
+	if threshold < 2 || threshold > len(peers) {
+		return nil, fmt.Errorf("[encryption.ShareSecrets]: threshold must be in [2, %d]", len(peers))
+	}
+	c.ID = id
+	c.Threshold = threshold
+	c.peers = peers
+	c.seed = make([]byte, 32)
+	_, err := rand.Read(c.seed)
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]uint64, 0, len(peers))
+	for p := range peers {
+		points = append(points, p)
+	}
+	sortIDs(points)
+	maskKeyShares, err := shamirSplit(new(big.Int).SetBytes(c.maskKey[:]), threshold, points)
+	if err != nil {
+		return nil, err
+	}
+	seedShares, err := shamirSplit(new(big.Int).SetBytes(c.seed), threshold, points)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make(map[uint64][]byte, len(points))
+	for i, p := range points {
+		msg, err := json.Marshal(maskingShare{From: id, To: p, MaskKey: maskKeyShares[i].Bytes(), Seed: seedShares[i].Bytes()})
+		if err != nil {
+			return nil, err
+		}
+		var nonce [24]byte
+		_, err = rand.Read(nonce[:])
+		if err != nil {
+			return nil, err
+		}
+		peerKey := peers[p].ShareKey
+		sealed[p] = box.Seal(nonce[:], msg, &nonce, &peerKey, c.shareKey)
+	}
+	return sealed, nil
+}
+
+// ReceiveShares opens the shares sealed for the client, by sender.
+// The senders are the participants of the aggregation.
+func (c *MaskingClient) ReceiveShares(sealed map[uint64][]byte) error {
+	if c.peers == nil {
+		return errors.New("[encryption.ReceiveShares]: secrets not shared yet")
+	}
+	if len(sealed) < c.Threshold {
+		return fmt.Errorf("[encryption.ReceiveShares]: %d participants, %d needed", len(sealed), c.Threshold)
+	}
+	c.received = make(map[uint64]maskingShare, len(sealed))
+	for from, s := range sealed {
+		keys, ok := c.peers[from]
+		if !ok || len(s) < 24 {
+			return fmt.Errorf("[encryption.ReceiveShares]: invalid share from %d", from)
+		}
+		var nonce [24]byte
+		copy(nonce[:], s)
+		msg, ok := box.Open(nil, s[24:], &nonce, &keys.ShareKey, c.shareKey)
+		if !ok {
+			return fmt.Errorf("[encryption.ReceiveShares]: share from %d was not sealed by it for this client", from)
+		}
+		share := maskingShare{}
+		err := json.Unmarshal(msg, &share)
+		if err != nil {
+			return err
+		}
+		if share.From != from || share.To != c.ID {
+			return fmt.Errorf("[encryption.ReceiveShares]: share from %d is for %d", share.From, share.To)
+		}
+		c.received[from] = share
+	}
+	c.participants = make([]uint64, 0, len(c.received))
+	for p := range c.received {
+		c.participants = append(c.participants, p)
+	}
+	sortIDs(c.participants)
+	return nil
+}
+
+// Ready returns whether the client received the shares of its peers
+func (c *MaskingClient) Ready() bool {
+	return c.participants != nil
+}
+
+// MaskVector encodes the values in fixed point and masks them
+func (c *MaskingClient) MaskVector(values []float64) ([]uint64, error) {
+	if c.participants == nil {
+		return nil, errors.New("[encryption.MaskVector]: shares not received yet")
+	}
+	masked := encodeFixedPoint(values)
+	addPRG(masked, c.seed, 1)
+	for _, p := range c.participants {
+		if p == c.ID {
+			continue
+		}
+		peerKey := c.peers[p].MaskKey
+		shared := new([32]byte)
+		box.Precompute(shared, &peerKey, c.maskKey)
+		addPRG(masked, shared[:], pairwiseSign(c.ID, p))
+	}
+	return masked, nil
+}
+
+// UnmaskingShares returns, for each participant, the share of its seed if it
+// survived (uploaded its vector), of its mask key otherwise. Only answers once.
+func (c *MaskingClient) UnmaskingShares(survivors []uint64) (map[uint64][]byte, error) {
+	if c.participants == nil {
+		return nil, errors.New("[encryption.UnmaskingShares]: shares not received yet")
+	}
+	if c.revealed {
+		return nil, errors.New("[encryption.UnmaskingShares]: shares already revealed")
+	}
+	if len(survivors) < c.Threshold {
+		return nil, fmt.Errorf("[encryption.UnmaskingShares]: %d survivors, %d needed", len(survivors), c.Threshold)
+	}
+	alive := make(map[uint64]bool, len(survivors))
+	for _, s := range survivors {
+		if _, ok := c.received[s]; !ok {
+			return nil, fmt.Errorf("[encryption.UnmaskingShares]: %d is not a participant", s)
+		}
+		alive[s] = true
+	}
+	c.revealed = true
+	shares := make(map[uint64][]byte, len(c.participants))
+	for _, p := range c.participants {
+		if alive[p] {
+			shares[p] = c.received[p].Seed
+		} else {
+			shares[p] = c.received[p].MaskKey
+		}
+	}
+	return shares, nil
+}
+
+// MaskingServer is the server side of one masked aggregation, it only learns
+// the sum of the vectors of the survivors.
+type MaskingServer struct {
+	Threshold    int
+	Keys         map[uint64]MaskingKeys
+	Participants []uint64            // shared their secrets
+	Masked       map[uint64][]uint64 // vectors of the survivors
+
+	unmasking map[uint64]map[uint64][]byte // shares, by responder
+}
+
+func NewMaskingServer(threshold int, keys map[uint64]MaskingKeys, participants []uint64) *MaskingServer {
+	return &MaskingServer{
+		Threshold:    threshold,
+		Keys:         keys,
+		Participants: sortIDs(append([]uint64(nil), participants...)),
+		Masked:       make(map[uint64][]uint64),
+		unmasking:    make(map[uint64]map[uint64][]byte),
+	}
+}
+
+// AddMasked records the masked vector of a participant
+func (s *MaskingServer) AddMasked(id uint64, masked []uint64) error {
+	if !ContainsID(s.Participants, id) {
+		return fmt.Errorf("[encryption.AddMasked]: %d is not a participant", id)
+	}
+	if _, ok := s.Masked[id]; ok {
+		return fmt.Errorf("[encryption.AddMasked]: %d already sent its vector", id)
+	}
+	for _, m := range s.Masked {
+		if len(m) != len(masked) {
+			return fmt.Errorf("[encryption.AddMasked]: vector of length %d, %d expected", len(masked), len(m))
+		}
+	}
+	s.Masked[id] = masked
+	return nil
+}
+
+// Survivors are the participants whose vector is in the sum
+func (s *MaskingServer) Survivors() []uint64 {
+	survivors := make([]uint64, 0, len(s.Masked))
+	for id := range s.Masked {
+		survivors = append(survivors, id)
+	}
+	return sortIDs(survivors)
+}
+
+// AddUnmaskingShares records the shares of a survivor, returns whether
+// enough survivors answered to unmask the sum.
+func (s *MaskingServer) AddUnmaskingShares(from uint64, shares map[uint64][]byte) (bool, error) {
+	if _, ok := s.Masked[from]; !ok {
+		return false, fmt.Errorf("[encryption.AddUnmaskingShares]: %d is not a survivor", from)
+	}
+	if len(shares) != len(s.Participants) {
+		return false, fmt.Errorf("[encryption.AddUnmaskingShares]: %d didn't send a share per participant", from)
+	}
+	s.unmasking[from] = shares
+	return len(s.unmasking) >= s.Threshold, nil
+}
+
+// Sum removes the masks from the sum of the survivors' vectors
+func (s *MaskingServer) Sum() ([]float64, error) {
+	if len(s.unmasking) < s.Threshold {
+		return nil, fmt.Errorf("[encryption.Sum]: %d survivors answered, %d needed", len(s.unmasking), s.Threshold)
+	}
+	survivors := s.Survivors()
+	if len(survivors) == 0 {
+		return nil, errors.New("[encryption.Sum]: no vector")
+	}
+	sum := make([]uint64, len(s.Masked[survivors[0]]))
+	for _, m := range s.Masked {
+		for i := range sum {
+			sum[i] += m[i]
+		}
+	}
+
+	responders := make([]uint64, 0, len(s.unmasking))
+	for id := range s.unmasking {
+		responders = append(responders, id)
+	}
+	responders = sortIDs(responders)[:s.Threshold]
+	for _, p := range s.Participants {
+		shares := make([]*big.Int, len(responders))
+		for i, r := range responders {
+			shares[i] = new(big.Int).SetBytes(s.unmasking[r][p])
+		}
+		secret, err := shamirCombine(responders, shares)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret.Bytes()) > 32 {
+			return nil, fmt.Errorf("[encryption.Sum]: invalid shares for %d", p)
+		}
+		b := make([]byte, 32)
+		secret.FillBytes(b)
+
+		if _, ok := s.Masked[p]; ok {
+			// Survivor, removes its self mask
+			addPRG(sum, b, -1)
+			continue
+		}
+		// Dropped, removes its pairwise masks from the survivors' vectors
+		maskKey := new([32]byte)
+		copy(maskKey[:], b)
+		for _, v := range survivors {
+			peerKey := s.Keys[v].MaskKey
+			shared := new([32]byte)
+			box.Precompute(shared, &peerKey, maskKey)
+			addPRG(sum, shared[:], -pairwiseSign(v, p))
+		}
+	}
+	return decodeFixedPoint(sum), nil
+}
+
+// ------------ MASKING UTILS ------------
+
+func encodeFixedPoint(values []float64) []uint64 {
+	encoded := make([]uint64, len(values))
+	for i, v := range values {
+		encoded[i] = uint64(int64(math.Round(v * (1 << MaskingScaleBits))))
+	}
+	return encoded
+}
+
+func decodeFixedPoint(values []uint64) []float64 {
+	decoded := make([]float64, len(values))
+	for i, v := range values {
+		decoded[i] = float64(int64(v)) / (1 << MaskingScaleBits)
+	}
+	return decoded
+}
+
+// Adds sign * PRG(seed) to values, modulo 2^64
+func addPRG(values []uint64, seed []byte, sign int) {
+	stream, err := chacha20.NewUnauthenticatedCipher(seed, make([]byte, chacha20.NonceSize))
+	if err != nil {
+		// 32-byte seeds, can't happen
+		panic(err)
+	}
+	buf := make([]byte, 8*len(values))
+	stream.XORKeyStream(buf, buf)
+	for i := range values {
+		mask := binary.LittleEndian.Uint64(buf[8*i:])
+		if sign > 0 {
+			values[i] += mask
+		} else {
+			values[i] -= mask
+		}
+	}
+}
+
+// The lower ID adds the pairwise mask, the higher one subtracts it
+func pairwiseSign(id uint64, peer uint64) int {
+	if id < peer {
+		return 1
+	}
+	return -1
+}
+
+func shamirSplit(secret *big.Int, threshold int, points []uint64) ([]*big.Int, error) {
+	coefficients := make([]*big.Int, threshold-1)
+	for i := range coefficients {
+		var err error
+		coefficients[i], err = rand.Int(rand.Reader, maskingField)
+		if err != nil {
+			return nil, err
+		}
+	}
+	shares := make([]*big.Int, len(points))
+	for i, p := range points {
+		x := new(big.Int).SetUint64(p)
+		y := big.NewInt(0)
+		for k := len(coefficients) - 1; k >= 0; k-- {
+			y.Add(y, coefficients[k]).Mul(y, x).Mod(y, maskingField)
+		}
+		shares[i] = y.Add(y, secret).Mod(y, maskingField)
+	}
+	return shares, nil
+}
+
+func shamirCombine(points []uint64, shares []*big.Int) (*big.Int, error) {
+	secret := big.NewInt(0)
+	for i, p := range points {
+		lambda, err := lagrangeCoefficient(p, points, maskingField)
+		if err != nil {
+			return nil, err
+		}
+		secret.Add(secret, lambda.Mul(lambda, shares[i])).Mod(secret, maskingField)
+	}
+	return secret, nil
+}
+
+func sortIDs(ids []uint64) []uint64 {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// ContainsID returns whether id is one of ids
+func ContainsID(ids []uint64, id uint64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
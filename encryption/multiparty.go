@@ -0,0 +1,128 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"errors"
+
+	"github.com/ldsec/lattigo/v2/ckks"
+	"github.com/ldsec/lattigo/v2/dckks"
+	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/rlwe"
+	"github.com/ldsec/lattigo/v2/utils"
+)
+
+// Size of the common reference string seed, in bytes
+const CRSSeedSize = 32
+
+// KeyGeneration is the server state of a collective public key generation:
+// the participants each hold a share of the secret key and send
+// crp*s_i + e_i, the sum of which is the public key of s = sum(s_i).
+type KeyGeneration struct {
+	Seed      []byte // common reference string, sent to the participants
+	Expected  []string
+	Received  map[string]bool
+	PublicKey *rlwe.PublicKey // set once every share is received
+
+	protocol  *dckks.CKGProtocol
+	crp       drlwe.CKGCRP
+	aggregate *drlwe.CKGShare
+}
+
+// NewCRSSeed draws a random seed for the common reference string
+func NewCRSSeed() ([]byte, error) {
+	seed := make([]byte, CRSSeedSize)
+	_, err := rand.Read(seed)
+	return seed, err
+}
+
+func sampleCKGCRP(protocol *dckks.CKGProtocol, seed []byte) (drlwe.CKGCRP, error) {
+	crs, err := utils.NewKeyedPRNG(seed)
+	if err != nil {
+		return drlwe.CKGCRP{}, err
+	}
+	return protocol.SampleCRP(crs), nil
+}
+
+// GenKeyGenShare draws a fresh secret key share for the client and returns
+// its public key share for the common reference string of seed.
+// The client can only decrypt collectively from then on.
+func (client *Client) GenKeyGenShare(seed []byte) (*drlwe.CKGShare, error) {
+	protocol := dckks.NewCKGProtocol(client.Params)
+	crp, err := sampleCKGCRP(protocol, seed)
+	if err != nil {
+		return nil, err
+	}
+
+	client.SecretKey = ckks.NewKeyGenerator(client.Params).GenSecretKey()
+	client.Decryptor = ckks.NewDecryptor(client.Params, client.SecretKey)
+
+	share := protocol.AllocateShares()
+	protocol.GenShare(client.SecretKey, crp, share)
+	return share, nil
+}
+
+// SetPublicKey makes the client encrypt under pk, such as the collective key
+func (client *Client) SetPublicKey(pk *rlwe.PublicKey) {
+	client.PublicKey = pk
+	client.Encryptor = ckks.NewEncryptor(client.Params, pk)
+}
+
+// StartKeyGeneration starts a collective key generation among participants
+func (s *Server) StartKeyGeneration(participants []string) (*KeyGeneration, error) {
+	if len(participants) == 0 {
+		return nil, errors.New("[encryption.StartKeyGeneration]: no participant")
+	}
+	seed, err := NewCRSSeed()
+	if err != nil {
+		return nil, err
+	}
+	protocol := dckks.NewCKGProtocol(s.Params)
+	crp, err := sampleCKGCRP(protocol, seed)
+	if err != nil {
+		return nil, err
+	}
+
+	s.KeyGeneration = &KeyGeneration{
+		Seed:      seed,
+		Expected:  participants,
+		Received:  make(map[string]bool),
+		protocol:  protocol,
+		crp:       crp,
+		aggregate: protocol.AllocateShares(),
+	}
+	return s.KeyGeneration, nil
+}
+
+// AddKeyGenShare aggregates the share of a participant, and generates
+// the collective public key once every participant sent its share.
+func (s *Server) AddKeyGenShare(participant string, share *drlwe.CKGShare) (done bool, err error) {
+	kg := s.KeyGeneration
+	if kg == nil || kg.PublicKey != nil {
+		return false, errors.New("[encryption.AddKeyGenShare]: no key generation in progress")
+	}
+	if !contains(kg.Expected, participant) {
+		return false, errors.New("[encryption.AddKeyGenShare]: " + participant + " is not part of the key generation")
+	}
+	if kg.Received[participant] {
+		return false, errors.New("[encryption.AddKeyGenShare]: " + participant + " already sent its share")
+	}
+
+	kg.protocol.AggregateShares(kg.aggregate, share, kg.aggregate)
+	kg.Received[participant] = true
+	if len(kg.Received) < len(kg.Expected) {
+		return false, nil
+	}
+
+	kg.PublicKey = ckks.NewPublicKey(s.Params)
+	kg.protocol.GenPublicKey(kg.aggregate, kg.crp, kg.PublicKey)
+	return true, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package encryption
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ldsec/lattigo/v2/ckks"
+)
+
+// AddValuesNew adds values to those encrypted in v, for instance noise
+// drawn by the server. Known to the server, the values are encoded at the
+// level and scale of v rather than encrypted.
+func (s *Server) AddValuesNew(v *EncryptedVector, values []float64) (*EncryptedVector, error) {
+	if len(values) != v.Length {
+		return nil, fmt.Errorf("[encryption.AddValuesNew]: %d values for a vector of length %d", len(values), v.Length)
+	}
+	if len(v.Chunks) == 0 {
+		return nil, errors.New("[encryption.AddValuesNew]: empty vector")
+	}
+	level, scale := v.Chunks[0].Level(), v.Chunks[0].Scale
+	for _, c := range v.Chunks {
+		if c.Level() != level || c.Scale != scale {
+			return nil, errors.New("[encryption.AddValuesNew]: chunks at different levels or scales")
+		}
+	}
+	plaintexts := v.encode(ckks.NewEncoder(s.Params), s.Params, values, level, scale)
+	if len(plaintexts) != len(v.Chunks) {
+		return nil, errors.New("[encryption.AddValuesNew]: number of chunks doesn't match the length")
+	}
+	res := &EncryptedVector{Length: v.Length, Encoding: v.Encoding, LogSlots: v.LogSlots, Chunks: make([]*ckks.Ciphertext, len(v.Chunks))}
+	for i, c := range v.Chunks {
+		res.Chunks[i] = s.Evaluator.AddNew(c, plaintexts[i])
+	}
+	return res, nil
+}
@@ -0,0 +1,406 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ldsec/lattigo/v2/ckks"
+	"github.com/ldsec/lattigo/v2/dckks"
+	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/rlwe"
+	"github.com/ldsec/lattigo/v2/utils"
+)
+
+// The squared L2 norm of an encrypted vector is computed by the server
+// without decrypting it, each chunk being multiplied, with relinearization:
+//   - in slots, by itself, the squares being summed into every slot by
+//     rotations, which encodes the constant polynomial of the norm,
+//   - in coefficients, by its conjugate m(1/X), whose constant coefficient
+//     sums the squares, the others being zeroed by a trace.
+// Either way, the result only decrypts to the norm.
+
+// NormGaloisElements are those of the rotation keys the norm needs
+func NormGaloisElements(params ckks.Parameters) []uint64 {
+	return params.GaloisElementsForRowInnerSum()
+}
+
+// GenNormKeys generates, from the client's secret key, the relinearization
+// and rotation keys the server needs to compute norms
+func (client *Client) GenNormKeys() (*rlwe.RelinearizationKey, *rlwe.RotationKeySet, error) {
+	if !client.CanDecrypt() {
+		return nil, nil, errors.New("[encryption.GenNormKeys]: no secret key")
+	}
+	kgen := ckks.NewKeyGenerator(client.Params)
+	rlk := kgen.GenRelinearizationKey(client.SecretKey, 2)
+	rtks := kgen.GenRotationKeys(NormGaloisElements(client.Params), client.SecretKey)
+	return rlk, rtks, nil
+}
+
+// NormKeyGeneration is the server state of the collective generation of the
+// norm keys of a collective secret: the rotation keys take one round of
+// shares, the relinearization key two, the second on the aggregate of the
+// first (RelinRoundOne).
+type NormKeyGeneration struct {
+	Seed          []byte // common reference string, sent to the participants
+	Expected      []string
+	Received      map[string]bool // shares of the current round
+	RelinRoundOne *drlwe.RKGShare // set once every first round share is received
+	Done          bool            // once the server has the norm keys
+
+	rkg       *dckks.RKGProtocol
+	rtg       *dckks.RTGProtocol
+	rkgCRP    drlwe.RKGCRP
+	rtgCRPs   map[uint64]drlwe.RTGCRP
+	relin     *drlwe.RKGShare // aggregates of the shares
+	rotations map[uint64]*drlwe.RTGShare
+}
+
+// NormKeyShares are the shares of a participant in the first round
+type NormKeyShares struct {
+	Relin     *drlwe.RKGShare
+	Rotations map[uint64]*drlwe.RTGShare // by Galois element
+}
+
+// Samples the common reference polynomials of the relinearization key and
+// of each rotation key, in the order of NormGaloisElements
+func sampleNormCRPs(params ckks.Parameters, rkg *dckks.RKGProtocol, rtg *dckks.RTGProtocol, seed []byte) (drlwe.RKGCRP, map[uint64]drlwe.RTGCRP, error) {
+	crs, err := utils.NewKeyedPRNG(seed)
+	if err != nil {
+		return nil, nil, err
+	}
+	rkgCRP := rkg.SampleCRP(crs)
+	rtgCRPs := make(map[uint64]drlwe.RTGCRP)
+	for _, galEl := range NormGaloisElements(params) {
+		rtgCRPs[galEl] = rtg.SampleCRP(crs)
+	}
+	return rkgCRP, rtgCRPs, nil
+}
+
+// GenNormKeyShares returns the client's shares of the norm keys of the
+// collective secret, for the common reference string of seed. The
+// relinearization key needs a second round, see GenRelinShare.
+func (client *Client) GenNormKeyShares(seed []byte) (*NormKeyShares, error) {
+	if !client.CanDecrypt() {
+		return nil, errors.New("[encryption.GenNormKeyShares]: no secret key")
+	}
+	rkg := dckks.NewRKGProtocol(client.Params)
+	rtg := dckks.NewRotKGProtocol(client.Params)
+	rkgCRP, rtgCRPs, err := sampleNormCRPs(client.Params, rkg, rtg, seed)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeral, relin, _ := rkg.AllocateShares()
+	rkg.GenShareRoundOne(client.SecretKey, rkgCRP, ephemeral, relin)
+	client.relinEphemeral = ephemeral
+	shares := &NormKeyShares{Relin: relin, Rotations: make(map[uint64]*drlwe.RTGShare)}
+	for galEl, crp := range rtgCRPs {
+		share := rtg.AllocateShares()
+		rtg.GenShare(client.SecretKey, galEl, crp, share)
+		shares.Rotations[galEl] = share
+	}
+	return shares, nil
+}
+
+// GenRelinShare returns the client's share of the second round of the
+// relinearization key, on the aggregate of the first. Answers once per
+// GenNormKeyShares.
+func (client *Client) GenRelinShare(roundOne *drlwe.RKGShare) (*drlwe.RKGShare, error) {
+	if client.relinEphemeral == nil || !client.CanDecrypt() {
+		return nil, errors.New("[encryption.GenRelinShare]: no relinearization key generation in progress")
+	}
+	rkg := dckks.NewRKGProtocol(client.Params)
+	_, _, share := rkg.AllocateShares()
+	rkg.GenShareRoundTwo(client.relinEphemeral, client.SecretKey, roundOne, share)
+	client.relinEphemeral = nil
+	return share, nil
+}
+
+// StartNormKeyGeneration starts the generation of the norm keys of the
+// collective secret shared by participants
+func (s *Server) StartNormKeyGeneration(participants []string) (*NormKeyGeneration, error) {
+	if len(participants) == 0 {
+		return nil, errors.New("[encryption.StartNormKeyGeneration]: no participant")
+	}
+	seed, err := NewCRSSeed()
+	if err != nil {
+		return nil, err
+	}
+	rkg := dckks.NewRKGProtocol(s.Params)
+	rtg := dckks.NewRotKGProtocol(s.Params)
+	rkgCRP, rtgCRPs, err := sampleNormCRPs(s.Params, rkg, rtg, seed)
+	if err != nil {
+		return nil, err
+	}
+
+	nkg := &NormKeyGeneration{
+		Seed:      seed,
+		Expected:  participants,
+		Received:  make(map[string]bool),
+		rkg:       rkg,
+		rtg:       rtg,
+		rkgCRP:    rkgCRP,
+		rtgCRPs:   rtgCRPs,
+		rotations: make(map[uint64]*drlwe.RTGShare),
+	}
+	_, nkg.relin, _ = rkg.AllocateShares()
+	for galEl := range rtgCRPs {
+		nkg.rotations[galEl] = rtg.AllocateShares()
+	}
+	s.NormKeyGeneration = nkg
+	return nkg, nil
+}
+
+// Checks participant can send a share of the current round
+func (nkg *NormKeyGeneration) expects(participant string, second bool, handler string) error {
+	if nkg == nil || nkg.Done || (nkg.RelinRoundOne != nil) != second {
+		return errors.New("[encryption." + handler + "]: no norm key generation round in progress")
+	}
+	if !contains(nkg.Expected, participant) {
+		return errors.New("[encryption." + handler + "]: " + participant + " is not part of the norm key generation")
+	}
+	if nkg.Received[participant] {
+		return errors.New("[encryption." + handler + "]: " + participant + " already sent its shares")
+	}
+	return nil
+}
+
+// AddNormKeyShares aggregates the first round shares of a participant,
+// returns whether every participant sent them: RelinRoundOne is then set.
+func (s *Server) AddNormKeyShares(participant string, shares *NormKeyShares) (bool, error) {
+	nkg := s.NormKeyGeneration
+	err := nkg.expects(participant, false, "AddNormKeyShares")
+	if err != nil {
+		return false, err
+	}
+	if shares.Relin == nil {
+		return false, errors.New("[encryption.AddNormKeyShares]: no share of the relinearization key")
+	}
+	for galEl := range nkg.rtgCRPs {
+		if shares.Rotations[galEl] == nil {
+			return false, fmt.Errorf("[encryption.AddNormKeyShares]: no share of the rotation key %d", galEl)
+		}
+	}
+
+	nkg.rkg.AggregateShares(nkg.relin, shares.Relin, nkg.relin)
+	for galEl, share := range nkg.rotations {
+		nkg.rtg.Aggregate(share, shares.Rotations[galEl], share)
+	}
+	nkg.Received[participant] = true
+	if len(nkg.Received) < len(nkg.Expected) {
+		return false, nil
+	}
+
+	nkg.RelinRoundOne = nkg.relin
+	_, nkg.relin, _ = nkg.rkg.AllocateShares()
+	nkg.Received = make(map[string]bool)
+	return true, nil
+}
+
+// AddRelinShare aggregates the second round share of a participant, and
+// sets the norm keys once every participant sent it
+func (s *Server) AddRelinShare(participant string, share *drlwe.RKGShare) (bool, error) {
+	nkg := s.NormKeyGeneration
+	err := nkg.expects(participant, true, "AddRelinShare")
+	if err != nil {
+		return false, err
+	}
+	nkg.rkg.AggregateShares(nkg.relin, share, nkg.relin)
+	nkg.Received[participant] = true
+	if len(nkg.Received) < len(nkg.Expected) {
+		return false, nil
+	}
+
+	rlk := ckks.NewRelinearizationKey(s.Params)
+	nkg.rkg.GenRelinearizationKey(nkg.RelinRoundOne, nkg.relin, rlk)
+	rtks := ckks.NewRotationKeySet(s.Params, NormGaloisElements(s.Params))
+	for galEl, share := range nkg.rotations {
+		nkg.rtg.GenRotationKey(share, nkg.rtgCRPs[galEl], rtks.Keys[galEl])
+	}
+	s.SetNormKeys(rlk, rtks)
+	nkg.Done = true
+	return true, nil
+}
+
+// Shares of the norm keys in a packet
+type normKeySharesContent struct {
+	Relin     string
+	Rotations map[uint64]string
+}
+
+// MarshalNormKeyShares encodes shares for a packet
+func MarshalNormKeyShares(shares *NormKeyShares) (string, error) {
+	content := normKeySharesContent{
+		Relin:     MarshalToBase64String(shares.Relin),
+		Rotations: make(map[uint64]string),
+	}
+	for galEl, share := range shares.Rotations {
+		content.Rotations[galEl] = MarshalToBase64String(share)
+	}
+	b, err := json.Marshal(content)
+	return string(b), err
+}
+
+// UnmarshalNormKeyShares reads shares sent in a packet, checking they match
+// the parameters
+func UnmarshalNormKeyShares(params ckks.Parameters, input string) (*NormKeyShares, error) {
+	content := normKeySharesContent{}
+	err := json.Unmarshal([]byte(input), &content)
+	if err != nil {
+		return nil, err
+	}
+	relin, err := UnmarshalRelinShare(params, content.Relin)
+	if err != nil {
+		return nil, err
+	}
+	shares := &NormKeyShares{Relin: relin, Rotations: make(map[uint64]*drlwe.RTGShare)}
+	for galEl, s := range content.Rotations {
+		b, err := sharePolys(params, s, 1, "UnmarshalNormKeyShares")
+		if err != nil {
+			return nil, err
+		}
+		share := new(drlwe.RTGShare)
+		err = share.UnmarshalBinary(b)
+		if err != nil {
+			return nil, err
+		}
+		err = checkPolys(params, share.Value, "UnmarshalNormKeyShares")
+		if err != nil {
+			return nil, err
+		}
+		shares.Rotations[galEl] = share
+	}
+	return shares, nil
+}
+
+// UnmarshalRelinShare reads a relinearization key share sent in a packet,
+// checking it matches the parameters
+func UnmarshalRelinShare(params ckks.Parameters, input string) (*drlwe.RKGShare, error) {
+	b, err := sharePolys(params, input, 2, "UnmarshalRelinShare")
+	if err != nil {
+		return nil, err
+	}
+	share := new(drlwe.RKGShare)
+	err = share.UnmarshalBinary(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range share.Value {
+		err = checkPolys(params, v[:], "UnmarshalRelinShare")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return share, nil
+}
+
+// Lattigo doesn't check the size of what it reads: a share is the number
+// of decomposition elements, then perElement polynomials for each
+func sharePolys(params ckks.Parameters, input string, perElement int, handler string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(input)
+	if err != nil {
+		return nil, err
+	}
+	poly := params.RingQP().NewPoly()
+	if len(b) != 1+perElement*params.Beta()*poly.GetDataLen(true) || int(b[0]) != params.Beta() {
+		return nil, errors.New("[encryption." + handler + "]: share doesn't match the parameters")
+	}
+	return b, nil
+}
+
+func checkPolys(params ckks.Parameters, polys []rlwe.PolyQP, handler string) error {
+	for _, p := range polys {
+		if p.Q.Degree() != params.N() || p.Q.Level() != params.QCount()-1 || p.P.Level() != params.PCount()-1 {
+			return errors.New("[encryption." + handler + "]: share doesn't match the parameters")
+		}
+	}
+	return nil
+}
+
+// SetNormKeys makes the server evaluate with rlk and rtks
+func (s *Server) SetNormKeys(rlk *rlwe.RelinearizationKey, rtks *rlwe.RotationKeySet) {
+	s.RelinearizationKey = rlk
+	s.RotationKeys = rtks
+	s.Evaluator = ckks.NewEvaluator(s.Params, rlwe.EvaluationKey{Rlk: rlk, Rtks: rtks})
+}
+
+// SquaredNormNew returns the encrypted squared L2 norm of v, as a vector of
+// length 1 that can be decrypted or released like any other
+func (s *Server) SquaredNormNew(v *EncryptedVector) (*EncryptedVector, error) {
+	if len(v.Chunks) == 0 {
+		return nil, errors.New("[encryption.SquaredNormNew]: empty vector")
+	}
+	if s.RotationKeys == nil {
+		return nil, errors.New("[encryption.SquaredNormNew]: no rotation keys, see SetNormKeys")
+	}
+	for _, galEl := range NormGaloisElements(s.Params) {
+		if _, ok := s.RotationKeys.GetRotationKey(galEl); !ok {
+			return nil, errors.New("[encryption.SquaredNormNew]: missing rotation keys, see SetNormKeys")
+		}
+	}
+
+	var sum *ckks.Ciphertext
+	for _, c := range v.Chunks {
+		if c.Degree() != 1 || c.Level() == 0 {
+			return nil, errors.New("[encryption.SquaredNormNew]: no level left for the multiplication")
+		}
+		other := c
+		if v.Encoding != SlotsEncoding {
+			other = s.ConjugateNew(c)
+		}
+		square := s.MulRelinNew(c, other)
+		err := s.Rescale(square, s.Params.DefaultScale(), square)
+		if err != nil {
+			return nil, err
+		}
+
+		var norm *ckks.Ciphertext
+		if v.Encoding == SlotsEncoding {
+			norm = ckks.NewCiphertext(s.Params, 1, square.Level(), square.Scale)
+			s.InnerSumLog(square, 1, 1<<v.LogSlots, norm)
+		} else {
+			// Sum over the subgroup generated by 5, then over its conjugates:
+			// twice the constant coefficient, halved exactly through the scale
+			norm = s.TraceNew(square, 0, s.Params.LogN()-1)
+			s.Add(norm, s.ConjugateNew(norm), norm)
+			norm.Scale *= 2
+		}
+		if sum == nil {
+			sum = norm
+		} else {
+			s.Add(sum, norm, sum)
+		}
+	}
+	return &EncryptedVector{Length: 1, Encoding: CoeffsEncoding, Chunks: []*ckks.Ciphertext{sum}}, nil
+}
+
+// SquaredNormsNew returns the encrypted squared L2 norms of vs, coefficient
+// i being that of vs[i], so that they are released together
+func (s *Server) SquaredNormsNew(vs []*EncryptedVector) (*EncryptedVector, error) {
+	if len(vs) == 0 || len(vs) > s.Params.N() {
+		return nil, fmt.Errorf("[encryption.SquaredNormsNew]: %d vectors, at most %d", len(vs), s.Params.N())
+	}
+	encoder := ckks.NewEncoder(s.Params)
+	var sum *ckks.Ciphertext
+	for i, v := range vs {
+		norm, err := s.SquaredNormNew(v)
+		if err != nil {
+			return nil, err
+		}
+		c := norm.Chunks[0]
+		if sum == nil {
+			sum = c
+			continue
+		}
+		if c.Level() != sum.Level() || c.Scale != sum.Scale {
+			return nil, errors.New("[encryption.SquaredNormsNew]: norms at different levels or scales")
+		}
+		// The norm is a constant polynomial, moved to coefficient i by X^i
+		monomial := make([]float64, i+1)
+		monomial[i] = 1
+		s.MulAndAdd(c, encoder.EncodeCoeffsNew(monomial, c.Level(), 1), sum)
+	}
+	return &EncryptedVector{Length: len(vs), Encoding: CoeffsEncoding, Chunks: []*ckks.Ciphertext{sum}}, nil
+}
@@ -0,0 +1,151 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/ldsec/lattigo/v2/ckks"
+	"github.com/ldsec/lattigo/v2/rlwe"
+)
+
+// Largest logQP ensuring 128 bits of classical security, per LogN
+// (homomorphic encryption standard, as for lattigo's default parameters)
+var MaxLogQP = map[int]int{12: 109, 13: 218, 14: 438, 15: 881, 16: 1761}
+
+const (
+	MinLogN = 12
+	MaxLogN = 16
+
+	// Above, LogN is only raised for security, weights being split over ciphertexts
+	MaxPreferredLogN = 14
+
+	// Bound on the absolute values encrypted, if not given
+	DefaultMagnitude = 1 << 10
+
+	// Bits lost to the encryption noise, before the sum over participants
+	noiseBits = 10
+
+	maxModulusBits = 60
+	minScaleBits   = 20
+)
+
+// Requirements are what the parameters must allow for
+type Requirements struct {
+	Weights         int     // values per vector
+	Precision       int     // decimal digits kept after the point
+	Participants    int     // vectors summed, 1 if 0
+	Multiplications int     // scaling multiplications, such as the averaging
+	Magnitude       float64 // bound on the absolute values, DefaultMagnitude if 0
+}
+
+// DefaultParameters returns the parameters nodes use unless set otherwise
+func DefaultParameters() ckks.Parameters {
+	params, err := ckks.NewParametersFromLiteral(ckks.DefaultParams[1])
+	if err != nil {
+		// Built-in parameters, can't happen
+		panic(err)
+	}
+	return params
+}
+
+// SelectParameters picks the smallest secure parameters meeting the requirements:
+// the scale keeps the precision above the noise, the first modulus keeps the
+// sums over participants, and there is one modulus per scaling multiplication.
+func SelectParameters(req Requirements) (ckks.Parameters, error) {
+	literal, err := SelectParametersLiteral(req)
+	if err != nil {
+		return ckks.Parameters{}, err
+	}
+	return ckks.NewParametersFromLiteral(literal)
+}
+
+// SelectParametersLiteral is SelectParameters, before the moduli are generated
+func SelectParametersLiteral(req Requirements) (ckks.ParametersLiteral, error) {
+	if req.Weights < 0 || req.Precision < 0 || req.Participants < 0 || req.Multiplications < 0 || req.Magnitude < 0 {
+		return ckks.ParametersLiteral{}, errors.New("[encryption.SelectParameters]: negative requirement")
+	}
+	participants := req.Participants
+	if participants == 0 {
+		participants = 1
+	}
+	magnitude := req.Magnitude
+	if magnitude == 0 {
+		magnitude = DefaultMagnitude
+	}
+
+	sumBits := int(math.Ceil(math.Log2(float64(participants))))
+	logScale := int(math.Ceil(float64(req.Precision)*math.Log2(10))) + noiseBits + sumBits
+	if logScale < minScaleBits {
+		logScale = minScaleBits
+	}
+	// One bit for the sign
+	logQ0 := logScale + int(math.Ceil(math.Log2(magnitude*float64(participants)))) + 1
+	if logQ0 > maxModulusBits {
+		return ckks.ParametersLiteral{}, fmt.Errorf("[encryption.SelectParameters]: %d decimal digits of values up to %g need a %d bits modulus, more than %d",
+			req.Precision, magnitude*float64(participants), logQ0, maxModulusBits)
+	}
+
+	logQ := []int{logQ0}
+	for i := 0; i < req.Multiplications; i++ {
+		logQ = append(logQ, logScale)
+	}
+	// Key switching modulus, above every modulus of Q
+	logP := []int{logQ0 + 1}
+	logQP := logQ0 + 1
+	for _, q := range logQ {
+		logQP += q
+	}
+
+	logN := MinLogN
+	for logN <= MaxLogN && MaxLogQP[logN] < logQP {
+		logN++
+	}
+	if logN > MaxLogN {
+		return ckks.ParametersLiteral{}, fmt.Errorf("[encryption.SelectParameters]: logQP of %d bits can't be secure", logQP)
+	}
+	for logN < MaxPreferredLogN && req.Weights > 1<<logN {
+		logN++
+	}
+
+	return ckks.ParametersLiteral{
+		LogN:         logN,
+		LogQ:         logQ,
+		LogP:         logP,
+		Sigma:        rlwe.DefaultSigma,
+		LogSlots:     logN - 1,
+		DefaultScale: float64(uint64(1) << logScale),
+	}, nil
+}
+
+// MarshalParameters returns the parameters as a base-64 string, to be sent in a packet
+func MarshalParameters(params ckks.Parameters) (string, error) {
+	b, err := params.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// UnmarshalParameters reads parameters sent in a packet, checking they are secure
+func UnmarshalParameters(input string) (ckks.Parameters, error) {
+	b, err := base64.StdEncoding.DecodeString(input)
+	if err != nil {
+		return ckks.Parameters{}, err
+	}
+	// Lattigo doesn't check the size of what it reads: logN, #Q, #P, sigma,
+	// ring type and moduli, then logSlots and scale
+	if len(b) < 12 || len(b) != 12+8*(int(b[1])+int(b[2]))+9 {
+		return ckks.Parameters{}, errors.New("[encryption.UnmarshalParameters]: truncated parameters")
+	}
+	params := ckks.Parameters{}
+	err = params.UnmarshalBinary(b)
+	if err != nil {
+		return ckks.Parameters{}, err
+	}
+	if maxLogQP, ok := MaxLogQP[params.LogN()]; !ok || params.LogQP() > maxLogQP {
+		return ckks.Parameters{}, fmt.Errorf("[encryption.UnmarshalParameters]: logN %d and logQP %d are not secure", params.LogN(), params.LogQP())
+	}
+	return params, nil
+}
@@ -0,0 +1,114 @@
+package encryption
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/ldsec/lattigo/v2/ckks"
+)
+
+// Precision of a float64, reported when decryption is exact
+const MaxPrecisionBits = 53
+
+// Below, the values risk to wrap around the modulus
+const MinHeadroomBits = 5
+
+// PrecisionStats describes the precision of a decrypted vector. Errors and
+// precisions need the reference values, the budget fields don't.
+type PrecisionStats struct {
+	Errors       []float64 // decrypted minus reference, per value
+	MaxError     float64
+	MinPrecision float64 // bits, -log2 of the error
+	AvgPrecision float64
+	MaxPrecision float64
+
+	Level    int     // levels left, over all chunks
+	LogScale float64 // of the chunk with the largest scale
+	Headroom float64 // bits between the largest value and the modulus
+}
+
+// NewPrecisionStats compares values, decrypted from v, to the reference
+// values if not nil, and measures what is left of the modulus of v.
+func NewPrecisionStats(params ckks.Parameters, v *EncryptedVector, values []float64, reference []float64) (PrecisionStats, error) {
+	if len(v.Chunks) == 0 {
+		return PrecisionStats{}, errors.New("[encryption.NewPrecisionStats]: empty vector")
+	}
+	stats := PrecisionStats{Level: v.Chunks[0].Level()}
+	for _, c := range v.Chunks {
+		if c.Level() < stats.Level {
+			stats.Level = c.Level()
+		}
+		if math.Log2(c.Scale) > stats.LogScale {
+			stats.LogScale = math.Log2(c.Scale)
+		}
+	}
+	logQ := 0.0
+	for _, q := range params.RingQ().Modulus[:stats.Level+1] {
+		logQ += math.Log2(float64(q))
+	}
+	maxValue := 1.0
+	for _, value := range values {
+		maxValue = math.Max(maxValue, math.Abs(value))
+	}
+	// One bit for the sign
+	stats.Headroom = logQ - stats.LogScale - math.Log2(maxValue) - 1
+
+	if reference == nil {
+		return stats, nil
+	}
+	if len(reference) != len(values) {
+		return PrecisionStats{}, fmt.Errorf("[encryption.NewPrecisionStats]: %d values for %d references", len(values), len(reference))
+	}
+	stats.Errors = make([]float64, len(values))
+	stats.MinPrecision = MaxPrecisionBits
+	sum := 0.0
+	for i := range values {
+		stats.Errors[i] = values[i] - reference[i]
+		err := math.Abs(stats.Errors[i])
+		stats.MaxError = math.Max(stats.MaxError, err)
+		sum += err
+		precision := precisionBits(err)
+		stats.MinPrecision = math.Min(stats.MinPrecision, precision)
+		stats.MaxPrecision = math.Max(stats.MaxPrecision, precision)
+	}
+	if len(values) > 0 {
+		stats.AvgPrecision = precisionBits(sum / float64(len(values)))
+	}
+	return stats, nil
+}
+
+func precisionBits(err float64) float64 {
+	if err == 0 {
+		return MaxPrecisionBits
+	}
+	return math.Min(-math.Log2(err), MaxPrecisionBits)
+}
+
+// DecryptVectorWithStats decrypts v and measures its precision,
+// against reference if not nil.
+func (client *Client) DecryptVectorWithStats(v *EncryptedVector, reference []float64) ([]float64, PrecisionStats, error) {
+	values, err := client.DecryptVector(v)
+	if err != nil {
+		return nil, PrecisionStats{}, err
+	}
+	stats, err := NewPrecisionStats(client.Params, v, values, reference)
+	return values, stats, err
+}
+
+// TooTight returns whether the parameters leave too little room to the values
+func (stats PrecisionStats) TooTight() bool {
+	return stats.Headroom < MinHeadroomBits
+}
+
+func (stats PrecisionStats) String() string {
+	s := fmt.Sprintf("level %d, scale 2^%.1f, headroom %.1f bits", stats.Level, stats.LogScale, stats.Headroom)
+	if stats.Errors != nil {
+		s += fmt.Sprintf(", precision min %.1f avg %.1f max %.1f bits (max error %.3g)",
+			stats.MinPrecision, stats.AvgPrecision, stats.MaxPrecision, stats.MaxError)
+	}
+	if stats.TooTight() {
+		s += ", parameters too tight"
+	}
+	return s
+}
@@ -0,0 +1,79 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"github.com/ldsec/lattigo/v2/ckks"
+	"github.com/ldsec/lattigo/v2/rlwe"
+)
+
+// Public-key mode: clients only encrypt, the secret key stays with the party
+// that decrypts, which distributes the public key.
+
+// NewPublicKeyClient returns a client that can encrypt under pk but holds no
+// secret key, hence can't decrypt.
+func NewPublicKeyClient(pk *rlwe.PublicKey) Client {
+	client := NewClient()
+	client.DropSecretKey()
+	client.SetPublicKey(pk)
+	return client
+}
+
+// GenKeyPair draws a fresh key pair for the client, which decrypts with the
+// secret key and encrypts with the public key. The public key is returned
+// to be distributed.
+func (client *Client) GenKeyPair() *rlwe.PublicKey {
+	sk, pk := ckks.NewKeyGenerator(client.Params).GenKeyPair()
+	client.SecretKey = sk
+	client.Decryptor = ckks.NewDecryptor(client.Params, sk)
+	client.SetPublicKey(pk)
+	return pk
+}
+
+// DropSecretKey removes the secret key material of the client, which can
+// still encrypt if it has a public key.
+func (client *Client) DropSecretKey() {
+	client.SecretKey = nil
+	client.Decryptor = nil
+	if client.PublicKey == nil {
+		client.Encryptor = nil
+	}
+}
+
+// CanDecrypt returns whether the client holds a secret key
+func (client *Client) CanDecrypt() bool {
+	return client.Decryptor != nil
+}
+
+// MarshalPublicKey returns the public key as a base-64 string, to be sent in a packet
+func MarshalPublicKey(pk *rlwe.PublicKey) (string, error) {
+	if pk == nil {
+		return "", errors.New("[encryption.MarshalPublicKey]: no public key")
+	}
+	return MarshalToBase64String(pk), nil
+}
+
+// UnmarshalPublicKey reads a public key sent in a packet,
+// checking it matches the parameters.
+func UnmarshalPublicKey(params ckks.Parameters, input string) (*rlwe.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(input)
+	if err != nil {
+		return nil, err
+	}
+	// Lattigo doesn't check the size of what it reads
+	pk := ckks.NewPublicKey(params)
+	if len(b) != pk.GetDataLen(true) {
+		return nil, errors.New("[encryption.UnmarshalPublicKey]: public key doesn't match the parameters")
+	}
+	err = pk.UnmarshalBinary(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pk.Value {
+		if p.Q.Degree() != params.N() || p.Q.Level() != params.QCount()-1 || p.P.Level() != params.PCount()-1 {
+			return nil, errors.New("[encryption.UnmarshalPublicKey]: public key doesn't match the parameters")
+		}
+	}
+	return pk, nil
+}
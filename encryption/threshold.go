@@ -0,0 +1,255 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ldsec/lattigo/v2/ckks"
+	"github.com/ldsec/lattigo/v2/dckks"
+	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/rlwe"
+	"github.com/ldsec/lattigo/v2/utils"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Standard deviation of the noise flooding the decryption shares
+const SmudgingSigma = 3.2
+
+// Collective decryption. Under a collective key s = sum(s_i), each party
+// sends a key-switching share of the ciphertext towards either the zero key
+// (release in plaintext) or a target public key (re-encryption).
+//
+// For t-out-of-N, every party additionally Shamir-shares its s_i at the
+// points of the N parties. Party j sums the shares received into S_j, and
+// any set of t parties can use lambda_j * S_j instead of s_j, lambda_j
+// being its Lagrange coefficient in the set.
+
+// GenShamirShares splits the client's secret key share into one share per
+// point, any threshold of which can reconstruct it.
+func (client *Client) GenShamirShares(threshold int, points []uint64) ([]*rlwe.SecretKey, error) {
+	if client.SecretKey == nil {
+		return nil, errors.New("[encryption.GenShamirShares]: no secret key")
+	}
+	if threshold < 1 || threshold > len(points) {
+		return nil, fmt.Errorf("[encryption.GenShamirShares]: threshold must be in [1, %d]", len(points))
+	}
+	for _, x := range points {
+		if x == 0 {
+			return nil, errors.New("[encryption.GenShamirShares]: point 0 would reveal the secret")
+		}
+	}
+
+	ringQP := client.Params.RingQP()
+	prng, err := utils.NewPRNG()
+	if err != nil {
+		return nil, err
+	}
+	sampler := rlwe.NewUniformSamplerQP(client.Params.Parameters, prng, ringQP)
+	coefficients := make([]rlwe.PolyQP, threshold-1)
+	for i := range coefficients {
+		coefficients[i] = ringQP.NewPoly()
+		sampler.Read(&coefficients[i])
+	}
+
+	shares := make([]*rlwe.SecretKey, len(points))
+	for i, x := range points {
+		// Horner: f(x) = s + x*(a_1 + x*(a_2 + ...))
+		share := ckks.NewSecretKey(client.Params)
+		for k := len(coefficients) - 1; k >= 0; k-- {
+			ringQP.AddLvl(client.Params.QCount()-1, client.Params.PCount()-1, share.Value, coefficients[k], share.Value)
+			client.mulScalarQP(share.Value, new(big.Int).SetUint64(x))
+		}
+		ringQP.AddLvl(client.Params.QCount()-1, client.Params.PCount()-1, share.Value, client.SecretKey.Value, share.Value)
+		shares[i] = share
+	}
+	return shares, nil
+}
+
+// SetShamirShares sums the shares received from every party into the
+// client's threshold key.
+func (client *Client) SetShamirShares(shares []*rlwe.SecretKey) {
+	key := ckks.NewSecretKey(client.Params)
+	for _, s := range shares {
+		client.Params.RingQP().AddLvl(client.Params.QCount()-1, client.Params.PCount()-1, key.Value, s.Value, key.Value)
+	}
+	client.ThresholdKey = key
+}
+
+// LagrangeCoefficient returns prod_{k != point} x_k / (x_k - point) mod QP
+func LagrangeCoefficient(params ckks.Parameters, point uint64, set []uint64) (*big.Int, error) {
+	return lagrangeCoefficient(point, set, new(big.Int).Mul(params.RingQ().ModulusBigint, params.RingP().ModulusBigint))
+}
+
+func lagrangeCoefficient(point uint64, set []uint64, modulus *big.Int) (*big.Int, error) {
+	num := big.NewInt(1)
+	den := big.NewInt(1)
+	found := false
+	for _, x := range set {
+		if x == point {
+			found = true
+			continue
+		}
+		num.Mul(num, new(big.Int).SetUint64(x))
+		den.Mul(den, new(big.Int).Sub(new(big.Int).SetUint64(x), new(big.Int).SetUint64(point)))
+	}
+	if !found {
+		return nil, fmt.Errorf("[encryption.LagrangeCoefficient]: point %d is not in the set", point)
+	}
+	den.Mod(den, modulus)
+	if den.ModInverse(den, modulus) == nil {
+		return nil, errors.New("[encryption.LagrangeCoefficient]: points of the set must be distinct")
+	}
+	return num.Mul(num, den).Mod(num, modulus), nil
+}
+
+func (client *Client) mulScalarQP(p rlwe.PolyQP, scalar *big.Int) {
+	client.Params.RingQ().MulScalarBigint(p.Q, scalar, p.Q)
+	client.Params.RingP().MulScalarBigint(p.P, scalar, p.P)
+}
+
+// Key the client decrypts with: its share of the collective key if set is
+// nil (every party takes part), lambda * threshold key otherwise.
+func (client *Client) decryptionKey(point uint64, set []uint64) (*rlwe.SecretKey, error) {
+	if set == nil {
+		if client.SecretKey == nil {
+			return nil, errors.New("[encryption.decryptionKey]: no secret key")
+		}
+		return client.SecretKey, nil
+	}
+	if client.ThresholdKey == nil {
+		return nil, errors.New("[encryption.decryptionKey]: no threshold key, shares were not exchanged")
+	}
+	lambda, err := LagrangeCoefficient(client.Params, point, set)
+	if err != nil {
+		return nil, err
+	}
+	key := client.ThresholdKey.CopyNew()
+	client.mulScalarQP(key.Value, lambda)
+	return key, nil
+}
+
+// GenDecryptionShares returns the client's shares to release v in plaintext,
+// one per chunk. point and set are nil for N-out-of-N decryption.
+func (client *Client) GenDecryptionShares(v *EncryptedVector, point uint64, set []uint64) ([]*drlwe.CKSShare, error) {
+	key, err := client.decryptionKey(point, set)
+	if err != nil {
+		return nil, err
+	}
+	protocol := dckks.NewCKSProtocol(client.Params, SmudgingSigma)
+	zero := ckks.NewSecretKey(client.Params)
+	shares := make([]*drlwe.CKSShare, len(v.Chunks))
+	for i, c := range v.Chunks {
+		shares[i] = protocol.AllocateShare(c.Level())
+		protocol.GenShare(key, zero, c.Ciphertext, shares[i])
+	}
+	return shares, nil
+}
+
+// GenReencryptionShares returns the client's shares to re-encrypt v under target
+func (client *Client) GenReencryptionShares(v *EncryptedVector, target *rlwe.PublicKey, point uint64, set []uint64) ([]*drlwe.PCKSShare, error) {
+	key, err := client.decryptionKey(point, set)
+	if err != nil {
+		return nil, err
+	}
+	protocol := dckks.NewPCKSProtocol(client.Params, SmudgingSigma)
+	shares := make([]*drlwe.PCKSShare, len(v.Chunks))
+	for i, c := range v.Chunks {
+		shares[i] = protocol.AllocateShare(c.Level())
+		protocol.GenShare(key, target, c.Ciphertext, shares[i])
+	}
+	return shares, nil
+}
+
+// ReleaseVector combines the decryption shares of every party of the set,
+// the result is decryptable by anyone with DecodeReleasedVector.
+func (s *Server) ReleaseVector(v *EncryptedVector, shares [][]*drlwe.CKSShare) (*EncryptedVector, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("[encryption.ReleaseVector]: no share")
+	}
+	protocol := dckks.NewCKSProtocol(s.Params, SmudgingSigma)
+	released := &EncryptedVector{Length: v.Length, Encoding: v.Encoding, LogSlots: v.LogSlots, Chunks: make([]*ckks.Ciphertext, len(v.Chunks))}
+	for i, c := range v.Chunks {
+		combined := protocol.AllocateShare(c.Level())
+		for _, partyShares := range shares {
+			if len(partyShares) != len(v.Chunks) {
+				return nil, errors.New("[encryption.ReleaseVector]: not one share per chunk")
+			}
+			protocol.AggregateShares(combined, partyShares[i], combined)
+		}
+		released.Chunks[i] = ckks.NewCiphertext(s.Params, 1, c.Level(), c.Scale)
+		protocol.KeySwitchCKKS(combined, c, released.Chunks[i])
+	}
+	return released, nil
+}
+
+// ReencryptVector combines the re-encryption shares of every party of the set,
+// the result is decryptable with the secret key of the target.
+func (s *Server) ReencryptVector(v *EncryptedVector, shares [][]*drlwe.PCKSShare) (*EncryptedVector, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("[encryption.ReencryptVector]: no share")
+	}
+	protocol := dckks.NewPCKSProtocol(s.Params, SmudgingSigma)
+	reencrypted := &EncryptedVector{Length: v.Length, Encoding: v.Encoding, LogSlots: v.LogSlots, Chunks: make([]*ckks.Ciphertext, len(v.Chunks))}
+	for i, c := range v.Chunks {
+		combined := protocol.AllocateShare(c.Level())
+		for _, partyShares := range shares {
+			if len(partyShares) != len(v.Chunks) {
+				return nil, errors.New("[encryption.ReencryptVector]: not one share per chunk")
+			}
+			protocol.AggregateShares(combined, partyShares[i], combined)
+		}
+		reencrypted.Chunks[i] = ckks.NewCiphertext(s.Params, 1, c.Level(), c.Scale)
+		protocol.KeySwitchCKKS(combined, c, reencrypted.Chunks[i])
+	}
+	return reencrypted, nil
+}
+
+// DecodeReleasedVector decodes a vector released by ReleaseVector
+func DecodeReleasedVector(params ckks.Parameters, v *EncryptedVector) ([]float64, error) {
+	zero := Client{
+		Params:    params,
+		Encoder:   ckks.NewEncoder(params),
+		Decryptor: ckks.NewDecryptor(params, ckks.NewSecretKey(params)),
+	}
+	return zero.DecryptVector(v)
+}
+
+// ------------ SHARES EXCHANGE ------------
+
+// Shamir shares go through the server, sealed to their recipient.
+
+// GenSharingKey draws the key pair the client receives its Shamir shares with
+func (client *Client) GenSharingKey() (*[32]byte, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	client.sharingKey = priv
+	client.SharingPublicKey = pub
+	return pub, nil
+}
+
+// SealShare encrypts a Shamir share for the owner of recipient
+func SealShare(share *rlwe.SecretKey, recipient *[32]byte) ([]byte, error) {
+	b, err := share.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return box.SealAnonymous(nil, b, recipient, rand.Reader)
+}
+
+// OpenShare decrypts a Shamir share sealed for the client
+func (client *Client) OpenShare(sealed []byte) (*rlwe.SecretKey, error) {
+	if client.sharingKey == nil {
+		return nil, errors.New("[encryption.OpenShare]: no sharing key")
+	}
+	b, ok := box.OpenAnonymous(nil, sealed, client.SharingPublicKey, client.sharingKey)
+	if !ok {
+		return nil, errors.New("[encryption.OpenShare]: share was not sealed for this client")
+	}
+	share := new(rlwe.SecretKey)
+	err := share.UnmarshalBinary(b)
+	return share, err
+}
@@ -0,0 +1,251 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ldsec/lattigo/v2/ckks"
+)
+
+// EncryptedVector is a vector of any length, split over as many
+// ciphertexts as needed. Chunk i holds values [i*size, (i+1)*size),
+// size being N for coefficients encoding and 2^LogSlots for slots encoding.
+type EncryptedVector struct {
+	Length   int // number of values before encryption
+	Encoding string
+	LogSlots int // slots encoding only
+	Chunks   []*ckks.Ciphertext
+}
+
+// Values per ciphertext
+func (v *EncryptedVector) chunkSize(params ckks.Parameters) int {
+	if v.Encoding == SlotsEncoding {
+		return 1 << v.LogSlots
+	}
+	return params.N()
+}
+
+// EncryptVector encodes the values with the client's encoding
+func (client *Client) EncryptVector(values []float64) *EncryptedVector {
+	v := &EncryptedVector{
+		Length:   len(values),
+		Encoding: client.encoding(),
+	}
+	if v.Encoding == SlotsEncoding {
+		v.LogSlots = client.LogSlots
+	}
+	plaintexts := v.encode(client.Encoder, client.Params, values, client.Params.MaxLevel(), client.Params.DefaultScale())
+	v.Chunks = make([]*ckks.Ciphertext, len(plaintexts))
+	for i, plaintext := range plaintexts {
+		v.Chunks[i] = client.EncryptNew(plaintext)
+	}
+	return v
+}
+
+// Encodes the values as v does, one plaintext per chunk
+func (v *EncryptedVector) encode(encoder ckks.Encoder, params ckks.Parameters, values []float64, level int, scale float64) []*ckks.Plaintext {
+	chunkSize := v.chunkSize(params)
+	plaintexts := make([]*ckks.Plaintext, 0, len(values)/chunkSize+1)
+	for start := 0; start == 0 || start < len(values); start += chunkSize {
+		end := start + chunkSize
+		if end > len(values) {
+			end = len(values)
+		}
+		plaintext := ckks.NewPlaintext(params, level, scale)
+		if v.Encoding == SlotsEncoding {
+			slots := make([]complex128, end-start)
+			for i, value := range values[start:end] {
+				slots[i] = complex(value, 0)
+			}
+			encoder.Encode(slots, plaintext, v.LogSlots)
+		} else {
+			encoder.EncodeCoeffs(values[start:end], plaintext)
+		}
+		plaintexts = append(plaintexts, plaintext)
+	}
+	return plaintexts
+}
+
+// DecryptVector returns exactly the v.Length values encrypted
+func (client *Client) DecryptVector(v *EncryptedVector) ([]float64, error) {
+	if !client.CanDecrypt() {
+		return nil, errors.New("[encryption.DecryptVector]: no secret key")
+	}
+	if v.Encoding == SlotsEncoding && (v.LogSlots < 0 || v.LogSlots > client.Params.MaxLogSlots()) {
+		return nil, errors.New("[encryption.DecryptVector]: invalid number of slots")
+	}
+	if len(v.Chunks) != nbChunks(v.Length, v.chunkSize(client.Params)) {
+		return nil, errors.New("[encryption.DecryptVector]: number of chunks doesn't match the length")
+	}
+	values := make([]float64, 0, v.Length)
+	for _, c := range v.Chunks {
+		var coeffs []float64
+		if v.Encoding == SlotsEncoding {
+			slots := client.Decode(client.DecryptNew(c), v.LogSlots)
+			coeffs = make([]float64, len(slots))
+			for i, slot := range slots {
+				coeffs[i] = real(slot)
+			}
+		} else {
+			coeffs = client.DecodeCoeffs(client.DecryptNew(c))
+		}
+		remaining := v.Length - len(values)
+		if remaining < len(coeffs) {
+			coeffs = coeffs[:remaining]
+		}
+		values = append(values, coeffs...)
+	}
+	return values, nil
+}
+
+// EncryptWeights encrypts values of any length, as a base-64 string
+func (client *Client) EncryptWeights(values []float64) (string, error) {
+	return MarshalToBase64String(client.EncryptVector(values)), nil
+}
+
+// DecryptWeights decrypts a base-64 vector, to its exact original length
+func (client *Client) DecryptWeights(input string) ([]float64, error) {
+	v := new(EncryptedVector)
+	err := UnmarshalFromBase64(v, input)
+	if err != nil {
+		return nil, err
+	}
+	return client.DecryptVector(v)
+}
+
+// AddVectorsNew sums two encrypted vectors chunk by chunk
+func (s *Server) AddVectorsNew(a *EncryptedVector, b *EncryptedVector) (*EncryptedVector, error) {
+	if a.Length != b.Length || len(a.Chunks) != len(b.Chunks) {
+		return nil, fmt.Errorf("[encryption.AddVectorsNew]: vectors of length %d and %d", a.Length, b.Length)
+	}
+	if a.Encoding != b.Encoding || a.LogSlots != b.LogSlots {
+		return nil, errors.New("[encryption.AddVectorsNew]: vectors encoded differently")
+	}
+	sum := &EncryptedVector{Length: a.Length, Encoding: a.Encoding, LogSlots: a.LogSlots, Chunks: make([]*ckks.Ciphertext, len(a.Chunks))}
+	for i := range a.Chunks {
+		sum.Chunks[i] = s.AddNew(a.Chunks[i], b.Chunks[i])
+	}
+	return sum, nil
+}
+
+// MultVectorByConstNew multiplies every value of an encrypted vector by c
+func (s *Server) MultVectorByConstNew(v *EncryptedVector, c float64) *EncryptedVector {
+	res := &EncryptedVector{Length: v.Length, Encoding: v.Encoding, LogSlots: v.LogSlots, Chunks: make([]*ckks.Ciphertext, len(v.Chunks))}
+	for i := range v.Chunks {
+		res.Chunks[i] = s.MultByConstNew(v.Chunks[i], c)
+	}
+	return res
+}
+
+// AverageVectorsNew returns the encrypted element-wise mean of the vectors
+func (s *Server) AverageVectorsNew(vs []*EncryptedVector) (*EncryptedVector, error) {
+	if len(vs) == 0 {
+		return nil, errors.New("[encryption.AverageVectorsNew]: no vector")
+	}
+	sum := vs[0]
+	for _, v := range vs[1:] {
+		var err error
+		sum, err = s.AddVectorsNew(sum, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.MultVectorByConstNew(sum, 1/float64(len(vs))), nil
+}
+
+func nbChunks(length int, chunkSize int) int {
+	if length == 0 {
+		return 1
+	}
+	return (length + chunkSize - 1) / chunkSize
+}
+
+// MarshalBinary encodes the length, encoding and number of chunks, then every
+// chunk prefixed with its index and size, so that order can be checked on reception.
+func (v *EncryptedVector) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint64(v.Length))
+	if v.Encoding == SlotsEncoding {
+		buf.Write([]byte{1, byte(v.LogSlots)})
+	} else {
+		buf.Write([]byte{0, 0})
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(len(v.Chunks)))
+	for i, c := range v.Chunks {
+		b, err := c.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(buf, binary.LittleEndian, uint32(i))
+		binary.Write(buf, binary.LittleEndian, uint64(len(b)))
+		buf.Write(b)
+	}
+	return buf.Bytes(), nil
+}
+
+func (v *EncryptedVector) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	var length uint64
+	var encoding [2]byte
+	var count uint32
+	if binary.Read(r, binary.LittleEndian, &length) != nil || binary.Read(r, binary.LittleEndian, &encoding) != nil ||
+		binary.Read(r, binary.LittleEndian, &count) != nil {
+		return errors.New("[encryption.UnmarshalBinary]: truncated vector header")
+	}
+	if uint64(count)*12 > uint64(r.Len()) {
+		return errors.New("[encryption.UnmarshalBinary]: truncated vector")
+	}
+
+	chunks := make([]*ckks.Ciphertext, count)
+	for range chunks {
+		var index uint32
+		var size uint64
+		if binary.Read(r, binary.LittleEndian, &index) != nil || binary.Read(r, binary.LittleEndian, &size) != nil {
+			return errors.New("[encryption.UnmarshalBinary]: truncated chunk header")
+		}
+		if index >= count || chunks[index] != nil {
+			return fmt.Errorf("[encryption.UnmarshalBinary]: unexpected chunk %d", index)
+		}
+		if size > uint64(r.Len()) {
+			return errors.New("[encryption.UnmarshalBinary]: truncated chunk")
+		}
+		b := make([]byte, size)
+		r.Read(b)
+		chunks[index] = new(ckks.Ciphertext)
+		err := chunks[index].UnmarshalBinary(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	// At most the values the chunks hold, N per ciphertext in coefficients
+	var capacity uint64
+	switch encoding[0] {
+	case 0:
+		if count > 0 {
+			capacity = uint64(count) * uint64(chunks[0].Value[0].Degree())
+		}
+	case 1:
+		if encoding[1] > 62 {
+			return fmt.Errorf("[encryption.UnmarshalBinary]: invalid number of slots 2^%d", encoding[1])
+		}
+		capacity = uint64(count) << encoding[1]
+	default:
+		return fmt.Errorf("[encryption.UnmarshalBinary]: unknown encoding %d", encoding[0])
+	}
+	if length > capacity {
+		return fmt.Errorf("[encryption.UnmarshalBinary]: length %d exceeds the %d values of the chunks", length, capacity)
+	}
+
+	v.Length = int(length)
+	v.Encoding = CoeffsEncoding
+	v.LogSlots = 0
+	if encoding[0] == 1 {
+		v.Encoding = SlotsEncoding
+		v.LogSlots = int(encoding[1])
+	}
+	v.Chunks = chunks
+	return nil
+}
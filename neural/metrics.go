@@ -0,0 +1,295 @@
+package neural
+
+import (
+	"errors"
+	"math"
+)
+
+// Kind of task the labels of a dataset describe
+const (
+	Classification = "classification"
+	Regression     = "regression"
+)
+
+type Dataset struct {
+	Inputs  [][]float64
+	Outputs [][]float64
+	Task    string
+}
+
+type Metrics struct {
+	Samples int
+	Loss    float64
+
+	// Classification
+	Accuracy        float64
+	Precision       float64
+	Recall          float64
+	F1              float64
+	ConfusionMatrix [][]int // actual class / predicted class
+
+	// Regression
+	MSE float64
+	MAE float64
+	R2  float64
+}
+
+// EvaluationSums holds additive statistics of an evaluation,
+// sums of several parties can be added before computing the metrics.
+type EvaluationSums struct {
+	Task      string
+	Count     float64
+	Loss      float64
+	Confusion [][]float64 // classification only
+
+	AbsError         float64   // regression only
+	SquaredError     float64   // regression only
+	TargetSum        []float64 // regression only, per output
+	TargetSquaredSum []float64 // regression only, per output
+}
+
+func NewEvaluationSums(task string, outputs int) EvaluationSums {
+	sums := EvaluationSums{Task: task}
+	if task == Classification {
+		classes := NbClasses(outputs)
+		sums.Confusion = make([][]float64, classes)
+		for i := range sums.Confusion {
+			sums.Confusion[i] = make([]float64, classes)
+		}
+	} else {
+		sums.TargetSum = make([]float64, outputs)
+		sums.TargetSquaredSum = make([]float64, outputs)
+	}
+	return sums
+}
+
+// NbClasses returns the number of classes predicted by a network
+// with the given number of outputs, a single output being binary.
+func NbClasses(outputs int) int {
+	if outputs == 1 {
+		return 2
+	}
+	return outputs
+}
+
+// Predict runs the network on input and returns the output layer
+func (nn *NeuralNetwork) Predict(input []float64) ([]float64, error) {
+	if len(nn.Layers) == 0 {
+		return nil, errors.New("[neural.Predict]: weights are not initialized")
+	}
+	if len(input) != nn.InputDimensions {
+		return nil, errors.New("[neural.Predict]: input dimensions don't match the input layer")
+	}
+
+	x := input
+	for l, shape := range nn.Layers {
+		z := make([]float64, shape.Outputs)
+		layer := nn.LayerWeights(l)
+		for i, xi := range x {
+			for j := range z {
+				z[j] += xi * layer[i*shape.Outputs+j]
+			}
+		}
+		// output layer is always a sigmoid, as in Forward
+		if nn.ActivationFunction == ReluFunc && l < len(nn.Layers)-1 {
+			x = Relu(z)
+		} else {
+			x = Sigmoid(z)
+		}
+	}
+	return x, nil
+}
+
+// Evaluate runs the network over the dataset and computes its metrics
+func (nn *NeuralNetwork) Evaluate(dataset Dataset) (Metrics, error) {
+	sums, err := nn.EvaluateSums(dataset)
+	if err != nil {
+		return Metrics{}, err
+	}
+	return sums.Metrics(), nil
+}
+
+// EvaluateSums runs the network over the dataset and returns
+// the additive statistics the metrics are computed from.
+func (nn *NeuralNetwork) EvaluateSums(dataset Dataset) (EvaluationSums, error) {
+	if len(dataset.Inputs) != len(dataset.Outputs) {
+		return EvaluationSums{}, errors.New("[neural.EvaluateSums]: dataset has not as many inputs as outputs")
+	}
+	if dataset.Task != Classification && dataset.Task != Regression {
+		return EvaluationSums{}, errors.New("[neural.EvaluateSums]: unknown task " + dataset.Task)
+	}
+
+	sums := NewEvaluationSums(dataset.Task, nn.OutputDimensions)
+	for s, input := range dataset.Inputs {
+		target := dataset.Outputs[s]
+		if len(target) != nn.OutputDimensions {
+			return EvaluationSums{}, errors.New("[neural.EvaluateSums]: output dimensions don't match the output layer")
+		}
+		output, err := nn.Predict(input)
+		if err != nil {
+			return EvaluationSums{}, err
+		}
+
+		sums.Count++
+		if dataset.Task == Classification {
+			sums.Loss += CrossEntropy(output, target)
+			sums.Confusion[Class(target)][Class(output)]++
+			continue
+		}
+
+		for k := range output {
+			e := output[k] - target[k]
+			sums.Loss += e * e / float64(len(output))
+			sums.AbsError += math.Abs(e)
+			sums.SquaredError += e * e
+			sums.TargetSum[k] += target[k]
+			sums.TargetSquaredSum[k] += target[k] * target[k]
+		}
+	}
+	return sums, nil
+}
+
+// Add accumulates the sums of another evaluation of the same model
+func (sums *EvaluationSums) Add(other EvaluationSums) {
+	sums.Count += other.Count
+	sums.Loss += other.Loss
+	for i := range sums.Confusion {
+		for j := range sums.Confusion[i] {
+			sums.Confusion[i][j] += other.Confusion[i][j]
+		}
+	}
+	sums.AbsError += other.AbsError
+	sums.SquaredError += other.SquaredError
+	for k := range sums.TargetSum {
+		sums.TargetSum[k] += other.TargetSum[k]
+		sums.TargetSquaredSum[k] += other.TargetSquaredSum[k]
+	}
+}
+
+// Vector flattens the sums, in a fixed order, to be encrypted
+func (sums *EvaluationSums) Vector() []float64 {
+	v := []float64{sums.Count, sums.Loss, sums.AbsError, sums.SquaredError}
+	for _, row := range sums.Confusion {
+		v = append(v, row...)
+	}
+	v = append(v, sums.TargetSum...)
+	v = append(v, sums.TargetSquaredSum...)
+	return v
+}
+
+// EvaluationSumsFromVector is the inverse of Vector, extra values are ignored
+func EvaluationSumsFromVector(task string, outputs int, v []float64) (EvaluationSums, error) {
+	sums := NewEvaluationSums(task, outputs)
+	if len(v) < len(sums.Vector()) {
+		return EvaluationSums{}, errors.New("[neural.EvaluationSumsFromVector]: vector is too short")
+	}
+	sums.Count, sums.Loss, sums.AbsError, sums.SquaredError = v[0], v[1], v[2], v[3]
+	i := 4
+	for _, row := range sums.Confusion {
+		i += copy(row, v[i:])
+	}
+	i += copy(sums.TargetSum, v[i:])
+	copy(sums.TargetSquaredSum, v[i:])
+	return sums, nil
+}
+
+func (sums *EvaluationSums) Metrics() Metrics {
+	m := Metrics{Samples: int(math.Round(sums.Count))}
+	if sums.Count == 0 {
+		return m
+	}
+	m.Loss = sums.Loss / sums.Count
+
+	if sums.Task == Classification {
+		classes := len(sums.Confusion)
+		m.ConfusionMatrix = make([][]int, classes)
+		correct := 0.0
+		for i := range sums.Confusion {
+			m.ConfusionMatrix[i] = make([]int, classes)
+			for j, c := range sums.Confusion[i] {
+				m.ConfusionMatrix[i][j] = int(math.Round(c))
+			}
+			correct += sums.Confusion[i][i]
+		}
+		m.Accuracy = correct / sums.Count
+		m.Precision, m.Recall, m.F1 = precisionRecallF1(sums.Confusion)
+		return m
+	}
+
+	outputs := float64(len(sums.TargetSum))
+	m.MSE = sums.SquaredError / (sums.Count * outputs)
+	m.MAE = sums.AbsError / (sums.Count * outputs)
+	total := 0.0
+	for k := range sums.TargetSum {
+		total += sums.TargetSquaredSum[k] - sums.TargetSum[k]*sums.TargetSum[k]/sums.Count
+	}
+	if total > 0 {
+		m.R2 = 1 - sums.SquaredError/total
+	}
+	return m
+}
+
+// precisionRecallF1 returns the scores of the positive class for binary
+// classification, and their macro average otherwise.
+func precisionRecallF1(confusion [][]float64) (float64, float64, float64) {
+	classes := []int{1}
+	if len(confusion) > 2 {
+		classes = make([]int, len(confusion))
+		for c := range classes {
+			classes[c] = c
+		}
+	}
+
+	var precision, recall, f1 float64
+	for _, c := range classes {
+		var predicted, actual float64
+		for i := range confusion {
+			predicted += confusion[i][c]
+			actual += confusion[c][i]
+		}
+		var p, r, f float64
+		if predicted > 0 {
+			p = confusion[c][c] / predicted
+		}
+		if actual > 0 {
+			r = confusion[c][c] / actual
+		}
+		if p+r > 0 {
+			f = 2 * p * r / (p + r)
+		}
+		precision += p
+		recall += r
+		f1 += f
+	}
+	n := float64(len(classes))
+	return precision / n, recall / n, f1 / n
+}
+
+// Class returns the class of an output vector,
+// thresholded at 0.5 for a single output, argmax otherwise.
+func Class(output []float64) int {
+	if len(output) == 1 {
+		if output[0] >= 0.5 {
+			return 1
+		}
+		return 0
+	}
+	class := 0
+	for i, o := range output {
+		if o > output[class] {
+			class = i
+		}
+	}
+	return class
+}
+
+// CrossEntropy is the binary cross-entropy averaged over the outputs
+func CrossEntropy(output []float64, target []float64) float64 {
+	const eps = 1e-12
+	loss := 0.0
+	for k, o := range output {
+		o = math.Min(math.Max(o, eps), 1-eps)
+		loss -= target[k]*math.Log(o) + (1-target[k])*math.Log(1-o)
+	}
+	return loss / float64(len(output))
+}
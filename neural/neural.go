@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"time"
 )
 
 type NeuralNetwork struct {
@@ -16,14 +17,43 @@ type NeuralNetwork struct {
 	NbIterations       int
 	ActivationFunction string
 	BatchSize          int
-	Weights            map[int]map[int][]float64 // layer / index neuron / array of weigths
+	Initialization     string
+	Rounds             int // aggregation rounds the weights went through
+
+	// All weights, layer after layer, in one contiguous buffer.
+	// Layers describes where each layer lives in it.
+	Weights       []float64
+	Layers        []LayerShape
+	LayoutVersion int
+}
+
+// LayerShape locates a layer in the flat weights buffer.
+// Weight from input i to output j is at Offset + i*Outputs + j.
+type LayerShape struct {
+	Inputs  int
+	Outputs int
+	Offset  int
 }
 
+// Version of the weights layout, bumped on any change of
+// the order in which layers are stored in Weights.
+const WeightsLayoutVersion = 1
+
 const (
 	SigmoidFunc = "sigmoid"
 	ReluFunc    = "relu"
 )
 
+// Weight initialization schemes
+const (
+	RandomInit        = "random" // legacy, weights in [0.0, 1.0)
+	UniformInit       = "uniform"
+	XavierUniformInit = "xavier_uniform"
+	XavierNormalInit  = "xavier_normal"
+	HeUniformInit     = "he_uniform"
+	HeNormalInit      = "he_normal"
+)
+
 func CreateNetwork(input int, output int,
 	nbLayers int, nbNeurons int, lr float64) NeuralNetwork {
 
@@ -38,91 +68,132 @@ func CreateNetwork(input int, output int,
 	return nn
 }
 
+// InitiateWeights fills the weights using a time-seeded source,
+// two calls give two different networks.
 func (nn *NeuralNetwork) InitiateWeights() {
-	// weigths are in [0.0, 1.0)
-	nn.Weights = make(map[int]map[int][]float64)
+	nn.InitiateWeightsWithRand(rand.New(rand.NewSource(time.Now().UnixNano())))
+}
 
-	// Input layer
-	nn.Weights[0] = make(map[int][]float64)
-	for input := 0; input < nn.InputDimensions; input++ {
-		nn.Weights[0][input] = RandomArrayFloat(nn.NbNeurons)
+// InitiateWeightsFromSeed fills the weights deterministically,
+// the same seed always gives the same initial model.
+func (nn *NeuralNetwork) InitiateWeightsFromSeed(seed int64) {
+	nn.InitiateWeightsWithRand(rand.New(rand.NewSource(seed)))
+}
+
+// InitiateWeightsWithRand fills the weights according to nn.Initialization
+// (xavier uniform by default), drawing from rng.
+func (nn *NeuralNetwork) InitiateWeightsWithRand(rng *rand.Rand) {
+	nn.AllocateWeights()
+	for l, shape := range nn.Layers {
+		err := FillWeights(nn.LayerWeights(l), nn.Initialization, shape.Inputs, shape.Outputs, rng)
+		if err != nil {
+			fmt.Println(err)
+		}
 	}
+}
 
+// AllocateWeights computes the layers shapes from the architecture
+// and allocates a zeroed weights buffer.
+func (nn *NeuralNetwork) AllocateWeights() {
+	nn.Layers = make([]LayerShape, 0, nn.NbLayers+1)
+	offset := 0
+	addLayer := func(inputs int, outputs int) {
+		nn.Layers = append(nn.Layers, LayerShape{Inputs: inputs, Outputs: outputs, Offset: offset})
+		offset += inputs * outputs
+	}
+
+	// Input layer
+	addLayer(nn.InputDimensions, nn.NbNeurons)
 	// Hidden layers
 	for layer := 1; layer < nn.NbLayers; layer++ {
-		nn.Weights[layer] = make(map[int][]float64)
-		for neuron := 0; neuron < nn.NbNeurons; neuron++ {
-			nn.Weights[layer][neuron] = RandomArrayFloat(nn.NbNeurons)
-		}
+		addLayer(nn.NbNeurons, nn.NbNeurons)
 	}
-
 	// Output layer
-	nn.Weights[nn.NbLayers+1] = make(map[int][]float64)
-	for input := 0; input < nn.OutputDimensions; input++ {
-		nn.Weights[nn.NbLayers+1][input] = RandomArrayFloat(nn.NbNeurons)
-	}
+	addLayer(nn.NbNeurons, nn.OutputDimensions)
+
+	nn.Weights = make([]float64, offset)
+	nn.LayoutVersion = WeightsLayoutVersion
 }
 
-func (nn *NeuralNetwork) Print() {
-	for input := 0; input < nn.InputDimensions; input++ {
-		fmt.Println(nn.Weights[0][input])
-	}
-	for layer := 1; layer < nn.NbLayers; layer++ {
-		fmt.Println("-----")
-		for neuron := 0; neuron < nn.NbNeurons; neuron++ {
-			fmt.Println(nn.Weights[layer][neuron])
+// LayerWeights returns the weights of layer l, as a view on the buffer
+func (nn *NeuralNetwork) LayerWeights(l int) []float64 {
+	shape := nn.Layers[l]
+	return nn.Weights[shape.Offset : shape.Offset+shape.Inputs*shape.Outputs]
+}
+
+// Weight returns the weight of layer l from input i to output j
+func (nn *NeuralNetwork) Weight(l int, i int, j int) float64 {
+	shape := nn.Layers[l]
+	return nn.Weights[shape.Offset+i*shape.Outputs+j]
+}
+
+// SetWeight sets the weight of layer l from input i to output j
+func (nn *NeuralNetwork) SetWeight(l int, i int, j int, w float64) {
+	shape := nn.Layers[l]
+	nn.Weights[shape.Offset+i*shape.Outputs+j] = w
+}
+
+// FillWeights draws the values of ws with the given initialization scheme.
+// An empty scheme defaults to XavierUniformInit.
+func FillWeights(ws []float64, initialization string, fanIn int, fanOut int, rng *rand.Rand) error {
+	switch initialization {
+	case RandomInit:
+		for i := range ws {
+			ws[i] = rng.Float64()
 		}
+	case UniformInit:
+		// zero-centered, limit 1/sqrt(fanIn)
+		fillUniform(ws, 1/math.Sqrt(float64(fanIn)), rng)
+	case XavierUniformInit, "":
+		fillUniform(ws, math.Sqrt(6/float64(fanIn+fanOut)), rng)
+	case XavierNormalInit:
+		fillNormal(ws, math.Sqrt(2/float64(fanIn+fanOut)), rng)
+	case HeUniformInit:
+		fillUniform(ws, math.Sqrt(6/float64(fanIn)), rng)
+	case HeNormalInit:
+		fillNormal(ws, math.Sqrt(2/float64(fanIn)), rng)
+	default:
+		return errors.New("[neural.FillWeights]: unknown initialization " + initialization)
 	}
-	fmt.Println("-----")
-	for input := 0; input < nn.OutputDimensions; input++ {
-		fmt.Println(nn.Weights[nn.NbLayers+1][input])
+	return nil
+}
+
+func fillUniform(ws []float64, limit float64, rng *rand.Rand) {
+	for i := range ws {
+		ws[i] = (2*rng.Float64() - 1) * limit
 	}
 }
 
-func (nn *NeuralNetwork) GetWeights() []float64 {
-	weights := make([]float64, 0)
-	for input := 0; input < nn.InputDimensions; input++ {
-		for _, w := range nn.Weights[0][input] {
-			weights = append(weights, w)
-		}
+func fillNormal(ws []float64, std float64, rng *rand.Rand) {
+	for i := range ws {
+		ws[i] = rng.NormFloat64() * std
 	}
-	for layer := 1; layer < nn.NbLayers; layer++ {
-		for neuron := 0; neuron < nn.NbNeurons; neuron++ {
-			for _, w := range nn.Weights[layer][neuron] {
-				weights = append(weights, w)
-			}
+}
+
+func (nn *NeuralNetwork) Print() {
+	for l, shape := range nn.Layers {
+		if l > 0 {
+			fmt.Println("-----")
 		}
-	}
-	for input := 0; input < nn.OutputDimensions; input++ {
-		for _, w := range nn.Weights[nn.NbLayers+1][input] {
-			weights = append(weights, w)
+		layer := nn.LayerWeights(l)
+		for i := 0; i < shape.Inputs; i++ {
+			fmt.Println(layer[i*shape.Outputs : (i+1)*shape.Outputs])
 		}
 	}
+}
+
+// GetWeights returns a copy of the weights,
+// use nn.Weights directly to avoid the allocation.
+func (nn *NeuralNetwork) GetWeights() []float64 {
+	weights := make([]float64, len(nn.Weights))
+	copy(weights, nn.Weights)
 	return weights
 }
 
+// SetWeights copies ws into the weights buffer,
+// values beyond the size of the model are ignored.
 func (nn *NeuralNetwork) SetWeights(ws []float64) {
-	index := 0
-	for input := 0; input < nn.InputDimensions; input++ {
-		for i := range nn.Weights[0][input] {
-			nn.Weights[0][input][i] = ws[index]
-			index++
-		}
-	}
-	for layer := 1; layer < nn.NbLayers; layer++ {
-		for neuron := 0; neuron < nn.NbNeurons; neuron++ {
-			for i := range nn.Weights[layer][neuron] {
-				nn.Weights[layer][neuron][i] = ws[index]
-				index++
-			}
-		}
-	}
-	for input := 0; input < nn.OutputDimensions; input++ {
-		for i := range nn.Weights[nn.NbLayers+1][input] {
-			nn.Weights[nn.NbLayers+1][input][i] = ws[index]
-			index++
-		}
-	}
+	copy(nn.Weights, ws)
 }
 
 // TODO generalize
@@ -135,18 +206,18 @@ func (nn *NeuralNetwork) Forward(input []float64) ([][]float64, error) {
 
 	z1 := make([]float64, 5)
 	for i, xi := range input {
-		z1[0] += xi * nn.Weights[0][i][0]
-		z1[1] += xi * nn.Weights[0][i][1]
-		z1[2] += xi * nn.Weights[0][i][2]
-		z1[3] += xi * nn.Weights[0][i][3]
-		z1[4] += xi * nn.Weights[0][i][4]
+		z1[0] += xi * nn.Weight(0, i, 0)
+		z1[1] += xi * nn.Weight(0, i, 1)
+		z1[2] += xi * nn.Weight(0, i, 2)
+		z1[3] += xi * nn.Weight(0, i, 3)
+		z1[4] += xi * nn.Weight(0, i, 4)
 	}
 	stepsOutputs = append(stepsOutputs, z1)
 	x1 := Sigmoid(z1)
 
 	z2 := make([]float64, 1)
 	for i, xi := range x1 {
-		z2[0] += xi * nn.Weights[2][0][i]
+		z2[0] += xi * nn.Weight(nn.NbLayers, i, 0)
 	}
 	stepsOutputs = append(stepsOutputs, z2)
 	output := Sigmoid(z2)
@@ -178,7 +249,7 @@ func (nn *NeuralNetwork) Backpropagation(input []float64, output float64) ([][]f
 	delta1 := make([]float64, len(steps[0])-1)
 	for i := range delta2 {
 		for _, xi := range delta2 {
-			delta1[i] += xi * nn.Weights[2][0][i] * GradSigmoid(steps[0])[i]
+			delta1[i] += xi * nn.Weight(nn.NbLayers, i, 0) * GradSigmoid(steps[0])[i]
 		}
 	}
 
@@ -204,6 +275,14 @@ func Sigmoid(x []float64) []float64 {
 	return x2
 }
 
+func Relu(x []float64) []float64 {
+	var x2 []float64
+	for _, xi := range x {
+		x2 = append(x2, math.Max(0, xi))
+	}
+	return x2
+}
+
 func GradSigmoid(x []float64) []float64 {
 	var x2 []float64
 	for _, xi := range x {
@@ -0,0 +1,108 @@
+package neural
+
+import (
+	"errors"
+	"math"
+)
+
+// ServerOptimizer updates the global model with the average of the
+// participants' deltas, weights after local training minus global weights.
+type ServerOptimizer interface {
+	// Step returns the new global weights
+	Step(global []float64, delta []float64) []float64
+}
+
+// StatefulOptimizer is a ServerOptimizer whose steps depend on the previous
+// ones, its state being checkpointed with the server
+type StatefulOptimizer interface {
+	ServerOptimizer
+	// State returns a copy of the vectors carried over between steps
+	State() [][]float64
+	// SetState restores a state returned by State
+	SetState(state [][]float64) error
+}
+
+// FedAvg adds the average delta times the learning rate. With a learning
+// rate of 1, the global model is the average of the participants' models.
+// Being linear, it can run on encrypted deltas.
+type FedAvg struct {
+	LearningRate float64
+}
+
+// FedAvgM is FedAvg with server momentum
+type FedAvgM struct {
+	LearningRate float64
+	Momentum     float64
+
+	velocity []float64
+}
+
+// FedAdam is Adam on the server, the average delta being the gradient
+// (Reddi et al., Adaptive Federated Optimization)
+type FedAdam struct {
+	LearningRate float64
+	Beta1        float64
+	Beta2        float64
+	Epsilon      float64 // degree of adaptivity
+
+	m []float64
+	v []float64
+}
+
+func (o *FedAvg) Step(global []float64, delta []float64) []float64 {
+	res := make([]float64, len(global))
+	for i := range global {
+		res[i] = global[i] + o.LearningRate*delta[i]
+	}
+	return res
+}
+
+func (o *FedAvgM) Step(global []float64, delta []float64) []float64 {
+	if len(o.velocity) != len(global) {
+		o.velocity = make([]float64, len(global))
+	}
+	res := make([]float64, len(global))
+	for i := range global {
+		o.velocity[i] = o.Momentum*o.velocity[i] + delta[i]
+		res[i] = global[i] + o.LearningRate*o.velocity[i]
+	}
+	return res
+}
+
+func (o *FedAvgM) State() [][]float64 {
+	return [][]float64{append([]float64(nil), o.velocity...)}
+}
+
+func (o *FedAvgM) SetState(state [][]float64) error {
+	if len(state) != 1 {
+		return errors.New("[neural.FedAvgM.SetState]: velocity expected")
+	}
+	o.velocity = state[0]
+	return nil
+}
+
+func (o *FedAdam) Step(global []float64, delta []float64) []float64 {
+	if len(o.m) != len(global) {
+		o.m = make([]float64, len(global))
+		o.v = make([]float64, len(global))
+	}
+	res := make([]float64, len(global))
+	for i := range global {
+		o.m[i] = o.Beta1*o.m[i] + (1-o.Beta1)*delta[i]
+		o.v[i] = o.Beta2*o.v[i] + (1-o.Beta2)*delta[i]*delta[i]
+		res[i] = global[i] + o.LearningRate*o.m[i]/(math.Sqrt(o.v[i])+o.Epsilon)
+	}
+	return res
+}
+
+func (o *FedAdam) State() [][]float64 {
+	return [][]float64{append([]float64(nil), o.m...), append([]float64(nil), o.v...)}
+}
+
+func (o *FedAdam) SetState(state [][]float64) error {
+	if len(state) != 2 || len(state[0]) != len(state[1]) {
+		return errors.New("[neural.FedAdam.SetState]: first and second moments expected")
+	}
+	o.m, o.v = state[0], state[1]
+	return nil
+}
@@ -0,0 +1,214 @@
+package neural
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// AggregationRule combines the updates of the participants, robust rules
+// tolerating up to a number of Byzantine participants sending anything.
+// They need the updates in clear.
+type AggregationRule interface {
+	Aggregate(updates [][]float64) ([]float64, error)
+}
+
+// Mean is the usual average, poisoned by a single Byzantine participant
+type Mean struct{}
+
+// CoordinateMedian is the median of each coordinate
+type CoordinateMedian struct{}
+
+// TrimmedMean averages each coordinate without its Byzantine largest and
+// Byzantine smallest values
+type TrimmedMean struct {
+	Byzantine int
+}
+
+// Krum selects the update closest to its n - f - 2 nearest neighbours
+// (Blanchard et al., Machine Learning with Adversaries). Multi-Krum averages
+// the Selected best ones, Krum being Selected = 1.
+type Krum struct {
+	Byzantine int
+	Selected  int
+}
+
+// GeometricMedian minimizes the sum of the distances to the updates,
+// approximated with the Weiszfeld algorithm (Pillutla et al., Robust
+// Aggregation for Federated Learning). Tolerates less than half Byzantine.
+type GeometricMedian struct {
+	Iterations int     // 100 if 0
+	Tolerance  float64 // on the move of the estimate, 1e-6 if 0
+}
+
+func (Mean) Aggregate(updates [][]float64) ([]float64, error) {
+	err := checkUpdates(updates)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]float64, len(updates[0]))
+	for _, u := range updates {
+		for i, x := range u {
+			res[i] += x / float64(len(updates))
+		}
+	}
+	return res, nil
+}
+
+func (CoordinateMedian) Aggregate(updates [][]float64) ([]float64, error) {
+	err := checkUpdates(updates)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]float64, len(updates[0]))
+	column := make([]float64, len(updates))
+	n := len(updates)
+	for i := range res {
+		for j, u := range updates {
+			column[j] = u[i]
+		}
+		sort.Float64s(column)
+		if n%2 == 1 {
+			res[i] = column[n/2]
+		} else {
+			res[i] = (column[n/2-1] + column[n/2]) / 2
+		}
+	}
+	return res, nil
+}
+
+func (r TrimmedMean) Aggregate(updates [][]float64) ([]float64, error) {
+	err := checkUpdates(updates)
+	if err != nil {
+		return nil, err
+	}
+	n := len(updates)
+	if r.Byzantine < 0 || n <= 2*r.Byzantine {
+		return nil, fmt.Errorf("[neural.TrimmedMean]: %d updates, more than %d needed", n, 2*r.Byzantine)
+	}
+	res := make([]float64, len(updates[0]))
+	column := make([]float64, n)
+	kept := column[r.Byzantine : n-r.Byzantine]
+	for i := range res {
+		for j, u := range updates {
+			column[j] = u[i]
+		}
+		sort.Float64s(column)
+		for _, x := range kept {
+			res[i] += x / float64(len(kept))
+		}
+	}
+	return res, nil
+}
+
+func (r Krum) Aggregate(updates [][]float64) ([]float64, error) {
+	err := checkUpdates(updates)
+	if err != nil {
+		return nil, err
+	}
+	n := len(updates)
+	if r.Byzantine < 0 || n <= 2*r.Byzantine+2 {
+		return nil, fmt.Errorf("[neural.Krum]: %d updates, more than %d needed", n, 2*r.Byzantine+2)
+	}
+	selected := r.Selected
+	if selected == 0 {
+		selected = 1
+	}
+	if selected < 0 || selected > n-r.Byzantine {
+		return nil, fmt.Errorf("[neural.Krum]: can't select %d updates out of %d", selected, n)
+	}
+
+	// Score: sum of the squared distances to the n - f - 2 closest updates
+	scores := make([]float64, n)
+	distances := make([]float64, 0, n-1)
+	for i := range updates {
+		distances = distances[:0]
+		for j := range updates {
+			if i != j {
+				distances = append(distances, squaredDistance(updates[i], updates[j]))
+			}
+		}
+		sort.Float64s(distances)
+		for _, d := range distances[:n-r.Byzantine-2] {
+			scores[i] += d
+		}
+	}
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] < scores[order[b]] })
+
+	best := make([][]float64, selected)
+	for i := range best {
+		best[i] = updates[order[i]]
+	}
+	return Mean{}.Aggregate(best)
+}
+
+func (r GeometricMedian) Aggregate(updates [][]float64) ([]float64, error) {
+	iterations := r.Iterations
+	if iterations == 0 {
+		iterations = 100
+	}
+	tolerance := r.Tolerance
+	if tolerance == 0 {
+		tolerance = 1e-6
+	}
+	// Starts from the coordinate median, unlike the mean not thrown
+	// arbitrarily far by a Byzantine update
+	estimate, err := CoordinateMedian{}.Aggregate(updates)
+	if err != nil {
+		return nil, err
+	}
+	for it := 0; it < iterations; it++ {
+		next := make([]float64, len(estimate))
+		total := 0.0
+		for _, u := range updates {
+			// Updates too far to measure are left out
+			d := math.Sqrt(squaredDistance(u, estimate))
+			if math.IsInf(d, 0) || math.IsNaN(d) {
+				continue
+			}
+			// Smoothed, an update can be the estimate
+			w := 1 / math.Max(d, 1e-12)
+			for i, x := range u {
+				next[i] += w * x
+			}
+			total += w
+		}
+		if total == 0 {
+			break
+		}
+		for i := range next {
+			next[i] /= total
+		}
+		move := math.Sqrt(squaredDistance(next, estimate))
+		estimate = next
+		if move < tolerance {
+			break
+		}
+	}
+	return estimate, nil
+}
+
+func checkUpdates(updates [][]float64) error {
+	if len(updates) == 0 {
+		return errors.New("[neural.Aggregate]: no update")
+	}
+	for _, u := range updates {
+		if len(u) != len(updates[0]) {
+			return errors.New("[neural.Aggregate]: updates of different lengths")
+		}
+	}
+	return nil
+}
+
+func squaredDistance(a []float64, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return sum
+}
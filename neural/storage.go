@@ -0,0 +1,288 @@
+package neural
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// Model file formats
+const (
+	JSONFormat   = "json"
+	BinaryFormat = "binary"
+)
+
+// Version of the model file formats, bumped on any incompatible change
+const ModelFormatVersion = 1
+
+// Magic bytes starting a binary model file
+var binaryMagic = []byte("FLNN")
+
+// ModelFile is the content of a saved model
+type ModelFile struct {
+	FormatVersion int
+	LayoutVersion int
+
+	// Architecture
+	InputDimensions    int
+	OutputDimensions   int
+	NbLayers           int
+	NbNeurons          int
+	ActivationFunction string
+	Initialization     string
+
+	// Training metadata
+	LearningRate float64
+	NbIterations int
+	BatchSize    int
+	Rounds       int
+	SavedAt      time.Time
+
+	// Parameters
+	Layers  []LayerShape
+	Weights []float64
+	Biases  []float64 // reserved, the network has no biases yet
+}
+
+// Save writes the network to path, in the given format
+func (nn *NeuralNetwork) Save(path string, format string) error {
+	var data []byte
+	var err error
+	switch format {
+	case JSONFormat:
+		data, err = nn.MarshalJSON()
+	case BinaryFormat:
+		data, err = nn.MarshalBinary()
+	default:
+		return errors.New("[neural.Save]: unknown format " + format)
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Load reads a network saved in any format
+func Load(path string) (NeuralNetwork, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return NeuralNetwork{}, err
+	}
+	nn := NeuralNetwork{}
+	if bytes.HasPrefix(data, binaryMagic) {
+		err = nn.UnmarshalBinary(data)
+	} else {
+		err = nn.UnmarshalJSON(data)
+	}
+	return nn, err
+}
+
+func (nn *NeuralNetwork) toFile() ModelFile {
+	return ModelFile{
+		FormatVersion:      ModelFormatVersion,
+		LayoutVersion:      nn.LayoutVersion,
+		InputDimensions:    nn.InputDimensions,
+		OutputDimensions:   nn.OutputDimensions,
+		NbLayers:           nn.NbLayers,
+		NbNeurons:          nn.NbNeurons,
+		ActivationFunction: nn.ActivationFunction,
+		Initialization:     nn.Initialization,
+		LearningRate:       nn.LearningRate,
+		NbIterations:       nn.NbIterations,
+		BatchSize:          nn.BatchSize,
+		Rounds:             nn.Rounds,
+		SavedAt:            time.Now().UTC(),
+		Layers:             nn.Layers,
+		Weights:            nn.Weights,
+		Biases:             []float64{},
+	}
+}
+
+// fromFile checks the stored parameters fit the stored architecture
+// before replacing the network.
+func (nn *NeuralNetwork) fromFile(f ModelFile) error {
+	if f.FormatVersion != ModelFormatVersion {
+		return fmt.Errorf("[neural.Load]: unsupported format version %d", f.FormatVersion)
+	}
+	if f.LayoutVersion != WeightsLayoutVersion {
+		return fmt.Errorf("[neural.Load]: unsupported weights layout version %d", f.LayoutVersion)
+	}
+	if len(f.Biases) != 0 {
+		return errors.New("[neural.Load]: biases are not supported")
+	}
+	count, err := weightsCount(f)
+	if err != nil {
+		return err
+	}
+	if len(f.Weights) != count {
+		return errors.New("[neural.Load]: number of weights doesn't match the architecture")
+	}
+
+	loaded := CreateNetwork(f.InputDimensions, f.OutputDimensions, f.NbLayers, f.NbNeurons, f.LearningRate)
+	loaded.ActivationFunction = f.ActivationFunction
+	loaded.Initialization = f.Initialization
+	loaded.NbIterations = f.NbIterations
+	loaded.BatchSize = f.BatchSize
+	loaded.Rounds = f.Rounds
+	loaded.AllocateWeights()
+
+	if len(f.Layers) != len(loaded.Layers) {
+		return errors.New("[neural.Load]: number of layers doesn't match the architecture")
+	}
+	for l := range f.Layers {
+		if f.Layers[l] != loaded.Layers[l] {
+			return fmt.Errorf("[neural.Load]: shape of layer %d doesn't match the architecture", l)
+		}
+	}
+	copy(loaded.Weights, f.Weights)
+
+	*nn = loaded
+	return nil
+}
+
+// Number of weights of the stored architecture, computed without
+// allocating, at most the number of weights stored
+func weightsCount(f ModelFile) (int, error) {
+	for _, d := range []int{f.InputDimensions, f.OutputDimensions, f.NbLayers, f.NbNeurons} {
+		// Each layer has at least d weights
+		if d < 1 || d > len(f.Weights) {
+			return 0, errors.New("[neural.Load]: invalid architecture dimensions")
+		}
+	}
+	count := f.InputDimensions * f.NbNeurons
+	for layer := 1; layer < f.NbLayers && count <= len(f.Weights); layer++ {
+		count += f.NbNeurons * f.NbNeurons
+	}
+	count += f.NbNeurons * f.OutputDimensions
+	if count > len(f.Weights) {
+		return 0, errors.New("[neural.Load]: number of weights doesn't match the architecture")
+	}
+	return count, nil
+}
+
+func (nn *NeuralNetwork) MarshalJSON() ([]byte, error) {
+	return json.MarshalIndent(nn.toFile(), "", "  ")
+}
+
+func (nn *NeuralNetwork) UnmarshalJSON(data []byte) error {
+	f := ModelFile{}
+	err := json.Unmarshal(data, &f)
+	if err != nil {
+		return err
+	}
+	return nn.fromFile(f)
+}
+
+// MarshalBinary encodes the network as magic bytes followed by
+// little-endian fields, in the order of ModelFile.
+func (nn *NeuralNetwork) MarshalBinary() ([]byte, error) {
+	f := nn.toFile()
+	buf := new(bytes.Buffer)
+	buf.Write(binaryMagic)
+
+	writeInts := func(ints ...int) {
+		for _, i := range ints {
+			binary.Write(buf, binary.LittleEndian, int64(i))
+		}
+	}
+	writeString := func(s string) {
+		writeInts(len(s))
+		buf.WriteString(s)
+	}
+	writeFloats := func(fs []float64) {
+		writeInts(len(fs))
+		binary.Write(buf, binary.LittleEndian, fs)
+	}
+
+	writeInts(f.FormatVersion, f.LayoutVersion, f.InputDimensions, f.OutputDimensions, f.NbLayers, f.NbNeurons)
+	writeString(f.ActivationFunction)
+	writeString(f.Initialization)
+	binary.Write(buf, binary.LittleEndian, math.Float64bits(f.LearningRate))
+	writeInts(f.NbIterations, f.BatchSize, f.Rounds)
+	binary.Write(buf, binary.LittleEndian, f.SavedAt.UnixNano())
+	writeInts(len(f.Layers))
+	for _, l := range f.Layers {
+		writeInts(l.Inputs, l.Outputs, l.Offset)
+	}
+	writeFloats(f.Weights)
+	writeFloats(f.Biases)
+	return buf.Bytes(), nil
+}
+
+func (nn *NeuralNetwork) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, binaryMagic) {
+		return errors.New("[neural.UnmarshalBinary]: not a binary model")
+	}
+	r := bytes.NewReader(data[len(binaryMagic):])
+
+	var err error
+	readInt := func() int {
+		var i int64
+		if err == nil {
+			err = binary.Read(r, binary.LittleEndian, &i)
+		}
+		return int(i)
+	}
+	readLength := func() int {
+		l := readInt()
+		if err == nil && (l < 0 || l > r.Len()) {
+			err = errors.New("[neural.UnmarshalBinary]: invalid length")
+		}
+		return l
+	}
+	readString := func() string {
+		b := make([]byte, readLength())
+		if err == nil {
+			_, err = r.Read(b)
+		}
+		return string(b)
+	}
+	readFloats := func() []float64 {
+		fs := make([]float64, readLength())
+		if err == nil {
+			err = binary.Read(r, binary.LittleEndian, fs)
+		}
+		return fs
+	}
+
+	f := ModelFile{}
+	f.FormatVersion = readInt()
+	if err == nil && f.FormatVersion != ModelFormatVersion {
+		return fmt.Errorf("[neural.Load]: unsupported format version %d", f.FormatVersion)
+	}
+	f.LayoutVersion = readInt()
+	f.InputDimensions = readInt()
+	f.OutputDimensions = readInt()
+	f.NbLayers = readInt()
+	f.NbNeurons = readInt()
+	f.ActivationFunction = readString()
+	f.Initialization = readString()
+	var lr uint64
+	if err == nil {
+		err = binary.Read(r, binary.LittleEndian, &lr)
+	}
+	f.LearningRate = math.Float64frombits(lr)
+	f.NbIterations = readInt()
+	f.BatchSize = readInt()
+	f.Rounds = readInt()
+	var savedAt int64
+	if err == nil {
+		err = binary.Read(r, binary.LittleEndian, &savedAt)
+	}
+	f.SavedAt = time.Unix(0, savedAt).UTC()
+	f.Layers = make([]LayerShape, readLength())
+	for l := range f.Layers {
+		f.Layers[l] = LayerShape{Inputs: readInt(), Outputs: readInt(), Offset: readInt()}
+	}
+	f.Weights = readFloats()
+	f.Biases = readFloats()
+	if err != nil {
+		return err
+	}
+	return nn.fromFile(f)
+}
@@ -0,0 +1,142 @@
+package node
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"federated/transport"
+	"fmt"
+	"time"
+)
+
+// Admission is the policy of a server accepting participants. A join is
+// accepted if the joiner is allowed, there is room left, and Approve accepts
+// it. Joiners are allowed if listed, by identity or address, or holding a
+// valid invitation. Anybody is allowed if there is no list and invitations
+// aren't required.
+type Admission struct {
+	Identities        []ed25519.PublicKey
+	Addresses         []string
+	RequireInvitation bool
+	MaxParticipants   int                     // 0 for no limit
+	Approve           func(JoinRequest) error // rejects with the error if not nil
+
+	invitations map[string]time.Time // expiry of the unused tokens
+}
+
+// JoinRequest is what the server knows of a joiner
+type JoinRequest struct {
+	Address  string
+	Identity ed25519.PublicKey // nil if the join isn't signed
+	Token    string            // of the invitation, if any
+}
+
+// Invite returns a token admitting a single participant until it expires
+func (a *Admission) Invite(validity time.Duration) (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if a.invitations == nil {
+		a.invitations = make(map[string]time.Time)
+	}
+	a.invitations[token] = time.Now().Add(validity)
+	return token, nil
+}
+
+// Admit returns why the join is rejected, nil if accepted. A valid
+// invitation is used up.
+func (a *Admission) Admit(req JoinRequest, participants int) error {
+	if a.MaxParticipants > 0 && participants >= a.MaxParticipants {
+		return fmt.Errorf("[node.Admit]: federation full, %d participants", a.MaxParticipants)
+	}
+	now := time.Now()
+	for token, expiry := range a.invitations {
+		if now.After(expiry) {
+			delete(a.invitations, token)
+		}
+	}
+	invited := false
+	if req.Token != "" {
+		if _, ok := a.invitations[req.Token]; !ok {
+			return errors.New("[node.Admit]: invalid or expired invitation")
+		}
+		invited = true
+	}
+	if !invited && !a.allowed(req) {
+		return errors.New("[node.Admit]: not allowed to join")
+	}
+	if a.Approve != nil {
+		err := a.Approve(req)
+		if err != nil {
+			return err
+		}
+	}
+	if invited {
+		delete(a.invitations, req.Token)
+	}
+	return nil
+}
+
+// Whether the joiner is listed, or lists are empty
+func (a *Admission) allowed(req JoinRequest) bool {
+	if len(a.Identities) == 0 && len(a.Addresses) == 0 && !a.RequireInvitation {
+		return true
+	}
+	for _, identity := range a.Identities {
+		if req.Identity != nil && bytes.Equal(identity, req.Identity) {
+			return true
+		}
+	}
+	return contains(a.Addresses, req.Address)
+}
+
+// Server side: checks the join against n.Admission, sending the reason back
+// if it is rejected. Returns whether the joiner is a participant joining
+// again, after a restart, which isn't admitted twice.
+func (n *Node) admit(pkt transport.Packet) (bool, error) {
+	rejoin, err := n.rejoin(pkt)
+	if err == nil && !rejoin && n.Admission != nil {
+		req := JoinRequest{Address: pkt.Source, Token: pkt.Message}
+		if pkt.Signed() {
+			req.Identity = pkt.Signer
+		}
+		err = n.Admission.Admit(req, len(n.Server.Participants))
+	}
+	if err == nil {
+		return rejoin, nil
+	}
+	pktRejected := transport.Packet{
+		Source:      n.Socket.GetAddress(),
+		Destination: pkt.Source,
+		Message:     err.Error(),
+		Type:        transport.JoinRejected,
+	}
+	sendErr := n.Socket.Send(pkt.Source, pktRejected)
+	if sendErr != nil {
+		fmt.Println(sendErr)
+	}
+	return false, err
+}
+
+// Whether the joiner is already a participant, with the identity bound to
+// its address. An identity joins from a single address.
+func (n *Node) rejoin(pkt transport.Packet) (bool, error) {
+	for _, p := range n.Server.Participants {
+		bound, ok := n.Identities[p]
+		identical := ok && pkt.Signed() && bytes.Equal(bound, pkt.Signer)
+		switch {
+		case p == pkt.Source && (!ok || identical):
+			return true, nil
+		case p == pkt.Source:
+			return false, errors.New("[node.admit]: " + p + " already joined with another identity")
+		case identical:
+			return false, errors.New("[node.admit]: identity already joined from " + p)
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,430 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"federated/encryption"
+	"federated/neural"
+	"federated/transport"
+	"fmt"
+	"strconv"
+)
+
+// Aggregator combines the contributions of the participants to a round,
+// whatever protects them. The server begins a round on its first
+// contribution, and finalizes it once the aggregator is ready.
+type Aggregator interface {
+	// Begin starts a round with the participants expected to contribute
+	Begin(round int, participants []string) error
+	// Add records a contribution, returns whether the round can be finalized
+	Add(pkt transport.Packet) (bool, error)
+	// Finalize aggregates the contributions. The result is sent back to the
+	// recipients, nil if the aggregator releases it later by itself.
+	Finalize() (*RoundResult, error)
+}
+
+// RoundResult is the payload sent to the recipients at the end of a round
+type RoundResult struct {
+	Type       string
+	Message    string
+	Recipients []string
+}
+
+// Aggregation modes, advertised to the participants
+const (
+	CKKSAggregation      = ""
+	PlaintextAggregation = "plaintext" // for debugging, the server sees every update
+	MaskedAggregation    = "masked"
+)
+
+// NewAggregator returns the aggregator of the mode, run by n
+func NewAggregator(n *Node, mode string) (Aggregator, error) {
+	switch mode {
+	case CKKSAggregation:
+		return &ckksAggregator{n: n}, nil
+	case PlaintextAggregation:
+		return &plaintextAggregator{n: n}, nil
+	case MaskedAggregation:
+		return &maskedAggregator{n: n}, nil
+	}
+	return nil, errors.New("[node.NewAggregator]: unknown aggregation " + mode)
+}
+
+// Server side: adds the contribution to the round, finalizes it when ready
+func (n *Node) contribute(pkt transport.Packet) error {
+	// Deltas of the first round are relative to the initial model
+	delta := pkt.Type == transport.EncryptedDelta || pkt.Type == transport.PlainDelta
+	if delta && n.Round == 0 && n.Seed == 0 {
+		return errors.New("[node.contribute]: no initial model shared for deltas, see Seed")
+	}
+	if n.Aggregator == nil {
+		a, err := NewAggregator(n, n.Aggregation)
+		if err != nil {
+			return err
+		}
+		n.Aggregator = a
+	}
+	if !n.aggregating {
+		err := n.Aggregator.Begin(n.Round, n.Server.Participants)
+		if err != nil {
+			return err
+		}
+		n.aggregating = true
+	}
+	ready, err := n.Aggregator.Add(pkt)
+	if err != nil || !ready {
+		return err
+	}
+	return n.aggregate()
+}
+
+// Finalizes the round and sends the result back
+func (n *Node) aggregate() error {
+	result, err := n.Aggregator.Finalize()
+	if err == nil && result == nil && n.closing {
+		// Closed once the norms of the contributions are released
+		return nil
+	}
+	return n.closeRound(result, err)
+}
+
+// Server side: ends the open round with its result, or on err starts it
+// over rather than staying wedged, the contributors can send again
+func (n *Node) closeRound(result *RoundResult, err error) error {
+	if !n.aggregating {
+		return err
+	}
+	n.aggregating = false
+	n.closing = false
+	if err != nil {
+		n.sendFailure(err)
+		n.Pending = nil
+		if n.Replay != nil {
+			for _, p := range n.Server.Participants {
+				n.Replay.Forget(p, n.Round)
+			}
+		}
+		return err
+	}
+	if n.CentralPrivacy != nil {
+		n.CentralPrivacy.Spend(n.contributions())
+		fmt.Println("Aggregate released,", n.CentralPrivacy)
+	}
+	n.sendResult(result, n.Round)
+	n.endRound()
+	return nil
+}
+
+// Server side: reports the failure of the round to its contributors
+func (n *Node) sendFailure(err error) {
+	for _, p := range n.Pending {
+		pkt := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p.Source,
+			Message:     err.Error(),
+			Type:        transport.RoundFailed,
+			ID:          strconv.Itoa(n.Round),
+		}
+		go n.Socket.Send(p.Source, pkt)
+	}
+}
+
+// Client side: the round failed, its vectors won't be released and the
+// participant can contribute again
+func (n *Node) onRoundFailed(pkt transport.Packet) {
+	fmt.Println("Round", pkt.ID, "failed:", pkt.Message)
+	delete(n.releases, pkt.ID)
+	delete(n.releases, "norms-"+pkt.ID)
+}
+
+// Server side, checks pkt is the first contribution of a participant to the
+// round, of the type of the others
+func (n *Node) checkContribution(pkt transport.Packet, participants []string, handler string) error {
+	if !contains(participants, pkt.Source) {
+		return errors.New("[node." + handler + "]: " + pkt.Source + " is not a participant of the round")
+	}
+	for _, p := range n.Pending {
+		if p.Source == pkt.Source {
+			return errors.New("[node." + handler + "]: " + pkt.Source + " already contributed to the round")
+		}
+		if p.Type != pkt.Type {
+			return errors.New("[node." + handler + "]: weights and deltas mixed")
+		}
+	}
+	return nil
+}
+
+// Server side, the number of updates aggregated in the round
+func (n *Node) contributions() int {
+	if n.masked != nil && n.masked.Server != nil {
+		return len(n.masked.Server.Masked)
+	}
+	return len(n.Pending)
+}
+
+// Sends the result of round to its recipients, if any
+func (n *Node) sendResult(result *RoundResult, round int) {
+	if result == nil {
+		return
+	}
+	for _, p := range result.Recipients {
+		pktResult := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     result.Message,
+			Type:        result.Type,
+			ID:          strconv.Itoa(round),
+		}
+		go n.Socket.Send(p, pktResult)
+	}
+}
+
+// Encrypted weights or deltas, averaged under CKKS
+type ckksAggregator struct {
+	n            *Node
+	round        int
+	participants []string
+}
+
+func (a *ckksAggregator) Begin(round int, participants []string) error {
+	if a.n.AggregationRule != nil {
+		return errors.New("[node.ckksAggregator.Begin]: aggregation rules need the updates in clear")
+	}
+	a.round = round
+	a.participants = participants
+	return nil
+}
+
+func (a *ckksAggregator) Add(pkt transport.Packet) (bool, error) {
+	if pkt.Type != transport.EncryptedChunk && pkt.Type != transport.EncryptedDelta {
+		return false, errors.New("[node.ckksAggregator.Add]: unexpected " + pkt.Type + " contribution")
+	}
+	err := a.n.checkContribution(pkt, a.participants, "ckksAggregator.Add")
+	if err != nil {
+		return false, err
+	}
+	vector := new(encryption.EncryptedVector)
+	err = encryption.UnmarshalFromBase64(vector, pkt.Message)
+	if err != nil {
+		return false, err
+	}
+	length := len(a.n.NeuralNetwork.Weights)
+	if length == 0 && len(a.n.Pending) > 0 {
+		first := new(encryption.EncryptedVector)
+		err = encryption.UnmarshalFromBase64(first, a.n.Pending[0].Message)
+		if err == nil {
+			length = first.Length
+		}
+	}
+	if length > 0 && vector.Length != length {
+		return false, fmt.Errorf("[node.ckksAggregator.Add]: vector of length %d, %d expected", vector.Length, length)
+	}
+	// Pending packets are checkpointed
+	a.n.Pending = append(a.n.Pending, pkt)
+	return len(a.n.Pending) >= len(a.participants), nil
+}
+
+// Averages the pending weights, or updates the global model with the deltas.
+// With n.NormBound set, the contributions exceeding it are dropped first.
+func (a *ckksAggregator) Finalize() (*RoundResult, error) {
+	n := a.n
+	fmt.Println("Server calculations on", len(n.Pending), "polynomes")
+	updates := make([]*encryption.EncryptedVector, 0, len(n.Pending))
+	sources := make([]string, 0, len(n.Pending))
+	for _, p := range n.Pending {
+		if p.Type != n.Pending[0].Type {
+			return nil, errors.New("[node.ckksAggregator.Finalize]: weights and deltas mixed")
+		}
+		vector := new(encryption.EncryptedVector)
+		err := encryption.UnmarshalFromBase64(vector, p.Message)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		updates = append(updates, vector)
+		sources = append(sources, p.Source)
+	}
+	if len(updates) == 0 {
+		return nil, errors.New("[node.ckksAggregator.Finalize]: no valid contribution")
+	}
+	// Participants can't decrypt: every contributor receives the result
+	contributors := append([]string(nil), sources...)
+	deltas := n.Pending[0].Type == transport.EncryptedDelta
+
+	if n.NormBound > 0 {
+		n.closing = true
+		return nil, n.boundNorms(updates, sources, contributors, func(kept []*encryption.EncryptedVector) error {
+			return n.closeRound(a.average(kept, contributors, deltas))
+		})
+	}
+	return a.average(updates, contributors, deltas)
+}
+
+func (a *ckksAggregator) average(updates []*encryption.EncryptedVector, contributors []string, deltas bool) (*RoundResult, error) {
+	n := a.n
+	n.Server.Updates = updates
+	var aggregate *encryption.EncryptedVector
+	var err error
+	if deltas {
+		aggregate, err = n.applyDeltas(updates)
+	} else {
+		aggregate, err = n.Server.AverageVectorsNew(updates)
+		if err == nil {
+			aggregate, err = n.addServerNoise(aggregate, len(updates), 1)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	n.Server.Aggregate = aggregate
+
+	// Participants can't decrypt: under a collective key they release the
+	// result, under the server's public key the server does.
+	if n.collectiveKey() {
+		return nil, n.startDecryption(strconv.Itoa(a.round), aggregate, contributors, nil)
+	}
+	if n.KeyHolder {
+		return nil, n.releaseAggregate(aggregate, contributors)
+	}
+	return &RoundResult{
+		Type:       transport.Result,
+		Message:    encryption.MarshalToBase64String(aggregate),
+		Recipients: contributors,
+	}, nil
+}
+
+// Weights or deltas in clear, for debugging
+type plaintextAggregator struct {
+	n            *Node
+	participants []string
+}
+
+func (a *plaintextAggregator) Begin(round int, participants []string) error {
+	a.participants = participants
+	return nil
+}
+
+func (a *plaintextAggregator) Add(pkt transport.Packet) (bool, error) {
+	if pkt.Type != transport.PlainWeights && pkt.Type != transport.PlainDelta {
+		return false, errors.New("[node.plaintextAggregator.Add]: unexpected " + pkt.Type + " contribution")
+	}
+	err := a.n.checkContribution(pkt, a.participants, "plaintextAggregator.Add")
+	if err != nil {
+		return false, err
+	}
+	update := make([]float64, 0)
+	err = json.Unmarshal([]byte(pkt.Message), &update)
+	if err != nil {
+		return false, err
+	}
+	length := a.n.updateLength()
+	if length > 0 && len(update) != length {
+		return false, fmt.Errorf("[node.plaintextAggregator.Add]: vector of length %d, %d expected", len(update), length)
+	}
+	a.n.Pending = append(a.n.Pending, pkt)
+	return len(a.n.Pending) >= len(a.participants), nil
+}
+
+// The average of the weights, or of the deltas given to the server
+// optimizer, is the new global model of the server. The average is robust
+// with a robust n.AggregationRule.
+func (a *plaintextAggregator) Finalize() (*RoundResult, error) {
+	n := a.n
+	// Updates that can't be aggregated are left out, sender by sender
+	length := n.updateLength()
+	updates := make([][]float64, 0, len(n.Pending))
+	contributors := make([]string, 0, len(n.Pending))
+	for _, p := range n.Pending {
+		if p.Type != n.Pending[0].Type {
+			return nil, errors.New("[node.plaintextAggregator.Finalize]: weights and deltas mixed")
+		}
+		update := make([]float64, 0)
+		err := json.Unmarshal([]byte(p.Message), &update)
+		if err == nil && length > 0 && len(update) != length {
+			err = fmt.Errorf("[node.plaintextAggregator.Finalize]: update of %s of length %d, %d expected", p.Source, len(update), length)
+		}
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		updates = append(updates, update)
+		contributors = append(contributors, p.Source)
+	}
+	if len(updates) == 0 {
+		return nil, errors.New("[node.plaintextAggregator.Finalize]: no valid contribution")
+	}
+	rule := n.AggregationRule
+	if rule == nil {
+		rule = neural.Mean{}
+	}
+	average, err := rule.Aggregate(updates)
+	if err != nil {
+		return nil, err
+	}
+	for i, noise := range n.serverNoise(len(average), len(updates)) {
+		average[i] += noise
+	}
+
+	if n.Pending[0].Type == transport.PlainDelta {
+		optimizer := n.ServerOptimizer
+		if optimizer == nil {
+			optimizer = &neural.FedAvg{LearningRate: 1}
+		}
+		global := n.NeuralNetwork.Weights
+		if len(global) != len(average) {
+			return nil, errors.New("[node.plaintextAggregator.Finalize]: deltas don't match the global model")
+		}
+		average = optimizer.Step(global, average)
+	}
+	n.SetWeights(average)
+
+	msg, err := json.Marshal(n.NeuralNetwork.Weights)
+	if err != nil {
+		return nil, err
+	}
+	return &RoundResult{Type: transport.PlainResult, Message: string(msg), Recipients: contributors}, nil
+}
+
+// Server side, the length of the updates in clear: of the model, or of the
+// first contribution if the server has none
+func (n *Node) updateLength() int {
+	if len(n.NeuralNetwork.Weights) > 0 || len(n.Pending) == 0 {
+		return len(n.NeuralNetwork.Weights)
+	}
+	first := make([]float64, 0)
+	err := json.Unmarshal([]byte(n.Pending[0].Message), &first)
+	if err != nil {
+		return 0
+	}
+	return len(first)
+}
+
+// Client side, sends values in clear
+func (n *Node) sendPlain(server string, values []float64, t string) error {
+	msg, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	pkt := transport.Packet{
+		Source:      n.Socket.GetAddress(),
+		Destination: server,
+		Message:     string(msg),
+		Type:        t,
+	}
+	err = n.tag(&pkt)
+	if err != nil {
+		return err
+	}
+	return n.Socket.Send(server, pkt)
+}
+
+// Client side: the aggregate in clear is the new model
+func (n *Node) onPlainResult(pkt transport.Packet) error {
+	weights := make([]float64, 0)
+	err := json.Unmarshal([]byte(pkt.Message), &weights)
+	if err != nil {
+		return err
+	}
+	n.applyResult(weights, pkt.ID)
+	return nil
+}
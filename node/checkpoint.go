@@ -0,0 +1,221 @@
+package node
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"federated/encryption"
+	"federated/neural"
+	"federated/transport"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of the checkpoint format
+const CheckpointVersion = 3
+
+// Number of checkpoints kept in the directory, older ones are removed
+const CheckpointsKept = 3
+
+const checkpointPrefix = "checkpoint-"
+
+// Checkpoint is the state a server needs to resume a federation
+type Checkpoint struct {
+	Version      int
+	Round        int
+	Address      string
+	Participants []string
+	Identities   map[string]ed25519.PublicKey // of the participants
+	Model        *neural.NeuralNetwork        // nil before the first join
+	Result       string                       // last aggregate, base64
+	Pending      []transport.Packet
+	Optimizer    [][]float64 // state of a neural.StatefulOptimizer
+	SavedAt      time.Time
+}
+
+// SaveCheckpoint atomically writes the server state into n.CheckpointDir:
+// the file is written under a temporary name then renamed.
+func (n *Node) SaveCheckpoint() error {
+	if n.CheckpointDir == "" {
+		return errors.New("[node.SaveCheckpoint]: no checkpoint directory")
+	}
+	err := os.MkdirAll(n.CheckpointDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	c := Checkpoint{
+		Version:      CheckpointVersion,
+		Round:        n.Round,
+		Address:      n.Socket.GetAddress(),
+		Participants: n.Participants,
+		Identities:   n.Identities,
+		Result:       encryption.MarshalToBase64String(n.Server.Aggregate),
+		Pending:      n.Pending,
+		SavedAt:      time.Now().UTC(),
+	}
+	if len(n.NeuralNetwork.Layers) > 0 {
+		model := n.NeuralNetwork
+		c.Model = &model
+	}
+	if optimizer, ok := n.ServerOptimizer.(neural.StatefulOptimizer); ok {
+		c.Optimizer = optimizer.State()
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(n.CheckpointDir, ".tmp-"+checkpointPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(n.CheckpointDir, fmt.Sprintf("%s%08d.json", checkpointPrefix, n.Round))
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	return pruneCheckpoints(n.CheckpointDir)
+}
+
+// LatestCheckpoint returns the checkpoint of the last round saved in dir
+func LatestCheckpoint(dir string) (Checkpoint, error) {
+	names, err := checkpointNames(dir)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	if len(names) == 0 {
+		return Checkpoint{}, errors.New("[node.LatestCheckpoint]: no checkpoint in " + dir)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, names[len(names)-1]))
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	c := Checkpoint{}
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	if c.Version != CheckpointVersion {
+		return Checkpoint{}, fmt.Errorf("[node.LatestCheckpoint]: unsupported checkpoint version %d", c.Version)
+	}
+	return c, nil
+}
+
+// Resume restores the server state from the latest checkpoint of dir,
+// and announces the (possibly new) server address to the participants,
+// which only accept it from the identity of the server (see CreateFromKeystore).
+// Next aggregation will be the round after the checkpointed one. A stateful
+// n.ServerOptimizer, set before, carries on from the checkpointed state.
+func (n *Node) Resume(dir string) error {
+	c, err := LatestCheckpoint(dir)
+	if err != nil {
+		return err
+	}
+	optimizer, stateful := n.ServerOptimizer.(neural.StatefulOptimizer)
+	if c.Optimizer != nil && !stateful {
+		return errors.New("[node.Resume]: checkpoint of a stateful server optimizer, set ServerOptimizer first")
+	}
+	if c.Optimizer != nil {
+		err = optimizer.SetState(c.Optimizer)
+		if err != nil {
+			return err
+		}
+	}
+
+	n.CheckpointDir = dir
+	n.Round = c.Round
+	n.Server.Participants = c.Participants
+	if n.Identities == nil {
+		n.Identities = make(map[string]ed25519.PublicKey)
+	}
+	for address, identity := range c.Identities {
+		n.Identities[address] = identity
+	}
+	n.Pending = c.Pending
+	// Checkpointed contributions cannot be replayed after the restart
+	if n.Replay != nil {
+		for _, pkt := range n.Pending {
+			err = n.Replay.Check(pkt.Source, pkt.Round, pkt.Nonce, n.Round)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+	if c.Model != nil {
+		n.NeuralNetwork = *c.Model
+	}
+	n.Server.Aggregate = nil
+	if c.Result != "nil" {
+		n.Server.Aggregate = new(encryption.EncryptedVector)
+		err = encryption.UnmarshalFromBase64(n.Server.Aggregate, c.Result)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range n.Participants {
+		pkt := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     strconv.Itoa(n.Round),
+			Type:        transport.Resume,
+		}
+		err = n.Socket.Send(p, pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	return nil
+}
+
+// Sorted names of the checkpoints of dir, oldest first
+func checkpointNames(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), checkpointPrefix) && strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, f.Name())
+		}
+	}
+	// round is zero-padded, lexical order is round order
+	sort.Strings(names)
+	return names, nil
+}
+
+func pruneCheckpoints(dir string) error {
+	names, err := checkpointNames(dir)
+	if err != nil {
+		return err
+	}
+	for len(names) > CheckpointsKept {
+		err = os.Remove(filepath.Join(dir, names[0]))
+		if err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
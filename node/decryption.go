@@ -0,0 +1,493 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"federated/encryption"
+	"federated/transport"
+	"fmt"
+
+	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/rlwe"
+)
+
+// Once a collective key is generated, nobody holds the secret key: the
+// aggregate is released by the participants, each sending a decryption share.
+// With n.Threshold set and the Shamir shares exchanged (StartThresholdSetup),
+// any Threshold participants are enough, RetryDecryption replacing those that
+// don't answer. Otherwise every participant is needed.
+//
+// Participants only release what they contributed to: the aggregate and the
+// norms of a round they uploaded to, or an evaluation they answered, until
+// they get its result, and a single vector for each.
+
+// Server state of the Shamir shares exchange
+type thresholdSetup struct {
+	Threshold int
+	Points    map[string]uint64 // evaluation point of each participant
+	Keys      map[string]string // sharing public keys, base64
+	Shares    map[string]map[string]string
+	Done      bool
+}
+
+// Server state of a collective decryption
+type decryptionRound struct {
+	ID         string
+	Vector     *encryption.EncryptedVector
+	Set        []string // participants asked for a share
+	Recipients []string
+	Shares     map[string][]*drlwe.CKSShare
+	Done       func(released *encryption.EncryptedVector) error // sends the release to Recipients if nil
+	Silent     []string                                         // members given up, see RetryDecryption
+}
+
+// Client side, what the server sends for the shares exchange
+type thresholdParams struct {
+	Threshold int
+	Points    map[string]uint64
+}
+
+type decryptionParams struct {
+	Vector       string
+	Points       []uint64 // nil if every participant takes part
+	Contributors []string
+}
+
+// StartThresholdSetup has the participants Shamir-share their secret key
+// shares, so that any n.Threshold of them can decrypt.
+// Must follow the collective key generation.
+func (n *Node) StartThresholdSetup() error {
+	kg := n.Server.KeyGeneration
+	if kg == nil || kg.PublicKey == nil {
+		return errors.New("[node.StartThresholdSetup]: no collective key")
+	}
+	if n.Threshold < 1 || n.Threshold > len(kg.Expected) {
+		return fmt.Errorf("[node.StartThresholdSetup]: threshold must be in [1, %d]", len(kg.Expected))
+	}
+
+	setup := &thresholdSetup{
+		Threshold: n.Threshold,
+		Points:    make(map[string]uint64),
+		Keys:      make(map[string]string),
+		Shares:    make(map[string]map[string]string),
+	}
+	for i, p := range kg.Expected {
+		setup.Points[p] = uint64(i + 1)
+	}
+	n.threshold = setup
+
+	msg, err := json.Marshal(thresholdParams{Threshold: setup.Threshold, Points: setup.Points})
+	if err != nil {
+		return err
+	}
+	for _, p := range kg.Expected {
+		pkt := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     string(msg),
+			Type:        transport.ThresholdSetup,
+		}
+		err = n.Socket.Send(p, pkt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ThresholdReady returns whether the server can decrypt with a subset of the participants
+func (n *Node) ThresholdReady() bool {
+	return n.threshold != nil && n.threshold.Done
+}
+
+// Client side: draws the key pair its shares will be sealed with
+func (n *Node) onThresholdSetup(pkt transport.Packet) error {
+	params := thresholdParams{}
+	err := json.Unmarshal([]byte(pkt.Message), &params)
+	if err != nil {
+		return err
+	}
+	n.thresholdParams = params
+	pub, err := n.Client.GenSharingKey()
+	if err != nil {
+		return err
+	}
+
+	pktKey := transport.Packet{
+		Source:      n.Socket.GetAddress(),
+		Destination: pkt.Source,
+		Message:     base64.StdEncoding.EncodeToString(pub[:]),
+		Type:        transport.SharingKey,
+	}
+	return n.Socket.Send(pkt.Source, pktKey)
+}
+
+// Server side: broadcasts the sharing keys once everybody sent theirs
+func (n *Node) onSharingKey(pkt transport.Packet) error {
+	setup := n.threshold
+	if setup == nil {
+		return errors.New("[node.onSharingKey]: no threshold setup in progress")
+	}
+	if _, ok := setup.Points[pkt.Source]; !ok {
+		return errors.New("[node.onSharingKey]: " + pkt.Source + " is not part of the threshold setup")
+	}
+	setup.Keys[pkt.Source] = pkt.Message
+	if len(setup.Keys) < len(setup.Points) {
+		return nil
+	}
+
+	msg, err := json.Marshal(setup.Keys)
+	if err != nil {
+		return err
+	}
+	for p := range setup.Points {
+		pktKeys := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     string(msg),
+			Type:        transport.SharingKeys,
+		}
+		go n.Socket.Send(p, pktKeys)
+	}
+	return nil
+}
+
+// Client side: sends a Shamir share of its secret key to every participant,
+// sealed with their sharing key so that the server can't read them.
+func (n *Node) onSharingKeys(pkt transport.Packet) error {
+	keys := make(map[string]string)
+	err := json.Unmarshal([]byte(pkt.Message), &keys)
+	if err != nil {
+		return err
+	}
+
+	participants := make([]string, 0, len(n.thresholdParams.Points))
+	points := make([]uint64, 0, len(n.thresholdParams.Points))
+	for p, x := range n.thresholdParams.Points {
+		participants = append(participants, p)
+		points = append(points, x)
+	}
+	shares, err := n.Client.GenShamirShares(n.thresholdParams.Threshold, points)
+	if err != nil {
+		return err
+	}
+
+	sealed := make(map[string]string)
+	for i, p := range participants {
+		key, err := base64.StdEncoding.DecodeString(keys[p])
+		if err != nil || len(key) != 32 {
+			return errors.New("[node.onSharingKeys]: invalid sharing key for " + p)
+		}
+		recipient := new([32]byte)
+		copy(recipient[:], key)
+		b, err := encryption.SealShare(shares[i], recipient)
+		if err != nil {
+			return err
+		}
+		sealed[p] = base64.StdEncoding.EncodeToString(b)
+	}
+	msg, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+
+	pktShares := transport.Packet{
+		Source:      n.Socket.GetAddress(),
+		Destination: pkt.Source,
+		Message:     string(msg),
+		Type:        transport.SealedShares,
+	}
+	go n.Socket.Send(pkt.Source, pktShares)
+	return nil
+}
+
+// Sealed shares go from each participant to the server (by recipient),
+// then from the server to each recipient (by sender).
+func (n *Node) onSealedShares(pkt transport.Packet) error {
+	sealed := make(map[string]string)
+	err := json.Unmarshal([]byte(pkt.Message), &sealed)
+	if err != nil {
+		return err
+	}
+	if pkt.Source == n.ServerAddress {
+		return n.openShares(sealed)
+	}
+
+	// Server side
+	setup := n.threshold
+	if setup == nil || setup.Done {
+		return errors.New("[node.onSealedShares]: no threshold setup in progress")
+	}
+	if _, ok := setup.Points[pkt.Source]; !ok {
+		return errors.New("[node.onSealedShares]: " + pkt.Source + " is not part of the threshold setup")
+	}
+	if len(sealed) != len(setup.Points) {
+		return errors.New("[node.onSealedShares]: " + pkt.Source + " didn't send a share per participant")
+	}
+	setup.Shares[pkt.Source] = sealed
+	if len(setup.Shares) < len(setup.Points) {
+		return nil
+	}
+
+	for recipient := range setup.Points {
+		received := make(map[string]string)
+		for sender, shares := range setup.Shares {
+			received[sender] = shares[recipient]
+		}
+		msg, err := json.Marshal(received)
+		if err != nil {
+			return err
+		}
+		pktShares := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: recipient,
+			Message:     string(msg),
+			Type:        transport.SealedShares,
+		}
+		go n.Socket.Send(recipient, pktShares)
+	}
+	setup.Shares = nil
+	setup.Done = true
+	fmt.Println("Threshold decryption set up,", setup.Threshold, "out of", len(setup.Points))
+	return nil
+}
+
+// Client side: sums the shares received into its threshold key
+func (n *Node) openShares(sealed map[string]string) error {
+	shares := make([]*rlwe.SecretKey, 0, len(sealed))
+	for sender, s := range sealed {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		share, err := n.Client.OpenShare(b)
+		if err != nil {
+			return errors.New("[node.openShares]: share of " + sender + ": " + err.Error())
+		}
+		shares = append(shares, share)
+	}
+	n.Client.SetShamirShares(shares)
+	return nil
+}
+
+// Server side: asks the decryption set for their shares of v, the released
+// vector being sent to the contributors, or given to done if not nil.
+// The set is the first n.Threshold contributors if the threshold is set up,
+// every participant of the key generation otherwise.
+func (n *Node) startDecryption(id string, v *encryption.EncryptedVector, contributors []string, done func(*encryption.EncryptedVector) error) error {
+	n.decryption = &decryptionRound{
+		ID:         id,
+		Vector:     v,
+		Recipients: contributors,
+		Done:       done,
+	}
+	return n.requestShares(n.decryption)
+}
+
+// RetryDecryption stops waiting for the members of the decryption set that
+// didn't send their share, and asks other contributors instead. Only
+// possible with the threshold set up, every participant being needed otherwise.
+func (n *Node) RetryDecryption() error {
+	d := n.decryption
+	if d == nil {
+		return errors.New("[node.RetryDecryption]: no decryption in progress")
+	}
+	if !n.ThresholdReady() {
+		return errors.New("[node.RetryDecryption]: every participant is needed without threshold")
+	}
+	for _, p := range d.Set {
+		if _, ok := d.Shares[p]; !ok {
+			d.Silent = append(d.Silent, p)
+		}
+	}
+	return n.requestShares(d)
+}
+
+// Server side: chooses the decryption set of d, asks it for its shares
+func (n *Node) requestShares(d *decryptionRound) error {
+	set := n.Server.KeyGeneration.Expected
+	var points []uint64
+	if n.ThresholdReady() {
+		set = make([]string, 0, n.threshold.Threshold)
+		for _, p := range d.Recipients {
+			if _, ok := n.threshold.Points[p]; ok && !contains(d.Silent, p) && len(set) < n.threshold.Threshold {
+				set = append(set, p)
+			}
+		}
+		if len(set) < n.threshold.Threshold {
+			return fmt.Errorf("[node.requestShares]: %d contributors available, %d needed", len(set), n.threshold.Threshold)
+		}
+		for _, p := range set {
+			points = append(points, n.threshold.Points[p])
+		}
+	}
+	// Shares depend on the set, through the Lagrange coefficients
+	d.Set = set
+	d.Shares = make(map[string][]*drlwe.CKSShare)
+
+	msg, err := json.Marshal(decryptionParams{Vector: encryption.MarshalToBase64String(d.Vector), Points: points, Contributors: d.Recipients})
+	if err != nil {
+		return err
+	}
+	for _, p := range set {
+		pkt := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     string(msg),
+			Type:        transport.DecryptionRequest,
+			ID:          d.ID,
+		}
+		go n.Socket.Send(p, pkt)
+	}
+	return nil
+}
+
+// Client side: agrees to release the vectors of ids, see checkRelease
+func (n *Node) expectRelease(ids ...string) {
+	if n.releases == nil {
+		n.releases = make(map[string]string)
+	}
+	for _, id := range ids {
+		if _, ok := n.releases[id]; !ok {
+			n.releases[id] = ""
+		}
+	}
+}
+
+// Client side: whether the decryption request is for something the
+// participant contributed to, binding its ID to the vector requested
+func (n *Node) checkRelease(id string, params decryptionParams) error {
+	hash, ok := n.releases[id]
+	if !ok {
+		return errors.New("[node.onDecryptionRequest]: nothing contributed to release as " + id)
+	}
+	if !contains(params.Contributors, n.Socket.GetAddress()) {
+		return errors.New("[node.onDecryptionRequest]: " + id + " is not an aggregate of our contribution")
+	}
+	sum := sha256.Sum256([]byte(params.Vector))
+	vector := hex.EncodeToString(sum[:])
+	if hash != "" && hash != vector {
+		return errors.New("[node.onDecryptionRequest]: another vector was already released as " + id)
+	}
+	n.releases[id] = vector
+	return nil
+}
+
+// Client side: sends its decryption share of the vector
+func (n *Node) onDecryptionRequest(pkt transport.Packet) error {
+	params := decryptionParams{}
+	err := json.Unmarshal([]byte(pkt.Message), &params)
+	if err != nil {
+		return err
+	}
+	err = n.checkRelease(pkt.ID, params)
+	if err != nil {
+		return err
+	}
+	v := new(encryption.EncryptedVector)
+	err = encryption.UnmarshalFromBase64(v, params.Vector)
+	if err != nil {
+		return err
+	}
+
+	point := n.thresholdParams.Points[n.Socket.GetAddress()]
+	shares, err := n.Client.GenDecryptionShares(v, point, params.Points)
+	if err != nil {
+		return err
+	}
+	encoded := make([]string, len(shares))
+	for i, s := range shares {
+		encoded[i] = encryption.MarshalToBase64String(s)
+	}
+	msg, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+
+	pktShare := transport.Packet{
+		Source:      n.Socket.GetAddress(),
+		Destination: pkt.Source,
+		Message:     string(msg),
+		Type:        transport.DecryptionShare,
+		ID:          pkt.ID,
+	}
+	go n.Socket.Send(pkt.Source, pktShare)
+	return nil
+}
+
+// Server side: releases the vector once the whole set sent its shares
+func (n *Node) onDecryptionShare(pkt transport.Packet) error {
+	d := n.decryption
+	if d == nil || pkt.ID != d.ID {
+		return errors.New("[node.onDecryptionShare]: no decryption " + pkt.ID + " in progress")
+	}
+	if !contains(d.Set, pkt.Source) {
+		return errors.New("[node.onDecryptionShare]: " + pkt.Source + " is not part of the decryption set")
+	}
+	encoded := make([]string, 0)
+	err := json.Unmarshal([]byte(pkt.Message), &encoded)
+	if err != nil {
+		return err
+	}
+	shares := make([]*drlwe.CKSShare, len(encoded))
+	for i, s := range encoded {
+		shares[i] = new(drlwe.CKSShare)
+		err = encryption.UnmarshalFromBase64(shares[i], s)
+		if err != nil {
+			return err
+		}
+	}
+	d.Shares[pkt.Source] = shares
+	if len(d.Shares) < len(d.Set) {
+		return nil
+	}
+
+	all := make([][]*drlwe.CKSShare, 0, len(d.Shares))
+	for _, s := range d.Shares {
+		all = append(all, s)
+	}
+	released, err := n.Server.ReleaseVector(d.Vector, all)
+	if err != nil {
+		return err
+	}
+	n.decryption = nil
+	if d.Done != nil {
+		return d.Done(released)
+	}
+	n.sendReleased(released, d.Recipients, d.ID)
+	return nil
+}
+
+// Sends the released aggregate, anybody can decode it
+func (n *Node) sendReleased(released *encryption.EncryptedVector, recipients []string, id string) {
+	msg := encryption.MarshalToBase64String(released)
+	for _, p := range recipients {
+		pktResult := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     msg,
+			Type:        transport.DecryptedResult,
+			ID:          id,
+		}
+		go n.Socket.Send(p, pktResult)
+	}
+}
+
+// Client side: the released aggregate is the new model
+func (n *Node) onDecryptedResult(pkt transport.Packet) error {
+	v := new(encryption.EncryptedVector)
+	err := encryption.UnmarshalFromBase64(v, pkt.Message)
+	if err != nil {
+		return err
+	}
+	weights, err := encryption.DecodeReleasedVector(n.Client.Params, v)
+	if err != nil {
+		return err
+	}
+	n.debugPrecision("released aggregate", v, weights, nil)
+	n.applyResult(weights, pkt.ID)
+	return nil
+}
@@ -0,0 +1,157 @@
+package node
+
+import (
+	"errors"
+	"federated/encryption"
+	"federated/neural"
+	"federated/privacy"
+	"federated/transport"
+)
+
+// SendDelta sends the difference between the local weights and
+// the global model of the round, instead of the weights themselves,
+// encrypted unless aggregated in clear, made private if privacy is set.
+func (n *Node) SendDelta(server string) error {
+	if n.Rounds == 0 && n.Seed == 0 {
+		return errors.New("[node.SendDelta]: no initial model shared with the server, see Seed")
+	}
+	if len(n.GlobalWeights) != len(n.NeuralNetwork.Weights) {
+		return errors.New("[node.SendDelta]: no global model to compute the delta from")
+	}
+	delta := make([]float64, len(n.NeuralNetwork.Weights))
+	for i, w := range n.NeuralNetwork.Weights {
+		delta[i] = w - n.GlobalWeights[i]
+	}
+	delta, err := n.privateUpdate(delta)
+	if err != nil {
+		return err
+	}
+	switch n.Aggregation {
+	case PlaintextAggregation:
+		return n.sendPlain(server, delta, transport.PlainDelta)
+	case MaskedAggregation:
+		return errors.New("[node.SendDelta]: deltas aren't supported by masked aggregation")
+	}
+	pkt := transport.Packet{
+		Source:      n.Socket.GetAddress(),
+		Destination: server,
+		Message:     encryption.MarshalToBase64String(n.EncryptVector(delta)),
+		Type:        transport.EncryptedDelta,
+	}
+	err = n.tag(&pkt)
+	if err != nil {
+		return err
+	}
+	return n.Socket.Send(server, pkt)
+}
+
+// Server side, returns the new global model, encrypted.
+// FedAvg runs on the encrypted deltas, other optimizers need the server
+// to hold the secret key, see DistributePublicKey, to decrypt their average
+// and the global model.
+func (n *Node) applyDeltas(deltas []*encryption.EncryptedVector) (*encryption.EncryptedVector, error) {
+	optimizer := n.ServerOptimizer
+	if optimizer == nil {
+		optimizer = &neural.FedAvg{LearningRate: 1}
+	}
+
+	if fedAvg, ok := optimizer.(*neural.FedAvg); ok {
+		var global *encryption.EncryptedVector
+		var err error
+		if n.Server.Aggregate != nil {
+			global, err = n.Server.AddDeltasNew(n.Server.Aggregate, deltas, fedAvg.LearningRate)
+		} else {
+			// First round, the server's model is the global one
+			global, err = n.Server.AddDeltasToPlainNew(n.NeuralNetwork.Weights, deltas, fedAvg.LearningRate)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return n.addServerNoise(global, len(deltas), fedAvg.LearningRate)
+	}
+
+	if !n.KeyHolder {
+		return nil, errors.New("[node.applyDeltas]: the server can't decrypt the average delta for its optimizer")
+	}
+	average, err := n.Server.AverageVectorsNew(deltas)
+	if err != nil {
+		return nil, err
+	}
+	delta, err := n.Client.DecryptVector(average)
+	if err != nil {
+		return nil, err
+	}
+	global := n.NeuralNetwork.Weights
+	if n.Server.Aggregate != nil {
+		global, err = n.Client.DecryptVector(n.Server.Aggregate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(delta) != len(global) {
+		return nil, errors.New("[node.applyDeltas]: deltas don't match the global model")
+	}
+	for i, noise := range n.serverNoise(len(delta), len(deltas)) {
+		delta[i] += noise
+	}
+	n.SetWeights(optimizer.Step(global, delta))
+	return n.Client.EncryptVector(n.NeuralNetwork.Weights), nil
+}
+
+// Client side, the weights to upload: with differential privacy, the global
+// model plus the private update.
+func (n *Node) privateWeights() ([]float64, error) {
+	if n.Privacy == nil && n.CentralPrivacy == nil {
+		return n.NeuralNetwork.Weights, nil
+	}
+	if len(n.GlobalWeights) != len(n.NeuralNetwork.Weights) {
+		return nil, errors.New("[node.privateWeights]: no global model to compute the update from")
+	}
+	update := make([]float64, len(n.NeuralNetwork.Weights))
+	for i, w := range n.NeuralNetwork.Weights {
+		update[i] = w - n.GlobalWeights[i]
+	}
+	update, err := n.privateUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+	weights := make([]float64, len(update))
+	for i, u := range update {
+		weights[i] = n.GlobalWeights[i] + u
+	}
+	return weights, nil
+}
+
+// Client side, the update made private by the configured mechanism
+func (n *Node) privateUpdate(update []float64) ([]float64, error) {
+	switch {
+	case n.Privacy != nil && n.CentralPrivacy != nil:
+		return nil, errors.New("[node.privateUpdate]: local and central privacy are alternatives")
+	case n.Privacy != nil:
+		return n.Privacy.Privatize(update)
+	case n.CentralPrivacy != nil:
+		return n.CentralPrivacy.Prepare(update), nil
+	}
+	return update, nil
+}
+
+// Server side, the noise of an average of count updates, nil if none
+func (n *Node) serverNoise(length int, count int) []float64 {
+	if n.CentralPrivacy == nil || n.CentralPrivacy.Mode != privacy.ServerNoise {
+		return nil
+	}
+	return n.CentralPrivacy.Noise(length, count)
+}
+
+// Server side, adds the noise of an average of count updates, times scale,
+// to the encrypted aggregate
+func (n *Node) addServerNoise(v *encryption.EncryptedVector, count int, scale float64) (*encryption.EncryptedVector, error) {
+	noise := n.serverNoise(v.Length, count)
+	if noise == nil {
+		return v, nil
+	}
+	for i := range noise {
+		noise[i] *= scale
+	}
+	return n.Server.AddValuesNew(v, noise)
+}
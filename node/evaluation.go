@@ -0,0 +1,165 @@
+package node
+
+import (
+	"errors"
+	"federated/encryption"
+	"federated/neural"
+	"federated/transport"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ldsec/lattigo/v2/ckks"
+)
+
+// Evaluation round currently waited for by the server
+type evaluationRound struct {
+	ID        int
+	Task      string
+	Selected  []string
+	Responses map[string]*ckks.Ciphertext
+}
+
+// StartEvaluation asks the selected participants (all of them if none given)
+// to evaluate the global model on their held-out data. Their encrypted metric
+// sums are added up, so that only the aggregate is learnt: it is released
+// jointly, under a collective key (threshold or not). A server holding the
+// key could decrypt each answer.
+func (n *Node) StartEvaluation(task string, participants ...string) error {
+	if !n.collectiveKey() {
+		return errors.New("[node.StartEvaluation]: metrics are only released under a collective key, see StartKeyGeneration")
+	}
+	if len(participants) == 0 {
+		participants = n.Participants
+	}
+	if len(participants) == 0 {
+		return errors.New("[node.StartEvaluation]: no participant to evaluate")
+	}
+
+	n.evaluation.ID++
+	n.evaluation.Task = task
+	n.evaluation.Selected = participants
+	n.evaluation.Responses = make(map[string]*ckks.Ciphertext)
+
+	for _, p := range participants {
+		pkt := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     task,
+			Type:        transport.Evaluate,
+			ID:          strconv.Itoa(n.evaluation.ID),
+		}
+		err := n.Socket.Send(p, pkt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Client side: evaluates the current model and sends back the encrypted sums
+func (n *Node) onEvaluate(pkt transport.Packet) error {
+	for id := range n.releases {
+		if strings.HasPrefix(id, "eval-") {
+			delete(n.releases, id)
+		}
+	}
+	n.expectRelease("eval-" + pkt.ID)
+	task := pkt.Message
+	sums := neural.NewEvaluationSums(task, n.OutputDimensions)
+	if len(n.Validation.Inputs) > 0 {
+		var err error
+		validation := n.Validation
+		validation.Task = task
+		sums, err = n.EvaluateSums(validation)
+		if err != nil {
+			return err
+		}
+	}
+
+	cipher, err := n.Client.Encrypt(sums.Vector())
+	if err != nil {
+		return err
+	}
+	pktMetrics := transport.Packet{
+		Source:      n.Socket.GetAddress(),
+		Destination: pkt.Source,
+		Message:     cipher,
+		Type:        transport.EncryptedMetrics,
+		ID:          pkt.ID,
+	}
+
+	// Not blocking the receiving loop, which gets the acks
+	go n.Socket.Send(pkt.Source, pktMetrics)
+	return nil
+}
+
+// Server side: collects the encrypted sums, and once every selected
+// participant answered, releases their aggregate only.
+func (n *Node) onEncryptedMetrics(pkt transport.Packet) error {
+	round := &n.evaluation
+	if pkt.ID != strconv.Itoa(round.ID) || round.Responses == nil {
+		return errors.New("[node.onEncryptedMetrics]: no evaluation round " + pkt.ID)
+	}
+	if !contains(round.Selected, pkt.Source) {
+		return errors.New("[node.onEncryptedMetrics]: " + pkt.Source + " was not selected for evaluation")
+	}
+	if _, ok := round.Responses[pkt.Source]; ok {
+		return errors.New("[node.onEncryptedMetrics]: " + pkt.Source + " already answered")
+	}
+
+	cipher := new(ckks.Ciphertext)
+	err := encryption.UnmarshalFromBase64(cipher, pkt.Message)
+	if err != nil {
+		return err
+	}
+	round.Responses[pkt.Source] = cipher
+	if len(round.Responses) < len(round.Selected) {
+		return nil
+	}
+
+	// Server calculations -> sums the metrics
+	var sum *ckks.Ciphertext
+	for _, c := range round.Responses {
+		if sum == nil {
+			sum = c
+		} else {
+			sum = n.Server.AddNew(sum, c)
+		}
+	}
+	round.Responses = nil
+
+	empty := neural.NewEvaluationSums(round.Task, n.OutputDimensions)
+	v := &encryption.EncryptedVector{
+		Length:   len(empty.Vector()),
+		Encoding: encryption.CoeffsEncoding,
+		Chunks:   []*ckks.Ciphertext{sum},
+	}
+	task, id := round.Task, round.ID
+	record := func(released *encryption.EncryptedVector) error {
+		values, err := encryption.DecodeReleasedVector(n.Server.Params, released)
+		if err != nil {
+			return err
+		}
+		sums, err := neural.EvaluationSumsFromVector(task, n.OutputDimensions, values)
+		if err != nil {
+			return err
+		}
+		n.FederatedEvaluations = append(n.FederatedEvaluations, sums.Metrics())
+		fmt.Println("Federated evaluation", id, "on", sums.Metrics().Samples, "samples")
+		return nil
+	}
+	if !n.collectiveKey() {
+		return errors.New("[node.onEncryptedMetrics]: nobody can release the metrics")
+	}
+	return n.startDecryption("eval-"+pkt.ID, v, round.Selected, record)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package node
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"federated/transport"
+)
+
+// Packets are signed by the identity of their sender (transport.Packet.Sign).
+// Identities are bound to addresses on first contact: the server binds that
+// of a participant on its Join once admitted (see Admission), a participant that of the server on the
+// Params answering its Join. Every other packet must then come from a bound
+// address, signed by its identity, and those the server sends to its
+// participants from the server joined. Over encrypted channels, packets must
+// also be signed by the identity proven in the handshake with their source.
+
+// Types of the packets a server sends to its participants
+var serverTypes = map[string]bool{
+	transport.Params:              true,
+	transport.JoinRejected:        true,
+	transport.RoundFailed:         true,
+	transport.Result:              true,
+	transport.PlainResult:         true,
+	transport.Evaluate:            true,
+	transport.KeyGenRequest:       true,
+	transport.CollectivePublicKey: true,
+	transport.NormKeyRequest:      true,
+	transport.RelinKeyRequest:     true,
+	transport.PublicKey:           true,
+	transport.ThresholdSetup:      true,
+	transport.SharingKeys:         true,
+	transport.DecryptionRequest:   true,
+	transport.DecryptedResult:     true,
+	transport.MaskingRequest:      true,
+	transport.UnmaskRequest:       true,
+	transport.MaskedResult:        true,
+}
+
+// Types relayed by the server, sent both ways
+var relayedTypes = map[string]bool{
+	transport.SealedShares:  true,
+	transport.MaskingKeys:   true,
+	transport.MaskingShares: true,
+}
+
+// Identity returns the public key identifying the node
+func (n *Node) Identity() ed25519.PublicKey {
+	return n.Socket.Identity()
+}
+
+// Checks the packet against the identity bound to its source, binding that
+// of the server on first contact
+func (n *Node) checkIdentity(pkt transport.Packet) error {
+	err := pkt.Verify()
+	if err != nil {
+		return errors.New("[node.OnReceive]: packet of " + pkt.Source + " rejected: " + err.Error())
+	}
+	if n.Socket.Encrypted() {
+		channel := n.Socket.PeerIdentity(pkt.Source)
+		if channel == nil || !bytes.Equal(channel, pkt.Signer) {
+			return errors.New("[node.OnReceive]: " + pkt.Type + " packet of " + pkt.Source + " rejected: not signed by the identity of the channel")
+		}
+	}
+	if n.Identities == nil {
+		n.Identities = make(map[string]ed25519.PublicKey)
+	}
+
+	switch {
+	case pkt.Type == transport.Join:
+		// Bound once admitted
+		return nil
+	case pkt.Type == transport.Resume:
+		// The server restarted on a new address, with the same identity
+		server, known := n.Identities[n.ServerAddress]
+		if !known || !bytes.Equal(server, pkt.Signer) {
+			return errors.New("[node.OnReceive]: resume from " + pkt.Source + " rejected: not signed by the server")
+		}
+		n.Identities[pkt.Source] = pkt.Signer
+		return nil
+	case serverTypes[pkt.Type] || (relayedTypes[pkt.Type] && pkt.Source == n.ServerAddress):
+		if n.ServerAddress == "" || pkt.Source != n.ServerAddress {
+			return errors.New("[node.OnReceive]: " + pkt.Type + " packet of " + pkt.Source + " rejected: not from the server joined")
+		}
+		_, bound := n.Identities[pkt.Source]
+		if !bound && pkt.Signed() {
+			switch pkt.Type {
+			case transport.Params:
+				n.Identities[pkt.Source] = pkt.Signer
+			case transport.JoinRejected:
+				return nil
+			}
+		}
+	}
+
+	bound, ok := n.Identities[pkt.Source]
+	switch {
+	case !ok:
+		return errors.New("[node.OnReceive]: " + pkt.Type + " packet of " + pkt.Source + " rejected: unknown source")
+	case !pkt.Signed():
+		return errors.New("[node.OnReceive]: " + pkt.Type + " packet of " + pkt.Source + " rejected: unsigned")
+	case !bytes.Equal(bound, pkt.Signer):
+		return errors.New("[node.OnReceive]: " + pkt.Type + " packet of " + pkt.Source + " rejected: signed by another identity")
+	}
+	return nil
+}
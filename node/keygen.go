@@ -0,0 +1,102 @@
+package node
+
+import (
+	"encoding/base64"
+	"errors"
+	"federated/encryption"
+	"federated/transport"
+	"fmt"
+
+	"github.com/ldsec/lattigo/v2/drlwe"
+)
+
+// StartKeyGeneration runs a collective public key generation among the
+// participants: each of them keeps a share of the secret key, and they all
+// end up encrypting under the same public key.
+func (n *Node) StartKeyGeneration() error {
+	if len(n.Participants) == 0 {
+		return errors.New("[node.StartKeyGeneration]: no participant")
+	}
+	kg, err := n.Server.StartKeyGeneration(n.Participants)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range kg.Expected {
+		pkt := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     base64.StdEncoding.EncodeToString(kg.Seed),
+			Type:        transport.KeyGenRequest,
+		}
+		err = n.Socket.Send(p, pkt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Server side, whether the participants encrypt under a collective key
+func (n *Node) collectiveKey() bool {
+	return n.Server.KeyGeneration != nil && n.Server.KeyGeneration.PublicKey != nil
+}
+
+// Client side: draws a secret key share and sends its public share
+func (n *Node) onKeyGenRequest(pkt transport.Packet) error {
+	seed, err := base64.StdEncoding.DecodeString(pkt.Message)
+	if err != nil {
+		return err
+	}
+	share, err := n.Client.GenKeyGenShare(seed)
+	if err != nil {
+		return err
+	}
+
+	pktShare := transport.Packet{
+		Source:      n.Socket.GetAddress(),
+		Destination: pkt.Source,
+		Message:     encryption.MarshalToBase64String(share),
+		Type:        transport.KeyGenShare,
+	}
+	// Not blocking the receiving loop, which gets the acks
+	go n.Socket.Send(pkt.Source, pktShare)
+	return nil
+}
+
+// Server side: aggregates the shares, and sends the collective
+// public key to the participants once complete.
+func (n *Node) onKeyGenShare(pkt transport.Packet) error {
+	share := new(drlwe.CKGShare)
+	err := encryption.UnmarshalFromBase64(share, pkt.Message)
+	if err != nil {
+		return err
+	}
+	done, err := n.Server.AddKeyGenShare(pkt.Source, share)
+	if err != nil || !done {
+		return err
+	}
+
+	fmt.Println("Collective public key generated by", len(n.KeyGeneration.Expected), "participants")
+	pk := encryption.MarshalToBase64String(n.KeyGeneration.PublicKey)
+	for _, p := range n.KeyGeneration.Expected {
+		pktKey := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     pk,
+			Type:        transport.CollectivePublicKey,
+		}
+		go n.Socket.Send(p, pktKey)
+	}
+	return nil
+}
+
+// Client side: encrypts under the collective public key from now on
+func (n *Node) onCollectivePublicKey(pkt transport.Packet) error {
+	pk, err := encryption.UnmarshalPublicKey(n.Client.Params, pkt.Message)
+	if err != nil {
+		return err
+	}
+	n.Client.SetPublicKey(pk)
+	return nil
+}
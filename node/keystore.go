@@ -0,0 +1,58 @@
+package node
+
+import (
+	"federated/encryption"
+	"os"
+)
+
+// Keys returns the key material of the node
+func (n *Node) Keys() encryption.Keys {
+	keys := n.Client.Keys()
+	keys.RelinearizationKey = n.Server.RelinearizationKey
+	keys.Identity = n.Socket.IdentityKey()
+	return keys
+}
+
+// SaveKeys stores the keys of the node at path, encrypted if passphrase isn't empty
+func (n *Node) SaveKeys(path string, passphrase []byte) error {
+	return encryption.SaveKeys(path, n.Keys(), passphrase)
+}
+
+// CreateFromKeystore returns a node with the keys stored at path,
+// so that it can decrypt what was encrypted before it restarted, and
+// keeps its identity.
+func CreateFromKeystore(path string, passphrase []byte) (Node, error) {
+	keys, err := encryption.LoadKeys(path, passphrase)
+	if err != nil {
+		return Node{}, err
+	}
+	n := CreateWithParameters(keys.Params)
+	err = n.Client.SetKeys(keys)
+	if err != nil {
+		return Node{}, err
+	}
+	if keys.RelinearizationKey != nil {
+		n.Server.SetRelinearizationKey(keys.RelinearizationKey)
+	}
+	if keys.Identity != nil {
+		n.Socket.SetIdentity(keys.Identity)
+	}
+	return n, nil
+}
+
+// CreateWithKeystore reuses the keys stored at path if any, otherwise
+// creates a node and stores there the keys it encrypts with, those of the
+// federation by default. Keys set later, such as by GenKeyPair, are stored
+// with SaveKeys.
+func CreateWithKeystore(path string, passphrase []byte) (Node, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return CreateFromKeystore(path, passphrase)
+	}
+	if !os.IsNotExist(err) {
+		return Node{}, err
+	}
+	n := Create()
+	err = n.SaveKeys(path, passphrase)
+	return n, err
+}
@@ -0,0 +1,524 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"federated/encryption"
+	"federated/transport"
+	"fmt"
+	"strconv"
+)
+
+// With n.Aggregation set to MaskedAggregation, weights are summed under
+// pairwise masks instead of CKKS (encryption.MaskingClient). Each round:
+//   - the server asks the participants for fresh masking keys (StartMaskedRound),
+//   - once all advertised, or CloseMaskingKeys, broadcasts them,
+//   - the participants Shamir-share their secrets through it, once all
+//     shared, or CloseMaskingShares, the others are ready,
+//   - the participants upload their masked weights (SendWeights),
+//     added by the maskedAggregator,
+//   - once all uploaded, or CloseMaskedInputs, the server asks the survivors
+//     for the shares needed to unmask the sum, and sends back the average.
+// Participants dropping after sharing their secrets only need n.Threshold
+// survivors to answer, a majority if not set. Those dropping before are left
+// out of the round, as long as n.Threshold remain.
+
+// Server state of a masked round
+type maskedRound struct {
+	ID        string
+	Threshold int
+	IDs       map[string]uint64 // of each participant
+	Keys      map[uint64]encryption.MaskingKeys
+	Shares    map[uint64]map[uint64][]byte // sealed, by sender then recipient
+	Sharing   bool                         // once the keys are broadcast
+	Server    *encryption.MaskingServer    // once the secrets are shared
+	Unmasking bool
+}
+
+// Client side, what the server sends to start a masked round
+type maskingParams struct {
+	Threshold int
+	IDs       map[string]uint64
+}
+
+// StartMaskedRound asks the participants for their masking keys
+func (n *Node) StartMaskedRound() error {
+	if n.Aggregation != MaskedAggregation {
+		return errors.New("[node.StartMaskedRound]: aggregation is not masked")
+	}
+	if len(n.Participants) < 2 {
+		return errors.New("[node.StartMaskedRound]: at least 2 participants needed")
+	}
+	threshold := n.Threshold
+	if threshold == 0 {
+		threshold = len(n.Participants)/2 + 1
+	}
+	if threshold < 2 || threshold > len(n.Participants) {
+		return fmt.Errorf("[node.StartMaskedRound]: threshold must be in [2, %d]", len(n.Participants))
+	}
+
+	round := &maskedRound{
+		ID:        strconv.Itoa(n.Round),
+		Threshold: threshold,
+		IDs:       make(map[string]uint64),
+		Keys:      make(map[uint64]encryption.MaskingKeys),
+		Shares:    make(map[uint64]map[uint64][]byte),
+	}
+	for i, p := range n.Participants {
+		round.IDs[p] = uint64(i + 1)
+	}
+	n.masked = round
+
+	msg, err := json.Marshal(maskingParams{Threshold: threshold, IDs: round.IDs})
+	if err != nil {
+		return err
+	}
+	for _, p := range n.Participants {
+		pkt := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     string(msg),
+			Type:        transport.MaskingRequest,
+			ID:          round.ID,
+		}
+		err = n.Socket.Send(p, pkt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MaskedReady returns whether the participants can upload their masked weights
+func (n *Node) MaskedReady() bool {
+	return n.masking != nil && n.masking.Ready()
+}
+
+// CloseMaskingKeys stops waiting for the participants that didn't advertise
+// their masking keys, and broadcasts the keys of the others.
+func (n *Node) CloseMaskingKeys() error {
+	round := n.masked
+	if round == nil || round.Sharing {
+		return errors.New("[node.CloseMaskingKeys]: no masking keys awaited")
+	}
+	if len(round.Keys) < round.Threshold {
+		return fmt.Errorf("[node.CloseMaskingKeys]: %d keys, %d needed", len(round.Keys), round.Threshold)
+	}
+	return n.sendMaskingKeys(round)
+}
+
+// CloseMaskingShares stops waiting for the participants that didn't share
+// their secrets, and sends the shares of the others.
+func (n *Node) CloseMaskingShares() error {
+	round := n.masked
+	if round == nil || !round.Sharing || round.Server != nil {
+		return errors.New("[node.CloseMaskingShares]: no secret shares awaited")
+	}
+	if len(round.Shares) < round.Threshold {
+		return fmt.Errorf("[node.CloseMaskingShares]: %d participants shared, %d needed", len(round.Shares), round.Threshold)
+	}
+	return n.sendMaskingShares(round)
+}
+
+// CloseMaskedInputs stops waiting for the participants that didn't upload
+// their weights, and unmasks the sum of the others.
+func (n *Node) CloseMaskedInputs() error {
+	round := n.masked
+	if round == nil || round.Server == nil || round.Unmasking {
+		return errors.New("[node.CloseMaskedInputs]: no masked round in progress")
+	}
+	if _, ok := n.Aggregator.(*maskedAggregator); !ok || !n.aggregating {
+		return errors.New("[node.CloseMaskedInputs]: no masked weights received")
+	}
+	return n.aggregate()
+}
+
+// Client side: draws its masking keys for the round
+func (n *Node) onMaskingRequest(pkt transport.Packet) error {
+	params := maskingParams{}
+	err := json.Unmarshal([]byte(pkt.Message), &params)
+	if err != nil {
+		return err
+	}
+	if _, ok := params.IDs[n.Socket.GetAddress()]; !ok {
+		return errors.New("[node.onMaskingRequest]: not part of the masked round")
+	}
+	c, err := encryption.NewMaskingClient()
+	if err != nil {
+		return err
+	}
+	n.masking = c
+	n.maskingParams = params
+
+	msg, err := json.Marshal(c.Keys)
+	if err != nil {
+		return err
+	}
+	pktKeys := transport.Packet{
+		Source:      n.Socket.GetAddress(),
+		Destination: pkt.Source,
+		Message:     string(msg),
+		Type:        transport.MaskingKeys,
+		ID:          pkt.ID,
+	}
+	go n.Socket.Send(pkt.Source, pktKeys)
+	return nil
+}
+
+// Keys go from each participant to the server, then from the server to
+// every participant. Participants then share their secrets.
+func (n *Node) onMaskingKeys(pkt transport.Packet) error {
+	if pkt.Source == n.ServerAddress {
+		keys := make(map[uint64]encryption.MaskingKeys)
+		err := json.Unmarshal([]byte(pkt.Message), &keys)
+		if err != nil {
+			return err
+		}
+		if n.masking == nil {
+			return errors.New("[node.onMaskingKeys]: no masked round in progress")
+		}
+		id := n.maskingParams.IDs[n.Socket.GetAddress()]
+		sealed, err := n.masking.ShareSecrets(id, n.maskingParams.Threshold, keys)
+		if err != nil {
+			return err
+		}
+		msg, err := json.Marshal(sealed)
+		if err != nil {
+			return err
+		}
+		pktShares := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: pkt.Source,
+			Message:     string(msg),
+			Type:        transport.MaskingShares,
+			ID:          pkt.ID,
+		}
+		go n.Socket.Send(pkt.Source, pktShares)
+		return nil
+	}
+
+	// Server side
+	round, id, err := n.maskedParticipant(pkt, "onMaskingKeys")
+	if err != nil {
+		return err
+	}
+	if round.Sharing {
+		return errors.New("[node.onMaskingKeys]: keys already broadcast")
+	}
+	keys := encryption.MaskingKeys{}
+	err = json.Unmarshal([]byte(pkt.Message), &keys)
+	if err != nil {
+		return err
+	}
+	round.Keys[id] = keys
+	if len(round.Keys) < len(round.IDs) {
+		return nil
+	}
+	return n.sendMaskingKeys(round)
+}
+
+// Server side: broadcasts the keys received, the participants that didn't
+// advertise theirs are left out of the round
+func (n *Node) sendMaskingKeys(round *maskedRound) error {
+	for p, id := range round.IDs {
+		if _, ok := round.Keys[id]; !ok {
+			delete(round.IDs, p)
+		}
+	}
+	round.Sharing = true
+
+	msg, err := json.Marshal(round.Keys)
+	if err != nil {
+		return err
+	}
+	for p := range round.IDs {
+		pktKeys := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     string(msg),
+			Type:        transport.MaskingKeys,
+			ID:          round.ID,
+		}
+		go n.Socket.Send(p, pktKeys)
+	}
+	return nil
+}
+
+// Sealed shares go from each participant to the server (by recipient),
+// then from the server to each recipient (by sender).
+func (n *Node) onMaskingShares(pkt transport.Packet) error {
+	sealed := make(map[uint64][]byte)
+	err := json.Unmarshal([]byte(pkt.Message), &sealed)
+	if err != nil {
+		return err
+	}
+	if pkt.Source == n.ServerAddress {
+		if n.masking == nil {
+			return errors.New("[node.onMaskingShares]: no masked round in progress")
+		}
+		return n.masking.ReceiveShares(sealed)
+	}
+
+	// Server side
+	round, id, err := n.maskedParticipant(pkt, "onMaskingShares")
+	if err != nil {
+		return err
+	}
+	if !round.Sharing {
+		return errors.New("[node.onMaskingShares]: keys not broadcast yet")
+	}
+	if round.Server != nil {
+		return errors.New("[node.onMaskingShares]: secrets already shared")
+	}
+	if len(sealed) != len(round.IDs) {
+		return fmt.Errorf("[node.onMaskingShares]: %d didn't send a share per participant", id)
+	}
+	round.Shares[id] = sealed
+	if len(round.Shares) < len(round.IDs) {
+		return nil
+	}
+	return n.sendMaskingShares(round)
+}
+
+// Server side: sends each participant the shares sealed for it, the
+// participants that didn't share their secrets are left out of the round
+func (n *Node) sendMaskingShares(round *maskedRound) error {
+	for p, id := range round.IDs {
+		if _, ok := round.Shares[id]; !ok {
+			delete(round.IDs, p)
+		}
+	}
+	participants := make([]uint64, 0, len(round.Shares))
+	for sender := range round.Shares {
+		participants = append(participants, sender)
+	}
+	round.Server = encryption.NewMaskingServer(round.Threshold, round.Keys, participants)
+	for p, recipient := range round.IDs {
+		received := make(map[uint64][]byte)
+		for sender, shares := range round.Shares {
+			received[sender] = shares[recipient]
+		}
+		msg, err := json.Marshal(received)
+		if err != nil {
+			return err
+		}
+		pktShares := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     string(msg),
+			Type:        transport.MaskingShares,
+			ID:          round.ID,
+		}
+		go n.Socket.Send(p, pktShares)
+	}
+	round.Shares = nil
+	return nil
+}
+
+// Client side: uploads its masked weights
+func (n *Node) sendMaskedWeights(server string, weights []float64) error {
+	if n.masking == nil {
+		return errors.New("[node.sendMaskedWeights]: no masked round in progress")
+	}
+	masked, err := n.masking.MaskVector(weights)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(masked)
+	if err != nil {
+		return err
+	}
+	pkt := transport.Packet{
+		Source:      n.Socket.GetAddress(),
+		Destination: server,
+		Message:     string(msg),
+		Type:        transport.MaskedInput,
+	}
+	err = n.tag(&pkt)
+	if err != nil {
+		return err
+	}
+	return n.Socket.Send(server, pkt)
+}
+
+// Masked weights, the server only learns the sum of the survivors'
+type maskedAggregator struct {
+	n *Node
+}
+
+func (a *maskedAggregator) Begin(round int, participants []string) error {
+	if a.n.AggregationRule != nil {
+		return errors.New("[node.maskedAggregator.Begin]: aggregation rules need the updates in clear")
+	}
+	if a.n.masked == nil || a.n.masked.Server == nil {
+		return errors.New("[node.maskedAggregator.Begin]: secrets not shared, see StartMaskedRound")
+	}
+	return nil
+}
+
+// Ready once every participant uploaded its weights
+func (a *maskedAggregator) Add(pkt transport.Packet) (bool, error) {
+	if pkt.Type != transport.MaskedInput {
+		return false, errors.New("[node.maskedAggregator.Add]: unexpected " + pkt.Type + " contribution")
+	}
+	round, id, err := a.n.maskedParticipant(pkt, "maskedAggregator.Add")
+	if err != nil {
+		return false, err
+	}
+	if round.Server == nil || round.Unmasking {
+		return false, errors.New("[node.maskedAggregator.Add]: not waiting for masked weights")
+	}
+	masked := make([]uint64, 0)
+	err = json.Unmarshal([]byte(pkt.Message), &masked)
+	if err != nil {
+		return false, err
+	}
+	err = round.Server.AddMasked(id, masked)
+	if err != nil {
+		return false, err
+	}
+	return len(round.Server.Masked) >= len(round.Server.Participants), nil
+}
+
+// The result is sent once enough survivors revealed their shares
+func (a *maskedAggregator) Finalize() (*RoundResult, error) {
+	return nil, a.n.requestUnmasking()
+}
+
+// Server side: asks the survivors for their unmasking shares
+func (n *Node) requestUnmasking() error {
+	round := n.masked
+	if round.Unmasking {
+		return errors.New("[node.requestUnmasking]: already unmasking")
+	}
+	survivors := round.Server.Survivors()
+	if len(survivors) < round.Threshold {
+		return fmt.Errorf("[node.requestUnmasking]: %d survivors, %d needed", len(survivors), round.Threshold)
+	}
+	round.Unmasking = true
+
+	msg, err := json.Marshal(survivors)
+	if err != nil {
+		return err
+	}
+	for p, id := range round.IDs {
+		if _, ok := round.Server.Masked[id]; !ok {
+			continue
+		}
+		pkt := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     string(msg),
+			Type:        transport.UnmaskRequest,
+			ID:          round.ID,
+		}
+		go n.Socket.Send(p, pkt)
+	}
+	return nil
+}
+
+// Client side: reveals the shares needed to unmask the survivors' sum
+func (n *Node) onUnmaskRequest(pkt transport.Packet) error {
+	if n.masking == nil {
+		return errors.New("[node.onUnmaskRequest]: no masked round in progress")
+	}
+	survivors := make([]uint64, 0)
+	err := json.Unmarshal([]byte(pkt.Message), &survivors)
+	if err != nil {
+		return err
+	}
+	shares, err := n.masking.UnmaskingShares(survivors)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(shares)
+	if err != nil {
+		return err
+	}
+	pktShares := transport.Packet{
+		Source:      n.Socket.GetAddress(),
+		Destination: pkt.Source,
+		Message:     string(msg),
+		Type:        transport.UnmaskShares,
+		ID:          pkt.ID,
+	}
+	go n.Socket.Send(pkt.Source, pktShares)
+	return nil
+}
+
+// Server side: sends the average to the survivors once enough answered
+func (n *Node) onUnmaskShares(pkt transport.Packet) error {
+	round, id, err := n.maskedParticipant(pkt, "onUnmaskShares")
+	if err != nil {
+		return err
+	}
+	if !round.Unmasking {
+		return errors.New("[node.onUnmaskShares]: not unmasking")
+	}
+	shares := make(map[uint64][]byte)
+	err = json.Unmarshal([]byte(pkt.Message), &shares)
+	if err != nil {
+		return err
+	}
+	done, err := round.Server.AddUnmaskingShares(id, shares)
+	if err != nil || !done {
+		return err
+	}
+	sum, err := round.Server.Sum()
+	if err != nil {
+		return err
+	}
+
+	survivors := round.Server.Survivors()
+	for i := range sum {
+		sum[i] /= float64(len(survivors))
+	}
+	for i, noise := range n.serverNoise(len(sum), len(survivors)) {
+		sum[i] += noise
+	}
+	msg, err := json.Marshal(sum)
+	if err != nil {
+		return err
+	}
+	for p, id := range round.IDs {
+		if !encryption.ContainsID(survivors, id) {
+			continue
+		}
+		pktResult := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     string(msg),
+			Type:        transport.MaskedResult,
+			ID:          round.ID,
+		}
+		go n.Socket.Send(p, pktResult)
+	}
+	fmt.Println("Masked sum of", len(survivors), "participants unmasked")
+	n.masked = nil
+	return nil
+}
+
+// Client side: the average is the new model
+func (n *Node) onMaskedResult(pkt transport.Packet) error {
+	weights := make([]float64, 0)
+	err := json.Unmarshal([]byte(pkt.Message), &weights)
+	if err != nil {
+		return err
+	}
+	n.masking = nil
+	n.applyResult(weights, pkt.ID)
+	return nil
+}
+
+// Server side, the round and the ID of the sender of pkt
+func (n *Node) maskedParticipant(pkt transport.Packet, handler string) (*maskedRound, uint64, error) {
+	round := n.masked
+	if round == nil || (pkt.ID != "" && pkt.ID != round.ID) {
+		return nil, 0, errors.New("[node." + handler + "]: no masked round " + pkt.ID + " in progress")
+	}
+	id, ok := round.IDs[pkt.Source]
+	if !ok {
+		return nil, 0, errors.New("[node." + handler + "]: " + pkt.Source + " is not part of the masked round")
+	}
+	return round, id, nil
+}
@@ -1,10 +1,13 @@
 package node
 
 import (
+	"crypto/ed25519"
 	"federated/encryption"
 	"federated/neural"
+	"federated/privacy"
 	"federated/transport"
 	"fmt"
+	"strconv"
 
 	"github.com/ldsec/lattigo/v2/ckks"
 )
@@ -20,16 +23,99 @@ type Node struct {
 
 	// neural
 	neural.NeuralNetwork
+	Validation  neural.Dataset   // held-out data, evaluated after each round
+	Evaluations []neural.Metrics // one per round
+
+	// Federated evaluation, server side
+	evaluation           evaluationRound
+	FederatedEvaluations []neural.Metrics
+
+	// Server rounds
+	Round   int                // aggregations done so far
+	Pending []transport.Packet // weights or deltas received for the current round
+
+	// Model deltas. Server side, the global model is the last aggregate, the
+	// initial model being drawn from Seed so that participants start from it.
+	// Client side, the Seed advertised: without one, deltas of the first
+	// round would be relative to different models.
+	Seed            int64
+	ServerOptimizer neural.ServerOptimizer // FedAvg with rate 1 if nil
+	GlobalWeights   []float64              // client side, model of the current round
+
+	// Differential privacy, disabled if nil: client side of the uploads, or
+	// of the aggregate, on both sides, as an alternative
+	Privacy        *privacy.LocalDP
+	CentralPrivacy *privacy.CentralDP
+
+	// Checkpoints, disabled if no directory
+	CheckpointDir   string
+	CheckpointEvery int // rounds between two checkpoints
+
+	// Client side, address of the server joined
+	ServerAddress string
+
+	// Identities of the peers, bound to their address on first contact,
+	// see checkIdentity
+	Identities map[string]ed25519.PublicKey
+
+	// Collective decryption, needs a collective key. Threshold participants
+	// are enough to decrypt once set up, 0 meaning every participant.
+	Threshold       int
+	threshold       *thresholdSetup
+	thresholdParams thresholdParams
+	decryption      *decryptionRound
+	releases        map[string]string // client side, see expectRelease
+
+	// How updates are protected, CKKS by default. Set on the server,
+	// advertised to the participants. The Aggregator is chosen from it if nil.
+	Aggregation   string
+	Aggregator    Aggregator
+	aggregating   bool
+	closing       bool // the round is open until the norms are released
+	masked        *maskedRound
+	masking       *encryption.MaskingClient
+	maskingParams maskingParams
+
+	// Plaintext aggregation, the mean if nil. Robust rules tolerate
+	// Byzantine participants, see neural.AggregationRule.
+	AggregationRule neural.AggregationRule
+
+	// CKKS aggregation, contributions of larger L2 norm are dropped before
+	// the sum, 0 disabling the check. Their norms are computed encrypted,
+	// see boundNorms.
+	NormBound float64
+
+	// Server side, accepts every join if nil
+	Admission *Admission
+
+	// Server side, rejects replayed contributions, not checked if nil.
+	// Client side, round of the server the next uploads are for.
+	Replay      *ReplayCache
+	ServerRound int
+
+	// Server side, holds the secret key of the public key it distributed
+	KeyHolder bool
+
+	// Logs the precision of each round, see debugPrecision
+	Debug      bool
+	Precisions []encryption.PrecisionStats
 
 	// Node
 	StopChan chan bool
 }
 
 func Create() Node {
+	return CreateWithParameters(encryption.DefaultParameters())
+}
+
+// CreateWithParameters returns a node encrypting with params, which a server
+// advertises to the participants joining it.
+func CreateWithParameters(params ckks.Parameters) Node {
 	n := Node{
-		Packets: make([]transport.Packet, 0),
-		Client:  encryption.NewClient(),
-		Server:  encryption.NewServer(),
+		Packets:    make([]transport.Packet, 0),
+		Client:     encryption.NewClientWithParameters(params),
+		Server:     encryption.NewServerWithParameters(params),
+		Identities: make(map[string]ed25519.PublicKey),
 	}
 	s, err := transport.CreateSocket()
 	if err != nil {
@@ -77,9 +163,16 @@ func (n *Node) Start() error {
 }
 
 func (n *Node) Join(server string) error {
+	return n.JoinWithInvitation(server, "")
+}
+
+// JoinWithInvitation joins a server admitting participants by invitation,
+// see Admission.Invite
+func (n *Node) JoinWithInvitation(server string, token string) error {
 	pktJoin := transport.Packet{
 		Source:      n.Socket.GetAddress(),
 		Destination: server,
+		Message:     token,
 		Type:        transport.Join,
 	}
 	err := n.Socket.Send(server, pktJoin)
@@ -87,17 +180,37 @@ func (n *Node) Join(server string) error {
 		return err
 	}
 
+	n.ServerAddress = server
 	return nil
 }
 
-// Weights are sent with a separator between them, in a string
+// Weights are sent encrypted, over as many ciphertexts as needed,
+// or as the aggregation mode requires
 func (n *Node) SendWeights(server string, asResult bool) error {
-	weights := n.GetWeights()
-	plaintext := ckks.NewPlaintext(n.Params, n.Params.MaxLevel(), n.Params.DefaultScale())
-	n.Encoder.EncodeCoeffs(weights, plaintext)
-
-	ciphertext := n.Encryptor.EncryptNew(plaintext)
-	cipher := encryption.MarshalToBase64String(ciphertext)
+	weights := n.NeuralNetwork.Weights
+	if !asResult {
+		var err error
+		weights, err = n.privateWeights()
+		if err != nil {
+			return err
+		}
+		switch n.Aggregation {
+		case PlaintextAggregation:
+			return n.sendPlain(server, weights, transport.PlainWeights)
+		case MaskedAggregation:
+			return n.sendMaskedWeights(server, weights)
+		}
+	}
+	v := n.EncryptVector(weights)
+	cipher := encryption.MarshalToBase64String(v)
+	if n.Debug && n.Client.CanDecrypt() {
+		// Precision of a fresh encryption
+		values, err := n.Client.DecryptVector(v)
+		if err != nil {
+			return err
+		}
+		n.debugPrecision("weights sent", v, values, weights)
+	}
 
 	var t string
 	if asResult {
@@ -111,10 +224,15 @@ func (n *Node) SendWeights(server string, asResult bool) error {
 		Message:     cipher,
 		Type:        t,
 	}
+	if !asResult {
+		err := n.tag(&pkt)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Send to server
-	err := n.Socket.Send(server, pkt)
-	return err
+	return n.Socket.Send(server, pkt)
 }
 
 func (n *Node) StartLearning() {
@@ -125,22 +243,49 @@ func (n *Node) StartLearning() {
 
 // Handler of packet
 func (n *Node) OnReceive(pkt transport.Packet) error {
+	err := n.checkIdentity(pkt)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
 
 	switch pkt.Type {
 	case "":
 		// For testing purpose
 		n.Packets = append(n.Packets, pkt)
 	case transport.Join:
-		// if first join
-		if w := n.GetWeights(); len(w) == 0 {
+		rejoin, err := n.admit(pkt)
+		if err != nil {
+			fmt.Println("Join of", pkt.Source, "rejected:", err)
+			return err
+		}
+		if pkt.Signed() {
+			n.Identities[pkt.Source] = pkt.Signer
+		}
+
+		// if first join, keeping the initializer chosen for the federation
+		if len(n.NeuralNetwork.Weights) == 0 {
+			initialization := n.Initialization
 			n.NeuralNetwork = neural.CreateNetwork(4, 1, 1, 5, 0.01)
-			n.InitiateWeights()
+			n.Initialization = initialization
+			if n.Seed != 0 {
+				n.InitiateWeightsFromSeed(n.Seed)
+			} else {
+				n.InitiateWeights()
+			}
 		}
 
-		// New participant joined
-		n.Server.Participants = append(n.Server.Participants, pkt.Source)
+		// New participant joined, or one restarted that gets the parameters again
+		if !rejoin {
+			n.Server.Participants = append(n.Server.Participants, pkt.Source)
+		}
 		n.Packets = append(n.Packets, pkt)
 
+		ckksParams, err := encryption.MarshalParameters(n.Server.Params)
+		if err != nil {
+			fmt.Println(err)
+		}
+
 		// To send hyperparams
 		params := transport.Parameters{
 			InputDimensions:    4,
@@ -151,6 +296,13 @@ func (n *Node) OnReceive(pkt transport.Packet) error {
 			NbIterations:       5,
 			ActivationFunction: neural.SigmoidFunc,
 			BatchSize:          64,
+			Initialization:     n.Initialization,
+			Encoding:           n.Client.Encoding,
+			LogSlots:           n.Client.LogSlots,
+			CKKS:               ckksParams,
+			Seed:               n.Seed,
+			Aggregation:        n.Aggregation,
+			Round:              n.Round,
 		}
 		pktParams := transport.Packet{
 			Source:      n.Socket.GetAddress(),
@@ -159,6 +311,24 @@ func (n *Node) OnReceive(pkt transport.Packet) error {
 			Type:        transport.Params,
 		}
 		n.Socket.Send(pkt.Source, pktParams)
+
+		if n.CheckpointDir != "" {
+			err = n.SaveCheckpoint()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	case transport.JoinRejected:
+		n.Packets = append(n.Packets, pkt)
+		fmt.Println("Join rejected by", pkt.Source+":", pkt.Message)
+	case transport.Resume:
+		// Server restarted, maybe on a new address
+		n.Packets = append(n.Packets, pkt)
+		n.ServerAddress = pkt.Source
+		round, err := strconv.Atoi(pkt.Message)
+		if err == nil {
+			n.ServerRound = round
+		}
 	case transport.Params:
 		n.Packets = append(n.Packets, pkt)
 		n.NeuralNetwork = neural.CreateNetwork(
@@ -168,57 +338,251 @@ func (n *Node) OnReceive(pkt transport.Packet) error {
 			pkt.Params.NbNeurons,
 			pkt.Params.LearningRate,
 		)
-		n.InitiateWeights()
-	case transport.EncryptedChunk:
+		n.Initialization = pkt.Params.Initialization
+		n.Aggregation = pkt.Params.Aggregation
+		n.ServerRound = pkt.Params.Round
+		n.Seed = pkt.Params.Seed
+		err := n.setParameters(pkt.Params.CKKS)
+		if err != nil {
+			fmt.Println(err)
+		}
+		err = n.Client.SetEncoding(pkt.Params.Encoding, pkt.Params.LogSlots)
+		if err != nil {
+			fmt.Println(err)
+		}
+		if pkt.Params.Seed != 0 {
+			n.InitiateWeightsFromSeed(pkt.Params.Seed)
+		} else {
+			n.InitiateWeights()
+		}
+		n.GlobalWeights = n.GetWeights()
+	case transport.EncryptedChunk, transport.EncryptedDelta, transport.PlainWeights, transport.PlainDelta, transport.MaskedInput:
+		// Contributions to the current round, replays and late ones dropped
+		if n.Replay != nil {
+			err := n.Replay.Check(pkt.Source, pkt.Round, pkt.Nonce, n.Round)
+			if err == nil && pkt.Round != n.Round {
+				err = fmt.Errorf("[node.OnReceive]: late contribution of %s to round %d dropped, round %d", pkt.Source, pkt.Round, n.Round)
+			}
+			if err != nil {
+				fmt.Println(err)
+				return err
+			}
+		}
 		n.Packets = append(n.Packets, pkt)
+		err := n.contribute(pkt)
+		if err != nil {
+			fmt.Println(err)
+			// Not part of the round, the participant can send another
+			if n.Replay != nil {
+				n.Replay.Forget(pkt.Source, n.Round)
+			}
+		}
 	case transport.Result:
 		n.Packets = append(n.Packets, pkt)
-		cipher := ckks.NewCiphertext(n.Params, 1, 1, 0.01)
-		encryption.UnmarshalFromBase64(cipher, pkt.Message)
-		coeffs := n.DecodeCoeffs(n.DecryptNew(cipher))
-		n.SetWeights(coeffs)
-	}
-
-	// TODO generalize to n participants
-	// If 2 packets -> Calculations + Send back
-	if len(n.GetPacketsByType(transport.EncryptedChunk)) >= len(n.Server.Participants) && len(n.Server.Participants) > 0 {
-		fmt.Println("Server calculations on", len(n.Server.Participants), "polynomes")
-		encryptedPkts := n.GetPacketsByType(transport.EncryptedChunk)
-		cipherText1 := new(ckks.Ciphertext)
-		cipherText2 := new(ckks.Ciphertext)
-		encryption.UnmarshalFromBase64(cipherText1, encryptedPkts[0].Message)
-		encryption.UnmarshalFromBase64(cipherText2, encryptedPkts[1].Message)
-		n.Server.Responses = append(n.Server.Responses, cipherText1)
-		n.Server.Responses = append(n.Server.Responses, cipherText2)
-
-		// Server calculations -> averages the weights
-		fmt.Println(n.Server.Responses[0])
-		adds := n.Server.AddNew(n.Server.Responses[0], n.Server.Responses[1])
-		fmt.Println(adds)
-		n.Server.Result = n.Server.MultByConstNew(adds, 0.5)
-
-		// Results
-		resultsCipher := encryption.MarshalToBase64String(n.Server.Result)
-
-		// Send // Multicast
-		for _, p := range encryptedPkts {
-			pktResult := transport.Packet{
-				Source:      n.Socket.GetAddress(),
-				Destination: p.Source,
-				Message:     resultsCipher,
-				Type:        transport.Result,
-			}
-
-			go n.Socket.Send(p.Source, pktResult)
+		v := new(encryption.EncryptedVector)
+		err := encryption.UnmarshalFromBase64(v, pkt.Message)
+		if err != nil {
+			fmt.Println(err)
+			break
+		}
+		weights, err := n.DecryptVector(v)
+		if err != nil {
+			fmt.Println(err)
+			break
+		}
+		n.debugPrecision("aggregate", v, weights, nil)
+		n.applyResult(weights, pkt.ID)
+	case transport.PlainResult:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onPlainResult(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.Evaluate:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onEvaluate(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.EncryptedMetrics:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onEncryptedMetrics(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.KeyGenRequest:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onKeyGenRequest(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.KeyGenShare:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onKeyGenShare(pkt)
+		if err != nil {
+			fmt.Println(err)
 		}
+	case transport.CollectivePublicKey:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onCollectivePublicKey(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.NormKeyRequest, transport.RelinKeyRequest:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onNormKeyRequest(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.NormKeyShares, transport.RelinKeyShare:
+		// Tens of MB, not kept in n.Packets
+		err := n.onNormKeyShares(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.RoundFailed:
+		n.Packets = append(n.Packets, pkt)
+		n.onRoundFailed(pkt)
+	case transport.PublicKey:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onPublicKey(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.ThresholdSetup:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onThresholdSetup(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.SharingKey:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onSharingKey(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.SharingKeys:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onSharingKeys(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.SealedShares:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onSealedShares(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.DecryptionRequest:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onDecryptionRequest(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.DecryptionShare:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onDecryptionShare(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.DecryptedResult:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onDecryptedResult(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.MaskingRequest:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onMaskingRequest(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.MaskingKeys:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onMaskingKeys(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.MaskingShares:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onMaskingShares(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.UnmaskRequest:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onUnmaskRequest(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.UnmaskShares:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onUnmaskShares(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	case transport.MaskedResult:
+		n.Packets = append(n.Packets, pkt)
+		err := n.onMaskedResult(pkt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	return nil
+}
 
-		// Empty used packets
-		encryptedPkts = encryptedPkts[0:]
+func (n *Node) endRound() {
+	// Empty used packets
+	n.Pending = nil
+	n.Round++
+	if n.CheckpointDir != "" && n.CheckpointEvery > 0 && n.Round%n.CheckpointEvery == 0 {
+		err := n.SaveCheckpoint()
+		if err != nil {
+			fmt.Println(err)
+		}
 	}
+}
 
+// Client side, encrypts with the parameters advertised by the server
+func (n *Node) setParameters(advertised string) error {
+	if advertised == "" {
+		return nil
+	}
+	params, err := encryption.UnmarshalParameters(advertised)
+	if err != nil {
+		return err
+	}
+	if !params.Equals(n.Client.Params) {
+		n.Client = encryption.NewClientWithParameters(params)
+	}
 	return nil
 }
 
+// Client side, the aggregated weights of round become the local model
+func (n *Node) applyResult(weights []float64, round string) {
+	delete(n.releases, round)
+	delete(n.releases, "norms-"+round)
+	n.nextRound(round)
+	n.SetWeights(weights)
+	n.GlobalWeights = n.GetWeights()
+	n.Rounds++
+	n.evaluateRound()
+}
+
+// Evaluates the current model on the validation set, if any
+func (n *Node) evaluateRound() {
+	if len(n.Validation.Inputs) == 0 {
+		return
+	}
+	metrics, err := n.Evaluate(n.Validation)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	n.Evaluations = append(n.Evaluations, metrics)
+}
+
 func (n *Node) GetPacketsByType(t string) []transport.Packet {
 	pkts := make([]transport.Packet, 0)
 	for _, p := range n.Packets {
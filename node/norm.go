@@ -0,0 +1,183 @@
+package node
+
+import (
+	"encoding/base64"
+	"errors"
+	"federated/encryption"
+	"federated/transport"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/ldsec/lattigo/v2/drlwe"
+)
+
+// Norm bounding, server side: the squared L2 norm of each encrypted
+// contribution is computed under encryption, and only these norms are
+// decrypted, by the server if it holds the secret key or jointly under a
+// collective key. Contributions above n.NormBound are dropped before the sum.
+
+// StartNormKeyGeneration has the participants generate jointly the norm
+// keys of their collective secret: the rotation keys in one round, the
+// relinearization key in two. Must follow the collective key generation.
+func (n *Node) StartNormKeyGeneration() error {
+	if !n.collectiveKey() {
+		return errors.New("[node.StartNormKeyGeneration]: no collective key")
+	}
+	nkg, err := n.Server.StartNormKeyGeneration(n.Server.KeyGeneration.Expected)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range nkg.Expected {
+		pkt := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     base64.StdEncoding.EncodeToString(nkg.Seed),
+			Type:        transport.NormKeyRequest,
+		}
+		err = n.Socket.Send(p, pkt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Client side: sends its shares of the norm keys, of the first or second round
+func (n *Node) onNormKeyRequest(pkt transport.Packet) error {
+	var msg string
+	var typ string
+	if pkt.Type == transport.NormKeyRequest {
+		seed, err := base64.StdEncoding.DecodeString(pkt.Message)
+		if err != nil {
+			return err
+		}
+		shares, err := n.Client.GenNormKeyShares(seed)
+		if err != nil {
+			return err
+		}
+		msg, err = encryption.MarshalNormKeyShares(shares)
+		if err != nil {
+			return err
+		}
+		typ = transport.NormKeyShares
+	} else {
+		roundOne := new(drlwe.RKGShare)
+		err := encryption.UnmarshalFromBase64(roundOne, pkt.Message)
+		if err != nil {
+			return err
+		}
+		share, err := n.Client.GenRelinShare(roundOne)
+		if err != nil {
+			return err
+		}
+		msg = encryption.MarshalToBase64String(share)
+		typ = transport.RelinKeyShare
+	}
+
+	pktShares := transport.Packet{
+		Source:      n.Socket.GetAddress(),
+		Destination: pkt.Source,
+		Message:     msg,
+		Type:        typ,
+	}
+	// Not blocking the receiving loop, which gets the acks
+	go n.Socket.Send(pkt.Source, pktShares)
+	return nil
+}
+
+// Server side: aggregates the shares, asks for the second round of the
+// relinearization key once the first is complete.
+func (n *Node) onNormKeyShares(pkt transport.Packet) error {
+	if pkt.Type == transport.RelinKeyShare {
+		share, err := encryption.UnmarshalRelinShare(n.Server.Params, pkt.Message)
+		if err != nil {
+			return err
+		}
+		done, err := n.Server.AddRelinShare(pkt.Source, share)
+		if err == nil && done {
+			fmt.Println("Norm keys generated by", len(n.Server.NormKeyGeneration.Expected), "participants")
+		}
+		return err
+	}
+
+	shares, err := encryption.UnmarshalNormKeyShares(n.Server.Params, pkt.Message)
+	if err != nil {
+		return err
+	}
+	done, err := n.Server.AddNormKeyShares(pkt.Source, shares)
+	if err != nil || !done {
+		return err
+	}
+	nkg := n.Server.NormKeyGeneration
+	msg := encryption.MarshalToBase64String(nkg.RelinRoundOne)
+	for _, p := range nkg.Expected {
+		pktRequest := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     msg,
+			Type:        transport.RelinKeyRequest,
+		}
+		go n.Socket.Send(p, pktRequest)
+	}
+	return nil
+}
+
+// Drops the updates of norm above n.NormBound, done with those kept.
+// Under a collective key, done runs once the norms are released, and the
+// server needs the norm keys of the collective secret, see
+// StartNormKeyGeneration.
+func (n *Node) boundNorms(updates []*encryption.EncryptedVector, sources []string, contributors []string, done func([]*encryption.EncryptedVector) error) error {
+	collective := n.collectiveKey()
+	if n.Server.RotationKeys == nil {
+		if collective || !n.KeyHolder {
+			return errors.New("[node.boundNorms]: no norm keys, see StartNormKeyGeneration")
+		}
+		rlk, rtks, err := n.Client.GenNormKeys()
+		if err != nil {
+			return err
+		}
+		n.Server.SetNormKeys(rlk, rtks)
+	}
+	norms, err := n.Server.SquaredNormsNew(updates)
+	if err != nil {
+		return err
+	}
+
+	filter := func(squared []float64) error {
+		kept := make([]*encryption.EncryptedVector, 0, len(updates))
+		for i, s := range squared {
+			if s > n.NormBound*n.NormBound {
+				fmt.Println("Contribution of", sources[i], "dropped, norm", math.Sqrt(s), "above", n.NormBound)
+				continue
+			}
+			kept = append(kept, updates[i])
+		}
+		if len(kept) == 0 {
+			return errors.New("[node.boundNorms]: every contribution exceeds the norm bound")
+		}
+		return done(kept)
+	}
+
+	if collective {
+		id := "norms-" + strconv.Itoa(n.Round)
+		return n.startDecryption(id, norms, contributors, func(released *encryption.EncryptedVector) error {
+			squared, err := encryption.DecodeReleasedVector(n.Server.Params, released)
+			if err == nil {
+				err = filter(squared)
+			}
+			// No-op if done closed the round
+			return n.closeRound(nil, err)
+		})
+	}
+	// Only the key holder decrypts, participants' keys differ otherwise
+	if !n.KeyHolder {
+		return errors.New("[node.boundNorms]: the server can't decrypt the norms, see DistributePublicKey")
+	}
+	squared, err := n.Client.DecryptVector(norms)
+	if err != nil {
+		return err
+	}
+	return filter(squared)
+}
@@ -0,0 +1,21 @@
+package node
+
+import (
+	"federated/encryption"
+	"fmt"
+)
+
+// In debug mode, logs the precision of the vectors decrypted by the node,
+// against reference if known, and keeps the statistics in n.Precisions.
+func (n *Node) debugPrecision(what string, v *encryption.EncryptedVector, values []float64, reference []float64) {
+	if !n.Debug {
+		return
+	}
+	stats, err := encryption.NewPrecisionStats(n.Client.Params, v, values, reference)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	n.Precisions = append(n.Precisions, stats)
+	fmt.Println(n.Socket.GetAddress(), "round", n.Rounds, what+":", stats)
+}
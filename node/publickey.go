@@ -0,0 +1,70 @@
+package node
+
+import (
+	"errors"
+	"federated/encryption"
+	"federated/transport"
+	"fmt"
+	"strconv"
+
+	"github.com/ldsec/lattigo/v2/drlwe"
+)
+
+// DistributePublicKey makes the server the only holder of a secret key: the
+// participants encrypt under its public key and drop their secret key, and
+// the server releases each aggregate.
+func (n *Node) DistributePublicKey() error {
+	if len(n.Participants) == 0 {
+		return errors.New("[node.DistributePublicKey]: no participant")
+	}
+	pk, err := encryption.MarshalPublicKey(n.Client.GenKeyPair())
+	if err != nil {
+		return err
+	}
+	n.KeyHolder = true
+
+	for _, p := range n.Participants {
+		pkt := transport.Packet{
+			Source:      n.Socket.GetAddress(),
+			Destination: p,
+			Message:     pk,
+			Type:        transport.PublicKey,
+		}
+		err = n.Socket.Send(p, pkt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Client side: encrypts under the distributed key, without secret key
+func (n *Node) onPublicKey(pkt transport.Packet) error {
+	pk, err := encryption.UnmarshalPublicKey(n.Client.Params, pkt.Message)
+	if err != nil {
+		return err
+	}
+	n.Client.SetPublicKey(pk)
+	n.Client.DropSecretKey()
+	return nil
+}
+
+// Server side, holding the secret key: releases the aggregate by itself
+func (n *Node) releaseAggregate(v *encryption.EncryptedVector, recipients []string) error {
+	released, err := n.releaseVector(v)
+	if err != nil {
+		return err
+	}
+	n.sendReleased(released, recipients, strconv.Itoa(n.Round))
+	fmt.Println("Aggregate released to", len(recipients), "participants")
+	return nil
+}
+
+// Server side, holding the secret key: v decodable by anyone
+func (n *Node) releaseVector(v *encryption.EncryptedVector) (*encryption.EncryptedVector, error) {
+	shares, err := n.Client.GenDecryptionShares(v, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return n.Server.ReleaseVector(v, [][]*drlwe.CKSShare{shares})
+}
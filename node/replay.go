@@ -0,0 +1,98 @@
+package node
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"federated/transport"
+	"fmt"
+	"strconv"
+)
+
+// Replay protection: each upload carries the round of the server it is for
+// and a fresh nonce, bound to it by the signature of the packet. The server
+// remembers the nonces of each participant over the rounds it accepts, and
+// rejects duplicate, second and out of window contributions before they are
+// aggregated. Late contributions, within the window, are dropped.
+
+// Size of the nonces of the uploads, in bytes
+const NonceSize = 16
+
+// ReplayCache remembers the nonces of the recent contributions, per participant
+type ReplayCache struct {
+	Window int // previous rounds told apart from replays, 0 for the current one only
+
+	seen        map[string]map[string]int // round of each nonce, per participant
+	contributed map[string]map[int]bool   // rounds contributed to, per participant
+}
+
+// NewReplayCache recognizes contributions up to window rounds late
+func NewReplayCache(window int) *ReplayCache {
+	return &ReplayCache{Window: window, seen: make(map[string]map[string]int), contributed: make(map[string]map[int]bool)}
+}
+
+// Check records the nonce of the contribution of participant to round,
+// received during round current, or returns why it is rejected
+func (c *ReplayCache) Check(participant string, round int, nonce []byte, current int) error {
+	if len(nonce) != NonceSize {
+		return fmt.Errorf("[node.ReplayCache.Check]: contribution of %s without nonce", participant)
+	}
+	if round > current || round < current-c.Window {
+		return fmt.Errorf("[node.ReplayCache.Check]: contribution of %s to round %d out of window, round %d", participant, round, current)
+	}
+	if c.seen == nil {
+		c.seen = make(map[string]map[string]int)
+		c.contributed = make(map[string]map[int]bool)
+	}
+	nonces, ok := c.seen[participant]
+	if !ok {
+		nonces = make(map[string]int)
+		c.seen[participant] = nonces
+		c.contributed[participant] = make(map[int]bool)
+	}
+	rounds := c.contributed[participant]
+	// Rounds out of the window are rejected anyway
+	for n, r := range nonces {
+		if r < current-c.Window {
+			delete(nonces, n)
+		}
+	}
+	for r := range rounds {
+		if r < current-c.Window {
+			delete(rounds, r)
+		}
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	if _, ok := nonces[key]; ok {
+		return fmt.Errorf("[node.ReplayCache.Check]: contribution of %s to round %d replayed", participant, round)
+	}
+	if rounds[round] {
+		return fmt.Errorf("[node.ReplayCache.Check]: %s already contributed to round %d", participant, round)
+	}
+	nonces[key] = round
+	rounds[round] = true
+	return nil
+}
+
+// Forget lets participant contribute again to round, whose contribution
+// wasn't aggregated. Its nonce still can't be replayed.
+func (c *ReplayCache) Forget(participant string, round int) {
+	delete(c.contributed[participant], round)
+}
+
+// Client side: binds the upload to the round of the server and a fresh nonce
+func (n *Node) tag(pkt *transport.Packet) error {
+	round := strconv.Itoa(n.ServerRound)
+	n.expectRelease(round, "norms-"+round)
+	pkt.Round = n.ServerRound
+	pkt.Nonce = make([]byte, NonceSize)
+	_, err := rand.Read(pkt.Nonce)
+	return err
+}
+
+// Client side: the next uploads are for the round after that of the result
+func (n *Node) nextRound(id string) {
+	round, err := strconv.Atoi(id)
+	if err == nil && round >= n.ServerRound {
+		n.ServerRound = round + 1
+	}
+}
@@ -0,0 +1,60 @@
+package privacy
+
+import "math"
+
+// Rényi orders tracked by the accountants
+var Orders = []float64{1.25, 1.5, 1.75, 2, 2.5, 3, 4, 5, 6, 8, 10, 12, 16, 20, 32, 64, 128, 256}
+
+// Accountant tracks the Rényi differential privacy (Mironov, Rényi
+// Differential Privacy) spent by successive releases, which compose by
+// addition, then converts it to (epsilon, delta).
+type Accountant struct {
+	RDP   []float64 // per order
+	Steps int
+}
+
+func NewAccountant() *Accountant {
+	return &Accountant{RDP: make([]float64, len(Orders))}
+}
+
+// Spend records a release with the mechanism and noise multiplier
+func (a *Accountant) Spend(mechanism string, noiseMultiplier float64) {
+	for i, alpha := range Orders {
+		a.RDP[i] += RDP(mechanism, noiseMultiplier, alpha)
+	}
+	a.Steps++
+}
+
+// Epsilon spent so far, for delta
+func (a *Accountant) Epsilon(delta float64) float64 {
+	return epsilon(a.RDP, delta)
+}
+
+// Allows returns whether one more release keeps epsilon within the budget
+func (a *Accountant) Allows(mechanism string, noiseMultiplier float64, budget float64, delta float64) bool {
+	next := make([]float64, len(Orders))
+	for i, alpha := range Orders {
+		next[i] = a.RDP[i] + RDP(mechanism, noiseMultiplier, alpha)
+	}
+	return epsilon(next, delta) <= budget
+}
+
+// RDP returns the Rényi divergence of order alpha of a release, the noise
+// scale being noiseMultiplier times the sensitivity
+func RDP(mechanism string, noiseMultiplier float64, alpha float64) float64 {
+	if mechanism == Laplace {
+		// Mironov, Proposition 6
+		l := noiseMultiplier
+		return math.Log(alpha/(2*alpha-1)*math.Exp((alpha-1)/l)+(alpha-1)/(2*alpha-1)*math.Exp(-alpha/l)) / (alpha - 1)
+	}
+	return alpha / (2 * noiseMultiplier * noiseMultiplier)
+}
+
+// Smallest epsilon over the orders, of the RDP guarantees
+func epsilon(rdp []float64, delta float64) float64 {
+	eps := math.Inf(1)
+	for i, alpha := range Orders {
+		eps = math.Min(eps, rdp[i]+math.Log(1/delta)/(alpha-1))
+	}
+	return eps
+}
@@ -0,0 +1,131 @@
+package privacy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Where the noise of the aggregate comes from
+const (
+	ServerNoise      = "server"      // the server adds it to the aggregate
+	DistributedNoise = "distributed" // each participant adds a share of it
+)
+
+// Noise shares are multiples of this, the fixed point of masked aggregation
+const DefaultGranularity = 1.0 / (1 << 24)
+
+// CentralConfig of the differential privacy of the aggregate. Participants
+// clip their update, the sum being noised with NoiseMultiplier times the
+// norm bound. Configured identically on the server and the participants.
+type CentralConfig struct {
+	Mode            string // ServerNoise by default
+	NormBound       float64
+	NoiseMultiplier float64
+	Delta           float64 // of the reported guarantee
+	Participants    int     // sharing the noise, in distributed mode
+	Granularity     float64 // of the noise shares, DefaultGranularity if 0
+}
+
+// CentralDP noises the aggregate of each round, and accounts for the
+// whole run on the server.
+type CentralDP struct {
+	CentralConfig
+	Accountant *Accountant
+
+	noise sampler
+}
+
+// NewCentralDP checks the configuration, the noise being drawn from crypto/rand
+func NewCentralDP(config CentralConfig) (*CentralDP, error) {
+	return newCentralDP(config, newCryptoRand())
+}
+
+// NewCentralDPWithSeed draws reproducible, predictable, noise: for tests only
+func NewCentralDPWithSeed(config CentralConfig, seed int64) (*CentralDP, error) {
+	return newCentralDP(config, rand.New(rand.NewSource(seed)))
+}
+
+func newCentralDP(config CentralConfig, source *rand.Rand) (*CentralDP, error) {
+	if config.Mode == "" {
+		config.Mode = ServerNoise
+	}
+	if config.Mode != ServerNoise && config.Mode != DistributedNoise {
+		return nil, errors.New("[privacy.NewCentralDP]: unknown mode " + config.Mode)
+	}
+	if config.NormBound <= 0 || config.NoiseMultiplier <= 0 {
+		return nil, errors.New("[privacy.NewCentralDP]: norm bound and noise multiplier must be positive")
+	}
+	if config.Delta <= 0 || config.Delta >= 1 {
+		return nil, errors.New("[privacy.NewCentralDP]: delta must be in (0, 1)")
+	}
+	if config.Mode == DistributedNoise && config.Participants < 1 {
+		return nil, errors.New("[privacy.NewCentralDP]: number of participants sharing the noise needed")
+	}
+	if config.Granularity == 0 {
+		config.Granularity = DefaultGranularity
+	}
+	return &CentralDP{
+		CentralConfig: config,
+		Accountant:    NewAccountant(),
+		noise:         sampler{rand: source},
+	}, nil
+}
+
+// Sigma is the standard deviation of the noise of the sum
+func (dp *CentralDP) Sigma() float64 {
+	return dp.NoiseMultiplier * dp.NormBound
+}
+
+// Prepare returns the update of a participant clipped, with its share of
+// the noise in distributed mode: a discrete Gaussian of variance Sigma^2
+// over the number of participants, so that the shares add up to the
+// variance of the sum. Fewer contributors leave less noise.
+func (dp *CentralDP) Prepare(update []float64) []float64 {
+	res := Clip(update, dp.NormBound)
+	if dp.Mode != DistributedNoise {
+		return res
+	}
+	sigma := dp.Sigma() / math.Sqrt(float64(dp.Participants)) / dp.Granularity
+	for i := range res {
+		res[i] += float64(dp.noise.discreteGaussian(sigma)) * dp.Granularity
+	}
+	return res
+}
+
+// Noise returns the noise the server adds to an average of count updates,
+// multiples of the granularity, none in distributed mode
+func (dp *CentralDP) Noise(length int, count int) []float64 {
+	noise := make([]float64, length)
+	if dp.Mode != ServerNoise {
+		return noise
+	}
+	sigma := dp.Sigma() / float64(count)
+	for i := range noise {
+		noise[i] = dp.noise.gaussian(0, sigma, dp.Granularity)
+	}
+	return noise
+}
+
+// Spend records a noised aggregate of contributors updates. Distributed
+// discrete Gaussian noise is accounted as continuous, which its sum
+// approaches for large shares, of the shares of the contributors only.
+func (dp *CentralDP) Spend(contributors int) {
+	multiplier := dp.NoiseMultiplier
+	if dp.Mode == DistributedNoise {
+		multiplier *= math.Sqrt(float64(contributors) / float64(dp.Participants))
+	}
+	dp.Accountant.Spend(Gaussian, multiplier)
+}
+
+// Guarantee is the (epsilon, delta) of every aggregate released so far
+func (dp *CentralDP) Guarantee() (float64, float64) {
+	return dp.Accountant.Epsilon(dp.Delta), dp.Delta
+}
+
+func (dp *CentralDP) String() string {
+	epsilon, delta := dp.Guarantee()
+	return fmt.Sprintf("(%.3f, %g)-DP over %d rounds, %s noise x%g, norm bound %g",
+		epsilon, delta, dp.Accountant.Steps, dp.Mode, dp.NoiseMultiplier, dp.NormBound)
+}
@@ -0,0 +1,125 @@
+package privacy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Noise mechanisms
+const (
+	Gaussian = "gaussian"
+	Laplace  = "laplace"
+)
+
+// ErrBudgetExhausted is returned once another update would exceed the budget
+var ErrBudgetExhausted = errors.New("[privacy]: privacy budget exhausted")
+
+// Config of the differential privacy of a client's updates
+type Config struct {
+	Mechanism       string  // Gaussian by default
+	NormBound       float64 // updates are clipped to this L2 norm
+	NoiseMultiplier float64 // noise scale over the sensitivity
+	Epsilon         float64 // budget over every round
+	Delta           float64
+}
+
+// LocalDP clips and noises the updates of a client before they leave it,
+// and refuses to release more than its budget.
+type LocalDP struct {
+	Config
+	Accountant *Accountant
+
+	noise sampler
+}
+
+// NewLocalDP checks the configuration, the noise being drawn from crypto/rand
+func NewLocalDP(config Config) (*LocalDP, error) {
+	return newLocalDP(config, newCryptoRand())
+}
+
+// NewLocalDPWithSeed draws reproducible, predictable, noise: for tests only
+func NewLocalDPWithSeed(config Config, seed int64) (*LocalDP, error) {
+	return newLocalDP(config, rand.New(rand.NewSource(seed)))
+}
+
+func newLocalDP(config Config, source *rand.Rand) (*LocalDP, error) {
+	if config.Mechanism == "" {
+		config.Mechanism = Gaussian
+	}
+	if config.Mechanism != Gaussian && config.Mechanism != Laplace {
+		return nil, errors.New("[privacy.NewLocalDP]: unknown mechanism " + config.Mechanism)
+	}
+	if config.NormBound <= 0 || config.NoiseMultiplier <= 0 {
+		return nil, errors.New("[privacy.NewLocalDP]: norm bound and noise multiplier must be positive")
+	}
+	if config.Epsilon <= 0 || config.Delta <= 0 || config.Delta >= 1 {
+		return nil, errors.New("[privacy.NewLocalDP]: epsilon must be positive, delta in (0, 1)")
+	}
+	return &LocalDP{
+		Config:     config,
+		Accountant: NewAccountant(),
+		noise:      sampler{rand: source},
+	}, nil
+}
+
+// Privatize returns the update clipped and noised, if the budget allows it
+func (dp *LocalDP) Privatize(update []float64) ([]float64, error) {
+	if !dp.Accountant.Allows(dp.Mechanism, dp.NoiseMultiplier, dp.Epsilon, dp.Delta) {
+		return nil, ErrBudgetExhausted
+	}
+	res := Clip(update, dp.NormBound)
+
+	// The whole update is protected: replaced by any other clipped update,
+	// it moves by up to twice the norm bound, in L2. In L1, for the Laplace
+	// mechanism, it is up to sqrt(d) times more.
+	sensitivity := 2 * dp.NormBound
+	switch dp.Mechanism {
+	case Gaussian:
+		sigma := dp.NoiseMultiplier * sensitivity
+		for i := range res {
+			res[i] = dp.noise.gaussian(res[i], sigma, DefaultGranularity)
+		}
+	case Laplace:
+		b := dp.NoiseMultiplier * sensitivity * math.Sqrt(float64(len(res)))
+		for i := range res {
+			res[i] = dp.noise.laplace(res[i], b, DefaultGranularity)
+		}
+	}
+	dp.Accountant.Spend(dp.Mechanism, dp.NoiseMultiplier)
+	return res, nil
+}
+
+// Spent returns the epsilon spent so far, for the configured delta
+func (dp *LocalDP) Spent() float64 {
+	return dp.Accountant.Epsilon(dp.Delta)
+}
+
+func (dp *LocalDP) String() string {
+	return fmt.Sprintf("%s noise x%g, norm bound %g, epsilon %.3f of %g (delta %g) over %d updates",
+		dp.Mechanism, dp.NoiseMultiplier, dp.NormBound, dp.Spent(), dp.Epsilon, dp.Delta, dp.Accountant.Steps)
+}
+
+// Clip returns a copy of v, scaled down to an L2 norm of at most bound
+func Clip(v []float64, bound float64) []float64 {
+	res := make([]float64, len(v))
+	norm := Norm(v)
+	scale := 1.0
+	if norm > bound {
+		scale = bound / norm
+	}
+	for i := range v {
+		res[i] = v[i] * scale
+	}
+	return res
+}
+
+// Norm returns the L2 norm of v
+func Norm(v []float64) float64 {
+	sum := 0.0
+	for _, x := range v {
+		sum += x * x
+	}
+	return math.Sqrt(sum)
+}
@@ -0,0 +1,96 @@
+package privacy
+
+import (
+	"bufio"
+	crand "crypto/rand"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/rand"
+)
+
+// Noise is drawn from crypto/rand: the state of a math/rand generator can
+// be told from its outputs. It is also drawn on a grid, in multiples of a
+// granularity added to values rounded on it, as the low-order bits of
+// floating-point samples leak the value they noise (Mironov, On
+// Significance of the Least Significant Bits for Differential Privacy).
+
+// Source of math/rand reading crypto/rand
+type cryptoSource struct {
+	r *bufio.Reader
+}
+
+func newCryptoRand() *rand.Rand {
+	return rand.New(cryptoSource{r: bufio.NewReader(crand.Reader)})
+}
+
+func (s cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	_, err := io.ReadFull(s.r, b[:])
+	if err != nil {
+		panic("[privacy]: crypto/rand unavailable: " + err.Error())
+	}
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+func (s cryptoSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// Seeding is meaningless for crypto/rand
+func (s cryptoSource) Seed(int64) {}
+
+// Draws the noise, from crypto/rand unless seeded for testing
+type sampler struct {
+	rand *rand.Rand
+}
+
+// x rounded on the grid of granularity, plus Gaussian noise of standard
+// deviation sigma on the grid
+func (s sampler) gaussian(x float64, sigma float64, granularity float64) float64 {
+	return (math.Round(x/granularity) + float64(s.discreteGaussian(sigma/granularity))) * granularity
+}
+
+// x rounded on the grid of granularity, plus Laplace noise of scale at
+// least b on the grid
+func (s sampler) laplace(x float64, b float64, granularity float64) float64 {
+	t := math.Max(1, math.Ceil(b/granularity))
+	return (math.Round(x/granularity) + float64(s.discreteLaplace(t))) * granularity
+}
+
+// Samples the discrete Gaussian of parameter sigma, by rejection from a
+// discrete Laplace (Canonne, Kamath, Steinke, The Discrete Gaussian for
+// Differential Privacy, Algorithm 3)
+func (s sampler) discreteGaussian(sigma float64) int64 {
+	t := math.Floor(sigma) + 1
+	for {
+		y := s.discreteLaplace(t)
+		d := math.Abs(float64(y)) - sigma*sigma/t
+		if s.rand.Float64() < math.Exp(-d*d/(2*sigma*sigma)) {
+			return y
+		}
+	}
+}
+
+// Samples the discrete Laplace of integer scale t (Algorithm 2)
+func (s sampler) discreteLaplace(t float64) int64 {
+	for {
+		u := math.Floor(s.rand.Float64() * t)
+		if s.rand.Float64() >= math.Exp(-u/t) {
+			continue
+		}
+		v := 0.0
+		for s.rand.Float64() < math.Exp(-1) {
+			v++
+		}
+		x := int64(u + t*v)
+		negative := s.rand.Intn(2) == 1
+		if negative && x == 0 {
+			continue
+		}
+		if negative {
+			return -x
+		}
+		return x
+	}
+}
@@ -0,0 +1,606 @@
+package test
+
+import (
+	"encoding/binary"
+	"federated/encryption"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/ckks"
+	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/rlwe"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_EncryptVectorLargerThanRing(t *testing.T) {
+	client := encryption.NewClient()
+	server := encryption.NewServer()
+
+	// More values than coefficients in one polynomial,
+	// including negative and near-zero weights.
+	length := client.Params.N() + 100
+	v1 := make([]float64, length)
+	v2 := make([]float64, length)
+	for i := range v1 {
+		v1[i] = float64(i%7) - 3
+		v2[i] = 1e-9
+	}
+
+	e1 := client.EncryptVector(v1)
+	require.Equal(t, 2, len(e1.Chunks))
+
+	// Through serialization, as sent by the nodes
+	encrypted, err := client.EncryptWeights(v2)
+	require.NoError(t, err)
+	e2 := new(encryption.EncryptedVector)
+	require.NoError(t, encryption.UnmarshalFromBase64(e2, encrypted))
+
+	mean, err := server.AverageVectorsNew([]*encryption.EncryptedVector{e1, e2})
+	require.NoError(t, err)
+	values, err := client.DecryptWeights(encryption.MarshalToBase64String(mean))
+	require.NoError(t, err)
+
+	require.Equal(t, length, len(values))
+	for i := range values {
+		require.InDelta(t, (v1[i]+v2[i])/2, values[i], 1e-5)
+	}
+
+	// Vectors of different lengths can't be added
+	_, err = server.AddVectorsNew(e1, client.EncryptVector([]float64{1}))
+	require.Error(t, err)
+
+	// Nor can lengths exceed what the chunks hold, negative ones included
+	data, err := e1.MarshalBinary()
+	require.NoError(t, err)
+	for _, crafted := range []uint64{1 << 63, uint64(2*client.Params.N() + 1)} {
+		binary.LittleEndian.PutUint64(data, crafted)
+		require.Error(t, new(encryption.EncryptedVector).UnmarshalBinary(data))
+	}
+	binary.LittleEndian.PutUint64(data, uint64(2*client.Params.N()))
+	require.NoError(t, new(encryption.EncryptedVector).UnmarshalBinary(data))
+}
+
+func Test_SlotsEncoding(t *testing.T) {
+	client := encryption.NewClient()
+	server := encryption.NewServer()
+
+	values := make([]float64, 3000)
+	for i := range values {
+		values[i] = float64(i%11)/10 - 0.5
+	}
+
+	for _, encoding := range []string{encryption.CoeffsEncoding, encryption.SlotsEncoding} {
+		require.NoError(t, client.SetEncoding(encoding, 10))
+		e := client.EncryptVector(values)
+		require.Equal(t, encoding, e.Encoding)
+		if encoding == encryption.SlotsEncoding {
+			// 1024 values per ciphertext
+			require.Equal(t, 3, len(e.Chunks))
+		}
+
+		encrypted := encryption.MarshalToBase64String(server.MultVectorByConstNew(e, 2))
+		decrypted, err := client.DecryptWeights(encrypted)
+		require.NoError(t, err)
+		require.Equal(t, len(values), len(decrypted))
+		for i := range values {
+			require.InDelta(t, 2*values[i], decrypted[i], 1e-5)
+		}
+	}
+
+	// Vectors of both encodings can't be mixed
+	require.NoError(t, client.SetEncoding(encryption.CoeffsEncoding, 0))
+	_, err := server.AddVectorsNew(client.EncryptVector(values), server.MultVectorByConstNew(client.EncryptVector(values), 1))
+	require.NoError(t, err)
+	slots := encryption.NewClient()
+	require.NoError(t, slots.SetEncoding(encryption.SlotsEncoding, 12))
+	_, err = server.AddVectorsNew(client.EncryptVector(values), slots.EncryptVector(values))
+	require.Error(t, err)
+
+	require.Error(t, client.SetEncoding(encryption.SlotsEncoding, 64))
+	require.Error(t, client.SetEncoding("unknown", 0))
+}
+
+func Test_ThresholdDecryption(t *testing.T) {
+	server := encryption.NewServer()
+	clients := make([]encryption.Client, 3)
+	points := []uint64{1, 2, 3}
+	for i := range clients {
+		clients[i] = encryption.NewClient()
+	}
+
+	// Collective key
+	_, err := server.StartKeyGeneration([]string{"a", "b", "c"})
+	require.NoError(t, err)
+	for i, name := range []string{"a", "b", "c"} {
+		share, err := clients[i].GenKeyGenShare(server.KeyGeneration.Seed)
+		require.NoError(t, err)
+		_, err = server.AddKeyGenShare(name, share)
+		require.NoError(t, err)
+	}
+	for i := range clients {
+		clients[i].SetPublicKey(server.KeyGeneration.PublicKey)
+	}
+
+	// 2-out-of-3 shares
+	received := make([][]*rlwe.SecretKey, 3)
+	for i := range clients {
+		shares, err := clients[i].GenShamirShares(2, points)
+		require.NoError(t, err)
+		for j := range shares {
+			received[j] = append(received[j], shares[j])
+		}
+	}
+	for i := range clients {
+		clients[i].SetShamirShares(received[i])
+	}
+
+	values := []float64{0.5, -1.25, 3}
+	v := clients[0].EncryptVector(values)
+
+	// Every participant, without the Shamir shares
+	all := make([][]*drlwe.CKSShare, 3)
+	for i := range clients {
+		all[i], err = clients[i].GenDecryptionShares(v, 0, nil)
+		require.NoError(t, err)
+	}
+	released, err := server.ReleaseVector(v, all)
+	require.NoError(t, err)
+	decrypted, err := encryption.DecodeReleasedVector(server.Params, released)
+	require.NoError(t, err)
+	for i := range values {
+		require.InDelta(t, values[i], decrypted[i], 1e-3)
+	}
+
+	// Participants 1 and 3 only
+	set := []uint64{1, 3}
+	shares := make([][]*drlwe.CKSShare, 0)
+	for _, i := range []int{0, 2} {
+		s, err := clients[i].GenDecryptionShares(v, points[i], set)
+		require.NoError(t, err)
+		shares = append(shares, s)
+	}
+	released, err = server.ReleaseVector(v, shares)
+	require.NoError(t, err)
+	decrypted, err = encryption.DecodeReleasedVector(server.Params, released)
+	require.NoError(t, err)
+	for i := range values {
+		require.InDelta(t, values[i], decrypted[i], 1e-3)
+	}
+
+	// A single participant is not enough
+	s, err := clients[1].GenDecryptionShares(v, points[1], []uint64{2})
+	require.NoError(t, err)
+	released, err = server.ReleaseVector(v, [][]*drlwe.CKSShare{s})
+	require.NoError(t, err)
+	decrypted, err = encryption.DecodeReleasedVector(server.Params, released)
+	require.NoError(t, err)
+	require.Greater(t, math.Abs(decrypted[0]-values[0]), 1.0)
+
+	// Re-encryption towards a key of its own
+	target := encryption.NewClient()
+	target.SecretKey = ckks.NewKeyGenerator(target.Params).GenSecretKey()
+	target.Decryptor = ckks.NewDecryptor(target.Params, target.SecretKey)
+	pk := ckks.NewKeyGenerator(target.Params).GenPublicKey(target.SecretKey)
+	reshares := make([][]*drlwe.PCKSShare, 0)
+	for _, i := range []int{0, 2} {
+		s, err := clients[i].GenReencryptionShares(v, pk, points[i], set)
+		require.NoError(t, err)
+		reshares = append(reshares, s)
+	}
+	reencrypted, err := server.ReencryptVector(v, reshares)
+	require.NoError(t, err)
+	decrypted, err = target.DecryptVector(reencrypted)
+	require.NoError(t, err)
+	for i := range values {
+		require.InDelta(t, values[i], decrypted[i], 1e-3)
+	}
+}
+
+func Test_SealedShares(t *testing.T) {
+	sender := encryption.NewClient()
+	recipient := encryption.NewClient()
+	other := encryption.NewClient()
+	pub, err := recipient.GenSharingKey()
+	require.NoError(t, err)
+	_, err = other.GenSharingKey()
+	require.NoError(t, err)
+
+	sender.SecretKey = ckks.NewKeyGenerator(sender.Params).GenSecretKey()
+	shares, err := sender.GenShamirShares(1, []uint64{1})
+	require.NoError(t, err)
+	require.True(t, shares[0].Value.Equals(sender.SecretKey.Value))
+
+	sealed, err := encryption.SealShare(shares[0], pub)
+	require.NoError(t, err)
+	opened, err := recipient.OpenShare(sealed)
+	require.NoError(t, err)
+	require.True(t, opened.Value.Equals(shares[0].Value))
+	_, err = other.OpenShare(sealed)
+	require.Error(t, err)
+}
+
+func Test_PublicKeyClient(t *testing.T) {
+	holder := encryption.NewClient()
+	pk := holder.GenKeyPair()
+
+	// Shipped as in a packet
+	msg, err := encryption.MarshalPublicKey(pk)
+	require.NoError(t, err)
+	received, err := encryption.UnmarshalPublicKey(holder.Params, msg)
+	require.NoError(t, err)
+	require.True(t, pk.Equals(received))
+	_, err = encryption.UnmarshalPublicKey(holder.Params, "AAAA")
+	require.Error(t, err)
+
+	client := encryption.NewPublicKeyClient(received)
+	require.Nil(t, client.SecretKey)
+	require.False(t, client.CanDecrypt())
+
+	values := []float64{0.5, -1.25, 3}
+	v := client.EncryptVector(values)
+	_, err = client.DecryptVector(v)
+	require.Error(t, err)
+
+	decrypted, err := holder.DecryptVector(v)
+	require.NoError(t, err)
+	for i := range values {
+		require.InDelta(t, values[i], decrypted[i], 1e-5)
+	}
+}
+
+func Test_SelectParameters(t *testing.T) {
+	req := encryption.Requirements{Weights: 3000, Precision: 6, Participants: 10, Multiplications: 1, Magnitude: 10}
+	params, err := encryption.SelectParameters(req)
+	require.NoError(t, err)
+	require.LessOrEqual(t, params.LogQP(), encryption.MaxLogQP[params.LogN()])
+	require.GreaterOrEqual(t, params.N(), req.Weights)
+
+	// Averaging keeps the precision asked for
+	client := encryption.NewClientWithParameters(params)
+	server := encryption.NewServerWithParameters(params)
+	vectors := make([]*encryption.EncryptedVector, req.Participants)
+	expected := make([]float64, req.Weights)
+	for i := range vectors {
+		values := make([]float64, req.Weights)
+		for j := range values {
+			values[j] = float64((i*j)%19)/2 - 4.5
+			expected[j] += values[j] / float64(req.Participants)
+		}
+		vectors[i] = client.EncryptVector(values)
+	}
+	average, err := server.AverageVectorsNew(vectors)
+	require.NoError(t, err)
+	decrypted, err := client.DecryptVector(average)
+	require.NoError(t, err)
+	for i := range expected {
+		require.InDelta(t, expected[i], decrypted[i], 1e-6)
+	}
+
+	// Through a packet
+	msg, err := encryption.MarshalParameters(params)
+	require.NoError(t, err)
+	received, err := encryption.UnmarshalParameters(msg)
+	require.NoError(t, err)
+	require.True(t, params.Equals(received))
+	_, err = encryption.UnmarshalParameters("AAAA")
+	require.Error(t, err)
+
+	_, err = encryption.SelectParameters(encryption.Requirements{Precision: 15, Participants: 100})
+	require.Error(t, err)
+	_, err = encryption.SelectParameters(encryption.Requirements{Precision: 3, Multiplications: 100})
+	require.Error(t, err)
+}
+
+func Test_Keystore(t *testing.T) {
+	dir := t.TempDir()
+	client := encryption.NewClient()
+	client.GenKeyPair()
+	v := client.EncryptVector([]float64{0.5, -1.25, 3})
+
+	for _, passphrase := range [][]byte{nil, []byte("correct horse")} {
+		path := filepath.Join(dir, "keys", string(passphrase)+"node.json")
+		require.NoError(t, encryption.SaveKeys(path, client.Keys(), passphrase))
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(encryption.KeyFileMode), info.Mode().Perm())
+
+		keys, err := encryption.LoadKeys(path, passphrase)
+		require.NoError(t, err)
+		require.True(t, keys.SecretKey.Value.Equals(client.SecretKey.Value))
+		require.True(t, keys.PublicKey.Equals(client.PublicKey))
+		require.Nil(t, keys.ThresholdKey)
+
+		restarted := encryption.NewClientWithParameters(keys.Params)
+		require.NoError(t, restarted.SetKeys(keys))
+		decrypted, err := restarted.DecryptVector(v)
+		require.NoError(t, err)
+		require.InDelta(t, -1.25, decrypted[1], 1e-5)
+
+		if passphrase != nil {
+			_, err = encryption.LoadKeys(path, []byte("wrong"))
+			require.Error(t, err)
+			_, err = encryption.LoadKeys(path, nil)
+			require.Error(t, err)
+		}
+
+		require.NoError(t, os.Chmod(path, 0644))
+		_, err = encryption.LoadKeys(path, passphrase)
+		require.Error(t, err)
+	}
+
+	// Keys of other parameters are refused
+	other, err := encryption.SelectParameters(encryption.Requirements{Weights: 25, Precision: 4, Participants: 2, Multiplications: 1})
+	require.NoError(t, err)
+	require.False(t, other.Equals(client.Params))
+	keys := client.Keys()
+	keys.Params = other
+	path := filepath.Join(dir, "mismatch.json")
+	require.NoError(t, encryption.SaveKeys(path, keys, nil))
+	_, err = encryption.LoadKeys(path, nil)
+	require.Error(t, err)
+}
+
+func Test_PrecisionStats(t *testing.T) {
+	client := encryption.NewClient()
+	server := encryption.NewServer()
+	v1 := []float64{0.5, -1.25, 3, 0}
+	v2 := []float64{1.5, 0.25, -3, 1e-9}
+	reference := make([]float64, len(v1))
+	for i := range v1 {
+		reference[i] = (v1[i] + v2[i]) / 2
+	}
+
+	average, err := server.AverageVectorsNew([]*encryption.EncryptedVector{client.EncryptVector(v1), client.EncryptVector(v2)})
+	require.NoError(t, err)
+	values, stats, err := client.DecryptVectorWithStats(average, reference)
+	require.NoError(t, err)
+	require.Equal(t, len(reference), len(values))
+	require.Equal(t, len(reference), len(stats.Errors))
+	require.Equal(t, client.Params.MaxLevel(), stats.Level)
+	require.Greater(t, stats.LogScale, math.Log2(client.Params.DefaultScale()))
+	require.LessOrEqual(t, stats.MinPrecision, stats.AvgPrecision)
+	require.LessOrEqual(t, stats.AvgPrecision, stats.MaxPrecision)
+	require.Greater(t, stats.MinPrecision, 15.0)
+	require.InDelta(t, 0, stats.MaxError, math.Exp2(-stats.MinPrecision)+1e-12)
+	require.False(t, stats.TooTight())
+
+	// Without reference, only the budget is known
+	_, stats, err = client.DecryptVectorWithStats(average, nil)
+	require.NoError(t, err)
+	require.Nil(t, stats.Errors)
+	require.Greater(t, stats.Headroom, 0.0)
+
+	// Values too large for the parameters
+	params, err := encryption.SelectParameters(encryption.Requirements{Precision: 3, Participants: 1, Magnitude: 2})
+	require.NoError(t, err)
+	tight := encryption.NewClientWithParameters(params)
+	_, stats, err = tight.DecryptVectorWithStats(tight.EncryptVector([]float64{1000}), nil)
+	require.NoError(t, err)
+	require.True(t, stats.TooTight())
+}
+
+func Test_AddDeltas(t *testing.T) {
+	client := encryption.NewClient()
+	server := encryption.NewServer()
+	global := []float64{1, -2, 0.5}
+	deltas := [][]float64{{0.1, 0.2, -0.3}, {0.3, -0.2, 0.1}}
+
+	encrypted := make([]*encryption.EncryptedVector, len(deltas))
+	for i, d := range deltas {
+		encrypted[i] = client.EncryptVector(d)
+	}
+	model, err := server.AddDeltasToPlainNew(global, encrypted, 0.5)
+	require.NoError(t, err)
+	level := model.Chunks[0].Level()
+
+	// The global model stays at the same level over the rounds
+	for round := 0; round < 5; round++ {
+		for i := range global {
+			global[i] += 0.5 * (deltas[0][i] + deltas[1][i]) / 2
+		}
+		decrypted, err := client.DecryptVector(model)
+		require.NoError(t, err)
+		for i := range global {
+			require.InDelta(t, global[i], decrypted[i], 1e-4)
+		}
+		require.Equal(t, level, model.Chunks[0].Level())
+
+		model, err = server.AddDeltasNew(model, encrypted, 0.5)
+		require.NoError(t, err)
+	}
+
+	_, err = server.AddDeltasToPlainNew([]float64{1}, encrypted, 1)
+	require.Error(t, err)
+}
+
+func Test_AddValues(t *testing.T) {
+	client := encryption.NewClient()
+	server := encryption.NewServer()
+	a := client.EncryptVector([]float64{1, 2, 3})
+	b := client.EncryptVector([]float64{3, 2, 1})
+
+	// Added at the scale of an average
+	average, err := server.AverageVectorsNew([]*encryption.EncryptedVector{a, b})
+	require.NoError(t, err)
+	noised, err := server.AddValuesNew(average, []float64{0.5, -0.25, 1e-3})
+	require.NoError(t, err)
+	decrypted, err := client.DecryptVector(noised)
+	require.NoError(t, err)
+	require.InDeltaSlice(t, []float64{2.5, 1.75, 2.001}, decrypted, 1e-4)
+
+	_, err = server.AddValuesNew(average, []float64{1})
+	require.Error(t, err)
+}
+
+func Test_SquaredNorm(t *testing.T) {
+	values := []float64{0.5, -1.25, 3, 0.1}
+	expected := 0.25 + 1.5625 + 9 + 0.01
+
+	// Shared zero key, over both encodings
+	for _, encoding := range []string{encryption.CoeffsEncoding, encryption.SlotsEncoding} {
+		client := encryption.NewClient()
+		require.NoError(t, client.SetEncoding(encoding, 0))
+		server := encryption.NewServer()
+		v := client.EncryptVector(values)
+		_, err := server.SquaredNormNew(v)
+		require.Error(t, err)
+
+		rlk, rtks, err := client.GenNormKeys()
+		require.NoError(t, err)
+		server.SetNormKeys(rlk, rtks)
+		norm, err := server.SquaredNormNew(v)
+		require.NoError(t, err)
+		decrypted, err := client.DecryptVector(norm)
+		require.NoError(t, err)
+		require.Len(t, decrypted, 1)
+		// Errors of the slots add up
+		delta := 1e-3
+		if encoding == encryption.SlotsEncoding {
+			delta = 1e-2
+		}
+		require.InDelta(t, expected, decrypted[0], delta, encoding)
+
+		// Several norms, released together
+		doubled := client.EncryptVector([]float64{1, -2.5, 6, 0.2})
+		norms, err := server.SquaredNormsNew([]*encryption.EncryptedVector{v, doubled, v})
+		require.NoError(t, err)
+		decrypted, err = client.DecryptVector(norms)
+		require.NoError(t, err)
+		require.InDeltaSlice(t, []float64{expected, 4 * expected, expected}, decrypted, 4*delta, encoding)
+	}
+
+	// Collective key, the norm is released jointly
+	server := encryption.NewServer()
+	clients := make([]encryption.Client, 2)
+	_, err := server.StartKeyGeneration([]string{"a", "b"})
+	require.NoError(t, err)
+	for i, name := range []string{"a", "b"} {
+		clients[i] = encryption.NewClient()
+		share, err := clients[i].GenKeyGenShare(server.KeyGeneration.Seed)
+		require.NoError(t, err)
+		_, err = server.AddKeyGenShare(name, share)
+		require.NoError(t, err)
+	}
+	for i := range clients {
+		clients[i].SetPublicKey(server.KeyGeneration.PublicKey)
+	}
+	// Keys of the collective secret, generated jointly, through the packets
+	_, err = server.StartNormKeyGeneration([]string{"a", "b"})
+	require.NoError(t, err)
+	_, err = clients[0].GenRelinShare(server.NormKeyGeneration.RelinRoundOne)
+	require.Error(t, err)
+	for i, name := range []string{"a", "b"} {
+		shares, err := clients[i].GenNormKeyShares(server.NormKeyGeneration.Seed)
+		require.NoError(t, err)
+		msg, err := encryption.MarshalNormKeyShares(shares)
+		require.NoError(t, err)
+		shares, err = encryption.UnmarshalNormKeyShares(server.Params, msg)
+		require.NoError(t, err)
+		done, err := server.AddNormKeyShares(name, shares)
+		require.NoError(t, err)
+		require.Equal(t, i == 1, done)
+	}
+	_, err = server.AddNormKeyShares("a", &encryption.NormKeyShares{})
+	require.Error(t, err)
+	roundOne := encryption.MarshalToBase64String(server.NormKeyGeneration.RelinRoundOne)
+	for i, name := range []string{"a", "b"} {
+		received, err := encryption.UnmarshalRelinShare(server.Params, roundOne)
+		require.NoError(t, err)
+		share, err := clients[i].GenRelinShare(received)
+		require.NoError(t, err)
+		// Answered once
+		_, err = clients[i].GenRelinShare(received)
+		require.Error(t, err)
+		share, err = encryption.UnmarshalRelinShare(server.Params, encryption.MarshalToBase64String(share))
+		require.NoError(t, err)
+		_, err = server.AddRelinShare(name, share)
+		require.NoError(t, err)
+	}
+	require.True(t, server.NormKeyGeneration.Done)
+	_, err = encryption.UnmarshalRelinShare(server.Params, roundOne[:len(roundOne)-8])
+	require.Error(t, err)
+
+	v := clients[0].EncryptVector(values)
+	norm, err := server.SquaredNormNew(v)
+	require.NoError(t, err)
+	shares := make([][]*drlwe.CKSShare, len(clients))
+	for i := range clients {
+		shares[i], err = clients[i].GenDecryptionShares(norm, 0, nil)
+		require.NoError(t, err)
+	}
+	released, err := server.ReleaseVector(norm, shares)
+	require.NoError(t, err)
+	decrypted, err := encryption.DecodeReleasedVector(server.Params, released)
+	require.NoError(t, err)
+	require.InDelta(t, expected, decrypted[0], 1e-2)
+}
+
+func Test_MaskedAggregation(t *testing.T) {
+	clients := make(map[uint64]*encryption.MaskingClient)
+	keys := make(map[uint64]encryption.MaskingKeys)
+	for id := uint64(1); id <= 5; id++ {
+		c, err := encryption.NewMaskingClient()
+		require.NoError(t, err)
+		clients[id] = c
+		keys[id] = c.Keys
+	}
+
+	// Secrets sharing, through the server
+	routed := make(map[uint64]map[uint64][]byte)
+	for id, c := range clients {
+		sealed, err := c.ShareSecrets(id, 3, keys)
+		require.NoError(t, err)
+		for to, s := range sealed {
+			if routed[to] == nil {
+				routed[to] = make(map[uint64][]byte)
+			}
+			routed[to][id] = s
+		}
+	}
+	for id, c := range clients {
+		require.NoError(t, c.ReceiveShares(routed[id]))
+	}
+	// Sealed for their recipient only
+	require.Error(t, clients[1].ReceiveShares(routed[2]))
+	require.NoError(t, clients[1].ReceiveShares(routed[1]))
+
+	// Client 5 drops before uploading
+	server := encryption.NewMaskingServer(3, keys, []uint64{1, 2, 3, 4, 5})
+	vectors := map[uint64][]float64{1: {0.5, -1}, 2: {1.25, 2}, 3: {-3, 0.001}, 4: {2, 1}}
+	for id := uint64(1); id <= 4; id++ {
+		masked, err := clients[id].MaskVector(vectors[id])
+		require.NoError(t, err)
+		// Masks hide the values
+		require.NotEqual(t, uint64(vectors[id][0]*(1<<encryption.MaskingScaleBits)), masked[0])
+		require.NoError(t, server.AddMasked(id, masked))
+	}
+	require.Error(t, server.AddMasked(4, []uint64{0, 0}))
+	require.Equal(t, []uint64{1, 2, 3, 4}, server.Survivors())
+
+	// Client 4 drops after uploading, its vector is still in the sum
+	_, err := clients[5].UnmaskingShares(server.Survivors())
+	require.NoError(t, err)
+	_, err = server.AddUnmaskingShares(5, map[uint64][]byte{})
+	require.Error(t, err)
+	for i, id := range []uint64{1, 2, 3} {
+		shares, err := clients[id].UnmaskingShares(server.Survivors())
+		require.NoError(t, err)
+		done, err := server.AddUnmaskingShares(id, shares)
+		require.NoError(t, err)
+		require.Equal(t, i == 2, done)
+		if !done {
+			_, err = server.Sum()
+			require.Error(t, err)
+		}
+	}
+
+	sum, err := server.Sum()
+	require.NoError(t, err)
+	require.InDeltaSlice(t, []float64{0.75, 2.001}, sum, 1e-6)
+
+	// Shares are revealed once only
+	_, err = clients[1].UnmaskingShares(server.Survivors())
+	require.Error(t, err)
+}
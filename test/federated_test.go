@@ -1,11 +1,18 @@
 package test
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
 	"federated/encryption"
 	"federated/neural"
 	"federated/node"
+	"federated/privacy"
 	"federated/transport"
 	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -13,6 +20,16 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// Binds the identities of the participants and of the server as joins
+// would, for tests exchanging packets without joining
+func bind(server *node.Node, participants ...*node.Node) {
+	for _, p := range participants {
+		server.Identities[p.Socket.GetAddress()] = p.Identity()
+		p.ServerAddress = server.Socket.GetAddress()
+		p.Identities[server.Socket.GetAddress()] = server.Identity()
+	}
+}
+
 // Test Send and Recv functions
 func Test_SendRecv(t *testing.T) {
 	n1 := node.Create()
@@ -34,6 +51,62 @@ func Test_SendRecv(t *testing.T) {
 	// Should terminate
 }
 
+// Fragmented messages in a row, such as the results of successive rounds,
+// small or not. The sender keeps receiving afterwards.
+func Test_FragmentedMessagesInARow(t *testing.T) {
+	sender := node.Create()
+	receiver := node.Create()
+	loop := func(n *node.Node) chan transport.Packet {
+		received := make(chan transport.Packet, 10)
+		go func() {
+			for {
+				pkt, err := n.Socket.Recv()
+				if err == nil && pkt.Type != transport.Ack {
+					received <- pkt
+				}
+			}
+		}()
+		return received
+	}
+	replies := loop(&sender)
+	received := loop(&receiver)
+
+	messages := make([]string, 4)
+	for i := range messages {
+		b := make([]byte, 10+120000*(i%2))
+		for j := range b {
+			b[j] = byte('a' + (i+j)%26)
+		}
+		messages[i] = string(b)
+		pkt := transport.Packet{
+			Source:      sender.Socket.GetAddress(),
+			Destination: receiver.Socket.GetAddress(),
+			Message:     messages[i],
+			Type:        transport.Result,
+			ID:          fmt.Sprint(i),
+		}
+		require.NoError(t, sender.Socket.Send(receiver.Socket.GetAddress(), pkt))
+	}
+	for i := range messages {
+		select {
+		case pkt := <-received:
+			require.Equal(t, fmt.Sprint(i), pkt.ID)
+			require.Equal(t, messages[i], pkt.Message)
+		case <-time.After(time.Second):
+			t.Fatal("message", i, "not received")
+		}
+	}
+
+	reply := transport.Packet{Source: receiver.Socket.GetAddress(), Destination: sender.Socket.GetAddress(), Message: "reply"}
+	require.NoError(t, receiver.Socket.Send(sender.Socket.GetAddress(), reply))
+	select {
+	case pkt := <-replies:
+		require.Equal(t, "reply", pkt.Message)
+	case <-time.After(time.Second):
+		t.Fatal("reply not received")
+	}
+}
+
 func Test_HE(t *testing.T) {
 	client := encryption.NewClient()
 
@@ -90,6 +163,7 @@ func Test_StartNode(t *testing.T) {
 
 	node2 := node.Create()
 	go node2.Start()
+	bind(&node1, &node2)
 
 	pkt := transport.Packet{
 		Source:      node2.Socket.GetAddress(),
@@ -101,6 +175,8 @@ func Test_StartNode(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 100)
 
+	// Received signed by node2
+	require.NoError(t, pkt.Sign(node2.Socket.IdentityKey()))
 	require.Equal(t, pkt, node1.Packets[0])
 }
 
@@ -110,6 +186,7 @@ func Test_SendHE(t *testing.T) {
 
 	node2 := node.Create()
 	go node2.Start()
+	bind(&node1, &node2)
 
 	encrypted, _ := node1.Client.Encrypt([]float64{3, 4})
 	pkt := transport.Packet{
@@ -139,6 +216,7 @@ func Test_ServerCalculations(t *testing.T) {
 
 	server := node.Create()
 	server.Server.AddParticipants(node1.Socket.GetAddress(), node2.Socket.GetAddress())
+	bind(&server, &node1, &node2)
 	server.Start()
 	serverEncryption := encryption.NewServer()
 
@@ -198,12 +276,13 @@ func Test_ServerSendResults(t *testing.T) {
 
 	server := node.Create()
 	server.Server.AddParticipants(node1.Socket.GetAddress(), node2.Socket.GetAddress())
+	bind(&server, &node1, &node2)
 
 	err := server.Start()
 	require.NoError(t, err)
 
 	// Node 1 encrypts and sends
-	encrypted, _ := node1.Client.Encrypt([]float64{3, 4, 5})
+	encrypted, _ := node1.Client.EncryptWeights([]float64{3, 4, 5})
 	pkt := transport.Packet{
 		Source:      node1.Socket.GetAddress(),
 		Destination: server.Socket.GetAddress(),
@@ -218,7 +297,7 @@ func Test_ServerSendResults(t *testing.T) {
 	require.NoError(t, err)
 
 	// Node 2 encrypts and sends
-	encrypted2, _ := node2.Client.Encrypt([]float64{5, 10, 0})
+	encrypted2, _ := node2.Client.EncryptWeights([]float64{5, 10, 0})
 	pkt2 := transport.Packet{
 		Source:      node2.Socket.GetAddress(),
 		Destination: server.Socket.GetAddress(),
@@ -239,13 +318,14 @@ func Test_ServerSendResults(t *testing.T) {
 	require.Equal(t, transport.Result, node2.Packets[0].Type)
 
 	// Node 1 receives
-	coeffs, err := node1.Decrypt(node1.Packets[0].Message)
+	coeffs, err := node1.DecryptWeights(node1.Packets[0].Message)
 	require.NoError(t, err)
 
 	// Node 2 receives
-	coeffs2, err2 := node2.Decrypt(node2.Packets[0].Message)
+	coeffs2, err2 := node2.DecryptWeights(node2.Packets[0].Message)
 	require.NoError(t, err2)
 
+	require.Equal(t, 3, len(coeffs))
 	require.Equal(t, coeffs[0], coeffs2[0])
 	require.Equal(t, coeffs[1], coeffs2[1])
 	require.Equal(t, coeffs[2], coeffs2[2])
@@ -285,15 +365,15 @@ func Test_NeuralNetwork(t *testing.T) {
 	nn.InitiateWeights()
 
 	// Change weights to known value
-	nn.Weights[0][0] = []float64{1, 1, 1, 1, 1}
-	nn.Weights[0][1] = []float64{1, 1, 1, 1, 1}
-	nn.Weights[0][2] = []float64{1, 1, 1, 1, 1}
-	nn.Weights[0][3] = []float64{1, 1, 1, 1, 1}
-	nn.Weights[2][0] = []float64{1, 1, 1, 1, 1}
+	for i := range nn.Weights {
+		nn.Weights[i] = 1
+	}
 
 	nn.Print()
 	// input -> hidden1 / hidden1 -> output
-	require.Equal(t, 2, len(nn.Weights))
+	require.Equal(t, 2, len(nn.Layers))
+	require.Equal(t, neural.LayerShape{Inputs: 5, Outputs: 1, Offset: 20}, nn.Layers[1])
+	require.Equal(t, 5, len(nn.LayerWeights(1)))
 
 	output, err := nn.Forward([]float64{0.01, 0.02, 0.03, 0.04})
 	require.NoError(t, err)
@@ -307,11 +387,43 @@ func Test_NeuralNetwork(t *testing.T) {
 	})
 }
 
+func Test_WeightsInitialization(t *testing.T) {
+	nn1 := neural.CreateNetwork(4, 1, 1, 5, 0.01)
+	nn1.InitiateWeightsFromSeed(42)
+	nn2 := neural.CreateNetwork(4, 1, 1, 5, 0.01)
+	nn2.InitiateWeightsFromSeed(42)
+
+	// Same seed -> same initial model
+	require.Equal(t, nn1.GetWeights(), nn2.GetWeights())
+
+	// Xavier uniform is zero-centered and bounded
+	limit := math.Sqrt(6.0 / 9.0)
+	negatives := 0
+	for _, w := range nn1.GetWeights() {
+		require.LessOrEqual(t, math.Abs(w), limit)
+		if w < 0 {
+			negatives++
+		}
+	}
+	require.Greater(t, negatives, 0)
+
+	for _, init := range []string{neural.RandomInit, neural.UniformInit, neural.XavierNormalInit, neural.HeUniformInit, neural.HeNormalInit} {
+		nn := neural.CreateNetwork(4, 1, 1, 5, 0.01)
+		nn.Initialization = init
+		nn.InitiateWeightsFromSeed(1)
+		require.Equal(t, 25, len(nn.GetWeights()))
+	}
+
+	err := neural.FillWeights(make([]float64, 3), "unknown", 1, 1, rand.New(rand.NewSource(1)))
+	require.Error(t, err)
+}
+
 func Test_Weights(t *testing.T) {
 	n1 := node.Create()
 	go n1.Start()
 	n2 := node.Create()
 	go n2.Start()
+	bind(&n2, &n1)
 	n1.NeuralNetwork = neural.CreateNetwork(4, 1, 1, 5, 0.01)
 	n1.NeuralNetwork.InitiateWeights()
 
@@ -329,6 +441,7 @@ func Test_Send2Times(t *testing.T) {
 	go n1.Start()
 	n2 := node.Create()
 	go n2.Start()
+	bind(&n2, &n1)
 	err := n1.SendWeights(n2.Socket.GetAddress(), false)
 	require.NoError(t, err)
 	err = n1.SendWeights(n2.Socket.GetAddress(), false)
@@ -354,6 +467,7 @@ func Test_Send2Times(t *testing.T) {
 // Root (server) encrypts initial weigths.
 func Test_ServerPreparesParameters(t *testing.T) {
 	server := node.Create()
+	server.Initialization = neural.HeNormalInit
 	go server.Start()
 
 	node1 := node.Create()
@@ -366,6 +480,8 @@ func Test_ServerPreparesParameters(t *testing.T) {
 	// See Protocol 1 Collective Training
 
 	// For now, server directly sends hyperparams
+	ckksParams, err := encryption.MarshalParameters(server.Server.Params)
+	require.NoError(t, err)
 	pktParams := transport.Packet{
 		Source:      server.Socket.GetAddress(),
 		Destination: node2.Socket.GetAddress(),
@@ -378,15 +494,19 @@ func Test_ServerPreparesParameters(t *testing.T) {
 			NbIterations:       5,
 			ActivationFunction: neural.SigmoidFunc,
 			BatchSize:          64,
+			Initialization:     neural.HeNormalInit,
+			CKKS:               ckksParams,
 		},
 		Type: transport.Params,
 	}
+	require.NoError(t, pktParams.Sign(server.Socket.IdentityKey()))
 	time.Sleep(time.Millisecond * 100)
 
 	require.Equal(t, 1, len(node1.Packets))
 	require.Equal(t, pktParams, node2.Packets[0])
 
 	require.Equal(t, node1.Packets[0].Params, node2.Packets[0].Params)
+	require.Equal(t, neural.HeNormalInit, node2.Initialization)
 }
 
 func Test_LocalGradientDescent(t *testing.T) {
@@ -444,3 +564,1235 @@ func Test_StartLearning(t *testing.T) {
 	// precision is up to ~10^7
 	require.Equal(t, int(n1.GetWeights()[0]*1000), int(n2.GetWeights()[0]*1000))
 }
+
+func Test_FederatedEvaluation(t *testing.T) {
+	// Only the aggregate is released, nobody holds the key of the participants
+	setups := map[string]func(server *node.Node) error{
+		"collective": (*node.Node).StartKeyGeneration,
+		"threshold": func(server *node.Node) error {
+			err := server.StartKeyGeneration()
+			if err != nil {
+				return err
+			}
+			time.Sleep(time.Millisecond * 500)
+			server.Threshold = 1
+			return server.StartThresholdSetup()
+		},
+	}
+	for name, setup := range setups {
+		t.Run(name, func(t *testing.T) {
+			server := node.Create()
+			server.Start()
+			n1 := node.Create()
+			n1.Start()
+			n2 := node.Create()
+			n2.Start()
+			n1.Join(server.Socket.GetAddress())
+			n2.Join(server.Socket.GetAddress())
+			time.Sleep(time.Millisecond * 100)
+
+			n1.Validation = neural.Dataset{
+				Inputs:  [][]float64{{0, 0, 0, 0}, {1, 1, 1, 1}},
+				Outputs: [][]float64{{1}, {0}},
+			}
+			n2.Validation = neural.Dataset{
+				Inputs:  [][]float64{{0, 0, 0, 0}},
+				Outputs: [][]float64{{1}},
+			}
+
+			// Under the shared default key, or its own, the server could read each answer
+			require.Error(t, server.StartEvaluation(neural.Classification))
+			holder := node.Create()
+			holder.Participants = server.Participants
+			holder.KeyHolder = true
+			require.Error(t, holder.StartEvaluation(neural.Classification))
+			require.NoError(t, setup(&server))
+			time.Sleep(time.Millisecond * 500)
+
+			err := server.StartEvaluation(neural.Classification)
+			require.NoError(t, err)
+			time.Sleep(time.Millisecond * 500)
+
+			require.Equal(t, 1, len(server.FederatedEvaluations))
+			metrics := server.FederatedEvaluations[0]
+			require.Equal(t, 3, metrics.Samples)
+
+			// Same as evaluating both datasets in one place
+			sums1, _ := n1.EvaluateSums(neural.Dataset{Inputs: n1.Validation.Inputs, Outputs: n1.Validation.Outputs, Task: neural.Classification})
+			sums2, _ := n2.EvaluateSums(neural.Dataset{Inputs: n2.Validation.Inputs, Outputs: n2.Validation.Outputs, Task: neural.Classification})
+			sums1.Add(sums2)
+			require.Equal(t, sums1.Metrics().ConfusionMatrix, metrics.ConfusionMatrix)
+			require.InDelta(t, sums1.Metrics().Loss, metrics.Loss, 1e-4)
+		})
+	}
+}
+
+func Test_CheckpointAndResume(t *testing.T) {
+	dir := t.TempDir()
+	server := node.Create()
+	server.CheckpointDir = dir
+	server.CheckpointEvery = 1
+	server.Start()
+	n1 := node.Create()
+	n1.Start()
+	n2 := node.Create()
+	n2.Start()
+	n1.Join(server.Socket.GetAddress())
+	n2.Join(server.Socket.GetAddress())
+	time.Sleep(time.Millisecond * 100)
+
+	n1.SendWeights(server.Socket.GetAddress(), false)
+	n2.SendWeights(server.Socket.GetAddress(), false)
+	time.Sleep(time.Millisecond * 200)
+	require.Equal(t, 1, server.Round)
+
+	checkpoint, err := node.LatestCheckpoint(dir)
+	require.NoError(t, err)
+	require.Equal(t, 1, checkpoint.Round)
+	require.Equal(t, 2, len(checkpoint.Participants))
+
+	// Server crashes, a new process resumes with its identity
+	resumed := node.Create()
+	resumed.Socket.SetIdentity(server.Socket.IdentityKey())
+	resumed.Start()
+	err = resumed.Resume(dir)
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond * 100)
+
+	require.Equal(t, 1, resumed.Round)
+	require.Equal(t, server.Participants, resumed.Participants)
+	require.Equal(t, server.GetWeights(), resumed.GetWeights())
+	require.NotNil(t, resumed.Server.Aggregate)
+	require.Equal(t, resumed.Socket.GetAddress(), n1.ServerAddress)
+	require.Equal(t, resumed.Socket.GetAddress(), n2.ServerAddress)
+
+	// Federation continues with the next round
+	n1.SendWeights(n1.ServerAddress, false)
+	n2.SendWeights(n2.ServerAddress, false)
+	time.Sleep(time.Millisecond * 200)
+	require.Equal(t, 2, resumed.Round)
+	require.Equal(t, 2, len(n1.GetPacketsByType(transport.Result)))
+
+	_, err = node.LatestCheckpoint(t.TempDir())
+	require.Error(t, err)
+
+	// The state of the server optimizer is checkpointed
+	momentum := node.Create()
+	momentum.CheckpointDir = t.TempDir()
+	optimizer := &neural.FedAvgM{LearningRate: 1, Momentum: 0.5}
+	optimizer.Step([]float64{1, 2}, []float64{0.5, 0.5})
+	momentum.ServerOptimizer = optimizer
+	require.NoError(t, momentum.SaveCheckpoint())
+	restarted := node.Create()
+	require.Error(t, restarted.Resume(momentum.CheckpointDir))
+	restored := &neural.FedAvgM{LearningRate: 1, Momentum: 0.5}
+	restarted.ServerOptimizer = restored
+	require.NoError(t, restarted.Resume(momentum.CheckpointDir))
+	require.Equal(t, optimizer.State(), restored.State())
+}
+
+func Test_ServerChoosesEncoding(t *testing.T) {
+	server := node.Create()
+	require.NoError(t, server.Client.SetEncoding(encryption.SlotsEncoding, 11))
+	server.Start()
+	n1 := node.Create()
+	n1.Start()
+	n2 := node.Create()
+	n2.Start()
+	n1.Join(server.Socket.GetAddress())
+	n2.Join(server.Socket.GetAddress())
+	time.Sleep(time.Millisecond * 100)
+
+	require.Equal(t, encryption.SlotsEncoding, n1.Client.Encoding)
+	require.Equal(t, 11, n2.Client.LogSlots)
+
+	w1 := n1.GetWeights()
+	w2 := n2.GetWeights()
+	n1.SendWeights(server.Socket.GetAddress(), false)
+	n2.SendWeights(server.Socket.GetAddress(), false)
+	time.Sleep(time.Millisecond * 200)
+
+	require.Equal(t, 1, len(n1.GetPacketsByType(transport.Result)))
+	for i, w := range n1.GetWeights() {
+		require.InDelta(t, (w1[i]+w2[i])/2, w, 1e-5)
+	}
+}
+
+func Test_CollectiveKeyGeneration(t *testing.T) {
+	server := node.Create()
+	server.Start()
+	clients := make([]*node.Node, 3)
+	for i := range clients {
+		n := node.Create()
+		clients[i] = &n
+		clients[i].Start()
+		clients[i].Join(server.Socket.GetAddress())
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	err := server.StartKeyGeneration()
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond * 500)
+
+	pk := server.KeyGeneration.PublicKey
+	require.NotNil(t, pk)
+	for _, c := range clients {
+		require.True(t, pk.Equals(c.Client.PublicKey))
+	}
+
+	// Encrypted under the collective key, decryptable by the sum of the shares only
+	params := server.Server.Params
+	sk := ckks.NewSecretKey(params)
+	for _, c := range clients {
+		params.RingQP().AddLvl(params.QCount()-1, params.PCount()-1, sk.Value, c.Client.SecretKey.Value, sk.Value)
+	}
+	values := []float64{0.5, -1.25, 3}
+	vector := clients[0].EncryptVector(values)
+
+	decryptor := encryption.Client{Params: params, Encoder: ckks.NewEncoder(params), Decryptor: ckks.NewDecryptor(params, sk)}
+	decrypted, err := decryptor.DecryptVector(vector)
+	require.NoError(t, err)
+	for i := range values {
+		require.InDelta(t, values[i], decrypted[i], 1e-5)
+	}
+
+	alone, err := clients[1].DecryptVector(vector)
+	require.NoError(t, err)
+	require.Greater(t, math.Abs(alone[0]-values[0]), 1.0)
+
+	// Only the server can have the key shares drawn again
+	share := clients[0].Client.SecretKey
+	request := transport.Packet{
+		Source:      clients[1].Socket.GetAddress(),
+		Destination: clients[0].Socket.GetAddress(),
+		Message:     server.GetPacketsByType(transport.KeyGenShare)[0].Message,
+		Type:        transport.KeyGenRequest,
+	}
+	require.NoError(t, request.Sign(clients[1].Socket.IdentityKey()))
+	require.Error(t, clients[0].OnReceive(request))
+	require.Equal(t, share, clients[0].Client.SecretKey)
+}
+
+func Test_ThresholdDecryptionRound(t *testing.T) {
+	server := node.Create()
+	server.Start()
+	server.Threshold = 2
+	clients := make([]*node.Node, 3)
+	for i := range clients {
+		n := node.Create()
+		clients[i] = &n
+		clients[i].Start()
+		clients[i].Join(server.Socket.GetAddress())
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	require.NoError(t, server.StartKeyGeneration())
+	time.Sleep(time.Millisecond * 500)
+	require.NoError(t, server.StartThresholdSetup())
+	time.Sleep(time.Second * 2)
+	require.True(t, server.ThresholdReady())
+	for _, c := range clients {
+		require.NotNil(t, c.Client.ThresholdKey)
+	}
+
+	expected := make([]float64, len(clients[0].NeuralNetwork.Weights))
+	for _, c := range clients {
+		for i, w := range c.NeuralNetwork.Weights {
+			expected[i] += w / float64(len(clients))
+		}
+		require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+	}
+	time.Sleep(time.Second * 2)
+
+	// Only the first two contributors were asked for a share
+	asked := 0
+	for _, c := range clients {
+		asked += len(c.GetPacketsByType(transport.DecryptionRequest))
+	}
+	require.Equal(t, 2, asked)
+
+	for _, c := range clients {
+		require.Equal(t, 1, c.Rounds)
+		for i := range expected {
+			require.InDelta(t, expected[i], c.NeuralNetwork.Weights[i], 1e-3)
+		}
+	}
+
+	// A member of the set offline, ignoring the server from now on, is
+	// replaced by another contributor
+	offline := clients[0]
+	offline.Identities[server.Socket.GetAddress()] = clients[1].Identity()
+	require.NoError(t, offline.SendWeights(server.Socket.GetAddress(), false))
+	time.Sleep(time.Millisecond * 200)
+	for _, c := range clients[1:] {
+		require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+	}
+	time.Sleep(time.Second)
+	for _, c := range clients[1:] {
+		require.Equal(t, 1, c.Rounds)
+	}
+	require.NoError(t, server.RetryDecryption())
+	time.Sleep(time.Second)
+	for _, c := range clients[1:] {
+		require.Equal(t, 2, c.Rounds)
+	}
+	require.Error(t, server.RetryDecryption())
+
+	// Participants only release what they contributed to, one vector per round
+	request := func(id string, vector string, contributors ...string) transport.Packet {
+		msg, err := json.Marshal(map[string]interface{}{
+			"Vector":       vector,
+			"Contributors": contributors,
+		})
+		require.NoError(t, err)
+		pkt := transport.Packet{
+			Source:      server.Socket.GetAddress(),
+			Destination: clients[1].Socket.GetAddress(),
+			Message:     string(msg),
+			Type:        transport.DecryptionRequest,
+			ID:          id,
+		}
+		require.NoError(t, pkt.Sign(server.Socket.IdentityKey()))
+		return pkt
+	}
+	answered := func(pkt transport.Packet) bool {
+		before := len(server.GetPacketsByType(transport.DecryptionShare))
+		clients[1].OnReceive(pkt)
+		time.Sleep(time.Millisecond * 200)
+		return len(server.GetPacketsByType(transport.DecryptionShare)) > before
+	}
+	self := clients[1].Socket.GetAddress()
+	single := encryption.MarshalToBase64String(clients[2].EncryptVector(clients[2].NeuralNetwork.Weights))
+	other := encryption.MarshalToBase64String(clients[2].EncryptVector([]float64{1}))
+	require.False(t, answered(request("1", single, self)))
+	require.NoError(t, clients[1].SendWeights(server.Socket.GetAddress(), false))
+	require.False(t, answered(request("2", single, clients[2].Socket.GetAddress())))
+	require.True(t, answered(request("2", single, self)))
+	require.True(t, answered(request("2", single, self)))
+	require.False(t, answered(request("2", other, self)))
+}
+
+func Test_DistributedPublicKey(t *testing.T) {
+	server := node.Create()
+	server.Start()
+	clients := make([]*node.Node, 2)
+	for i := range clients {
+		n := node.Create()
+		clients[i] = &n
+		clients[i].Start()
+		clients[i].Join(server.Socket.GetAddress())
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// A participant can't make another drop its key
+	forged := transport.Packet{
+		Source:      clients[1].Socket.GetAddress(),
+		Destination: clients[0].Socket.GetAddress(),
+		Message:     encryption.MarshalToBase64String(clients[1].Client.GenKeyPair()),
+		Type:        transport.PublicKey,
+	}
+	require.NoError(t, forged.Sign(clients[1].Socket.IdentityKey()))
+	require.Error(t, clients[0].OnReceive(forged))
+	require.NotNil(t, clients[0].Client.SecretKey)
+
+	require.NoError(t, server.DistributePublicKey())
+	time.Sleep(time.Millisecond * 500)
+	for _, c := range clients {
+		require.Nil(t, c.Client.SecretKey)
+		require.True(t, server.Client.PublicKey.Equals(c.Client.PublicKey))
+	}
+
+	expected := make([]float64, len(clients[0].NeuralNetwork.Weights))
+	for _, c := range clients {
+		for i, w := range c.NeuralNetwork.Weights {
+			expected[i] += w / float64(len(clients))
+		}
+		require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+	}
+	time.Sleep(time.Second)
+
+	for _, c := range clients {
+		require.Equal(t, 1, c.Rounds)
+		for i := range expected {
+			require.InDelta(t, expected[i], c.NeuralNetwork.Weights[i], 1e-3)
+		}
+	}
+}
+
+func Test_ServerAdvertisesParameters(t *testing.T) {
+	params, err := encryption.SelectParameters(encryption.Requirements{Weights: 25, Precision: 4, Participants: 2, Multiplications: 1})
+	require.NoError(t, err)
+	require.False(t, params.Equals(encryption.DefaultParameters()))
+
+	server := node.CreateWithParameters(params)
+	server.Start()
+	client := node.Create()
+	client.Start()
+	client.Join(server.Socket.GetAddress())
+	time.Sleep(time.Millisecond * 100)
+
+	require.True(t, params.Equals(client.Client.Params))
+	weights := client.NeuralNetwork.GetWeights()
+	require.NoError(t, client.SendWeights(server.Socket.GetAddress(), false))
+	time.Sleep(time.Millisecond * 500)
+	require.Equal(t, 1, client.Rounds)
+	for i := range weights {
+		require.InDelta(t, weights[i], client.NeuralNetwork.Weights[i], 1e-4)
+	}
+}
+
+func Test_NodeKeystore(t *testing.T) {
+	// First run: the keys of the federation are stored, and the node
+	// takes part in rounds next to the others after a restart
+	path := filepath.Join(t.TempDir(), "participant.keys")
+	_, err := node.CreateWithKeystore(path, nil)
+	require.NoError(t, err)
+	participant, err := node.CreateWithKeystore(path, nil)
+	require.NoError(t, err)
+	require.True(t, participant.Client.SecretKey.Value.Equals(ckks.NewSecretKey(participant.Client.Params).Value))
+
+	server := node.Create()
+	server.Start()
+	other := node.Create()
+	clients := []*node.Node{&participant, &other}
+	for _, c := range clients {
+		c.Start()
+		c.Join(server.Socket.GetAddress())
+	}
+	time.Sleep(time.Millisecond * 100)
+	expected := make([]float64, len(other.NeuralNetwork.Weights))
+	for i, c := range clients {
+		for j := range c.NeuralNetwork.Weights {
+			c.NeuralNetwork.Weights[j] = float64(i + 1)
+			expected[j] += float64(i+1) / 2
+		}
+		require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+	}
+	time.Sleep(time.Millisecond * 300)
+	for _, c := range clients {
+		require.Equal(t, 1, c.Rounds)
+		for j := range expected {
+			require.InDelta(t, expected[j], c.NeuralNetwork.Weights[j], 1e-3)
+		}
+	}
+
+	// A key pair of its own, stored once generated
+	path = filepath.Join(t.TempDir(), "server.keys")
+	n, err := node.CreateWithKeystore(path, []byte("passphrase"))
+	require.NoError(t, err)
+	n.Client.GenKeyPair()
+	require.NoError(t, n.SaveKeys(path, []byte("passphrase")))
+	v := n.Client.EncryptVector([]float64{1, 2, 3})
+
+	// Same identity after a restart
+	restarted, err := node.CreateWithKeystore(path, []byte("passphrase"))
+	require.NoError(t, err)
+	require.True(t, n.Client.PublicKey.Equals(restarted.Client.PublicKey))
+	require.Equal(t, n.Identity(), restarted.Identity())
+	decrypted, err := restarted.Client.DecryptVector(v)
+	require.NoError(t, err)
+	require.InDelta(t, 2, decrypted[1], 1e-5)
+
+	_, err = node.CreateFromKeystore(path, []byte("wrong"))
+	require.Error(t, err)
+}
+
+func Test_DebugPrecision(t *testing.T) {
+	server := node.Create()
+	server.Start()
+	client := node.Create()
+	client.Debug = true
+	client.Start()
+	client.Join(server.Socket.GetAddress())
+	time.Sleep(time.Millisecond * 100)
+
+	require.NoError(t, client.SendWeights(server.Socket.GetAddress(), false))
+	time.Sleep(time.Millisecond * 500)
+
+	require.Equal(t, 1, client.Rounds)
+	require.Equal(t, 2, len(client.Precisions))
+	sent, aggregate := client.Precisions[0], client.Precisions[1]
+	require.Equal(t, len(client.NeuralNetwork.Weights), len(sent.Errors))
+	require.Greater(t, sent.MinPrecision, 15.0)
+	require.Nil(t, aggregate.Errors)
+	require.False(t, aggregate.TooTight())
+}
+
+func Test_DeltaUploads(t *testing.T) {
+	// Without seed, participants don't start from the server's model
+	server := node.Create()
+	server.Start()
+	client := node.Create()
+	client.Start()
+	client.Join(server.Socket.GetAddress())
+	time.Sleep(time.Millisecond * 100)
+	require.Error(t, client.SendDelta(server.Socket.GetAddress()))
+
+	for _, optimizer := range []neural.ServerOptimizer{nil, &neural.FedAvgM{LearningRate: 1, Momentum: 0.5}} {
+		server := node.Create()
+		server.Seed = 7
+		server.ServerOptimizer = optimizer
+		server.Start()
+		clients := make([]*node.Node, 2)
+		for i := range clients {
+			n := node.Create()
+			clients[i] = &n
+			clients[i].Start()
+			clients[i].Join(server.Socket.GetAddress())
+		}
+		time.Sleep(time.Millisecond * 100)
+
+		// Everybody starts from the server's model
+		global := server.NeuralNetwork.GetWeights()
+		for _, c := range clients {
+			require.Equal(t, global, c.GlobalWeights)
+		}
+
+		// The server decrypts the average delta for its optimizer
+		if optimizer != nil {
+			require.NoError(t, server.DistributePublicKey())
+			time.Sleep(time.Millisecond * 100)
+		}
+
+		velocity := 0.0
+		for round := 1; round <= 2; round++ {
+			// Local training moves each weight by +0.1 and +0.3
+			for i, c := range clients {
+				for j := range c.NeuralNetwork.Weights {
+					c.NeuralNetwork.Weights[j] += 0.1 + 0.2*float64(i)
+				}
+				require.NoError(t, c.SendDelta(server.Socket.GetAddress()))
+			}
+			time.Sleep(time.Millisecond * 500)
+
+			step := 0.2
+			if optimizer != nil {
+				velocity = 0.5*velocity + 0.2
+				step = velocity
+			}
+			for j := range global {
+				global[j] += step
+			}
+			for _, c := range clients {
+				require.Equal(t, round, c.Rounds)
+				require.InDeltaSlice(t, global, c.NeuralNetwork.Weights, 1e-3)
+				require.Equal(t, c.NeuralNetwork.Weights, c.GlobalWeights)
+			}
+		}
+	}
+}
+
+func Test_MaskedAggregationRound(t *testing.T) {
+	server := node.Create()
+	server.Aggregation = node.MaskedAggregation
+	server.Threshold = 2
+	server.Start()
+	clients := make([]*node.Node, 3)
+	for i := range clients {
+		n := node.Create()
+		clients[i] = &n
+		// The last client is driven by hand to drop when needed
+		if i < 2 {
+			clients[i].Start()
+		}
+		clients[i].Join(server.Socket.GetAddress())
+	}
+	dropping := clients[2]
+	receive := func(count int) {
+		for i := 0; i < count; i++ {
+			pkt, err := dropping.Socket.Recv()
+			require.NoError(t, err)
+			dropping.OnReceive(pkt)
+		}
+	}
+	// Parameters
+	receive(1)
+	time.Sleep(time.Millisecond * 100)
+	for _, c := range clients {
+		require.Equal(t, node.MaskedAggregation, c.Aggregation)
+	}
+
+	// Secrets sharing: request, keys, shares
+	for round := 1; round <= 2; round++ {
+		require.NoError(t, server.StartMaskedRound())
+		receive(3)
+		time.Sleep(time.Millisecond * 200)
+		for _, c := range clients {
+			require.True(t, c.MaskedReady())
+		}
+
+		// First round, the last client drops after uploading its weights.
+		// Second round, before.
+		uploading := clients
+		if round == 2 {
+			uploading = clients[:2]
+		}
+		expected := make([]float64, len(clients[0].NeuralNetwork.Weights))
+		for _, c := range uploading {
+			for i, w := range c.NeuralNetwork.Weights {
+				expected[i] += w / float64(len(uploading))
+			}
+			require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+		}
+		if round == 2 {
+			time.Sleep(time.Millisecond * 100)
+			require.NoError(t, server.CloseMaskedInputs())
+		}
+		time.Sleep(time.Millisecond * 500)
+
+		for _, c := range clients[:2] {
+			require.Equal(t, round, c.Rounds)
+			require.InDeltaSlice(t, expected, c.NeuralNetwork.Weights, 1e-6)
+		}
+		// The server only saw masked weights
+		require.Empty(t, server.Pending)
+
+		if round == 1 {
+			// Left unanswered, the server doesn't know the client dropped
+			for _, expected := range []string{transport.UnmaskRequest, transport.MaskedResult} {
+				pkt, err := dropping.Socket.Recv()
+				require.NoError(t, err)
+				require.Equal(t, expected, pkt.Type)
+			}
+		}
+	}
+	require.Equal(t, 2, server.Round)
+	require.Equal(t, 0, dropping.Rounds)
+
+	// Third round, the last client drops before advertising its keys.
+	// Fourth round, before sharing its secrets.
+	for round := 3; round <= 4; round++ {
+		require.NoError(t, server.StartMaskedRound())
+		if round == 3 {
+			_, err := dropping.Socket.Recv()
+			require.NoError(t, err)
+		} else {
+			receive(1)
+		}
+		time.Sleep(time.Millisecond * 200)
+		if round == 3 {
+			require.Error(t, server.CloseMaskingShares())
+			require.NoError(t, server.CloseMaskingKeys())
+		} else {
+			// Keys of all, the broadcast is left unanswered
+			pkt, err := dropping.Socket.Recv()
+			require.NoError(t, err)
+			require.Equal(t, transport.MaskingKeys, pkt.Type)
+			time.Sleep(time.Millisecond * 200)
+			require.Error(t, server.CloseMaskingKeys())
+			require.NoError(t, server.CloseMaskingShares())
+		}
+		time.Sleep(time.Millisecond * 200)
+
+		expected := make([]float64, len(clients[0].NeuralNetwork.Weights))
+		for _, c := range clients[:2] {
+			require.True(t, c.MaskedReady())
+			for i, w := range c.NeuralNetwork.Weights {
+				expected[i] += w / 2
+			}
+			require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+		}
+		time.Sleep(time.Millisecond * 500)
+		for _, c := range clients[:2] {
+			require.Equal(t, round, c.Rounds)
+			require.InDeltaSlice(t, expected, c.NeuralNetwork.Weights, 1e-6)
+		}
+	}
+	require.Equal(t, 4, server.Round)
+}
+
+// Keeps the contribution of the first participant
+type firstAggregator struct {
+	first transport.Packet
+	count int
+	total int
+}
+
+func (a *firstAggregator) Begin(round int, participants []string) error {
+	a.count = 0
+	a.total = len(participants)
+	return nil
+}
+
+func (a *firstAggregator) Add(pkt transport.Packet) (bool, error) {
+	if a.count == 0 {
+		a.first = pkt
+	}
+	a.count++
+	return a.count == a.total, nil
+}
+
+func (a *firstAggregator) Finalize() (*node.RoundResult, error) {
+	return &node.RoundResult{Type: transport.PlainResult, Message: a.first.Message, Recipients: []string{a.first.Source}}, nil
+}
+
+func Test_Aggregators(t *testing.T) {
+	server := node.Create()
+	server.Aggregation = node.PlaintextAggregation
+	server.Start()
+	clients := make([]*node.Node, 2)
+	for i := range clients {
+		n := node.Create()
+		clients[i] = &n
+		clients[i].Start()
+		clients[i].Join(server.Socket.GetAddress())
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// A round that fails to aggregate starts over
+	server.AggregationRule = neural.Krum{Byzantine: 1}
+	for _, c := range clients {
+		require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+	}
+	time.Sleep(time.Millisecond * 200)
+	require.Empty(t, server.Pending)
+	require.Zero(t, server.Round)
+	server.AggregationRule = nil
+
+	// One contribution per participant, of the length of the others
+	require.NoError(t, clients[0].SendWeights(server.Socket.GetAddress(), false))
+	require.NoError(t, clients[0].SendWeights(server.Socket.GetAddress(), false))
+	short := transport.Packet{
+		Source:      clients[1].Socket.GetAddress(),
+		Destination: server.Socket.GetAddress(),
+		Message:     "[1,2]",
+		Type:        transport.PlainWeights,
+	}
+	require.NoError(t, clients[1].Socket.Send(server.Socket.GetAddress(), short))
+	time.Sleep(time.Millisecond * 200)
+	require.Len(t, server.Pending, 1)
+	require.Zero(t, server.Round)
+
+	// Weights in clear
+	expected := make([]float64, len(clients[0].NeuralNetwork.Weights))
+	for _, c := range clients {
+		require.Equal(t, node.PlaintextAggregation, c.Aggregation)
+		for i, w := range c.NeuralNetwork.Weights {
+			expected[i] += w / float64(len(clients))
+		}
+		require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+	}
+	time.Sleep(time.Millisecond * 200)
+	for _, c := range clients {
+		require.Equal(t, 1, c.Rounds)
+		require.InDeltaSlice(t, expected, c.NeuralNetwork.Weights, 1e-12)
+	}
+	require.InDeltaSlice(t, expected, server.NeuralNetwork.Weights, 1e-12)
+	require.Empty(t, server.Pending)
+
+	// Deltas in clear
+	for i, c := range clients {
+		for j := range c.NeuralNetwork.Weights {
+			c.NeuralNetwork.Weights[j] += 0.1 + 0.2*float64(i)
+		}
+		require.NoError(t, c.SendDelta(server.Socket.GetAddress()))
+	}
+	time.Sleep(time.Millisecond * 200)
+	for i := range expected {
+		expected[i] += 0.2
+	}
+	for _, c := range clients {
+		require.Equal(t, 2, c.Rounds)
+		require.InDeltaSlice(t, expected, c.NeuralNetwork.Weights, 1e-12)
+	}
+
+	// Custom aggregator
+	server.Aggregator = &firstAggregator{}
+	for _, c := range clients {
+		require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+		time.Sleep(time.Millisecond * 50)
+	}
+	time.Sleep(time.Millisecond * 200)
+	require.Equal(t, 3, clients[0].Rounds)
+	require.Equal(t, 2, clients[1].Rounds)
+	require.Equal(t, 3, server.Round)
+
+	_, err := node.NewAggregator(&server, "unknown")
+	require.Error(t, err)
+}
+
+func Test_LocalDifferentialPrivacy(t *testing.T) {
+	server := node.Create()
+	server.Aggregation = node.PlaintextAggregation
+	server.Start()
+	client := node.Create()
+	client.Start()
+	client.Join(server.Socket.GetAddress())
+	time.Sleep(time.Millisecond * 100)
+
+	dp, err := privacy.NewLocalDP(privacy.Config{NormBound: 0.5, NoiseMultiplier: 0.01, Epsilon: 1e4, Delta: 1e-5})
+	require.NoError(t, err)
+	client.Privacy = dp
+
+	// The update of norm 5 is clipped to 0.5
+	global := client.GetWeights()
+	for i := range client.NeuralNetwork.Weights {
+		client.NeuralNetwork.Weights[i] += 1
+	}
+	require.NoError(t, client.SendWeights(server.Socket.GetAddress(), false))
+	time.Sleep(time.Millisecond * 200)
+	require.Equal(t, 1, client.Rounds)
+	update := make([]float64, len(global))
+	for i := range global {
+		update[i] = client.NeuralNetwork.Weights[i] - global[i]
+	}
+	require.InDelta(t, 0.5, privacy.Norm(update), 0.1)
+
+	// A second update would exceed the budget
+	require.Equal(t, privacy.ErrBudgetExhausted, client.SendWeights(server.Socket.GetAddress(), false))
+	require.Equal(t, privacy.ErrBudgetExhausted, client.SendDelta(server.Socket.GetAddress()))
+	require.Equal(t, 1, dp.Accountant.Steps)
+}
+
+func Test_CentralDifferentialPrivacy(t *testing.T) {
+	config := privacy.CentralConfig{NormBound: 1, NoiseMultiplier: 0.01, Delta: 1e-5}
+	server := node.Create()
+	server.Seed = 3
+	dp, err := privacy.NewCentralDP(config)
+	require.NoError(t, err)
+	server.CentralPrivacy = dp
+	server.Start()
+	clients := make([]*node.Node, 2)
+	for i := range clients {
+		n := node.Create()
+		clients[i] = &n
+		clients[i].CentralPrivacy, err = privacy.NewCentralDP(config)
+		require.NoError(t, err)
+		clients[i].Start()
+		clients[i].Join(server.Socket.GetAddress())
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// Updates of norm 0.5 and 1.5, the second one is clipped
+	global := server.GetWeights()
+	for i, c := range clients {
+		for j := range c.NeuralNetwork.Weights {
+			c.NeuralNetwork.Weights[j] += 0.1 + 0.2*float64(i)
+		}
+		require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+	}
+	time.Sleep(time.Millisecond * 500)
+
+	clipped := 1 / math.Sqrt(float64(len(global)))
+	for _, c := range clients {
+		require.Equal(t, 1, c.Rounds)
+		for j := range global {
+			// Noise of standard deviation 0.005
+			require.InDelta(t, global[j]+(0.1+clipped)/2, c.NeuralNetwork.Weights[j], 0.03)
+		}
+	}
+	epsilon, _ := dp.Guarantee()
+	require.Equal(t, 1, dp.Accountant.Steps)
+	require.Greater(t, epsilon, 0.0)
+}
+
+func Test_ByzantineParticipant(t *testing.T) {
+	server := node.Create()
+	server.Seed = 5
+	server.Aggregation = node.PlaintextAggregation
+	server.AggregationRule = neural.TrimmedMean{Byzantine: 1}
+	server.Start()
+	clients := make([]*node.Node, 4)
+	for i := range clients {
+		n := node.Create()
+		clients[i] = &n
+		clients[i].Start()
+		clients[i].Join(server.Socket.GetAddress())
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// An update of the wrong length is left out, not the round
+	short := transport.Packet{
+		Source:      clients[0].Socket.GetAddress(),
+		Destination: server.Socket.GetAddress(),
+		Message:     "[1e6]",
+		Type:        transport.PlainWeights,
+	}
+	require.NoError(t, clients[0].Socket.Send(server.Socket.GetAddress(), short))
+	time.Sleep(time.Millisecond * 100)
+	require.Empty(t, server.Pending)
+
+	global := server.GetWeights()
+	for i, c := range clients {
+		for j := range c.NeuralNetwork.Weights {
+			if i == 0 {
+				// Poisoned
+				c.NeuralNetwork.Weights[j] = 1e6
+			} else {
+				c.NeuralNetwork.Weights[j] += 0.1
+			}
+		}
+		require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+	}
+	time.Sleep(time.Millisecond * 300)
+	for _, c := range clients {
+		require.Equal(t, 1, c.Rounds)
+		for j := range global {
+			require.InDelta(t, global[j]+0.1, c.NeuralNetwork.Weights[j], 1e-9)
+		}
+	}
+
+	// Rules need the updates in clear
+	encrypted := node.Create()
+	encrypted.AggregationRule = neural.CoordinateMedian{}
+	a, err := node.NewAggregator(&encrypted, node.CKKSAggregation)
+	require.NoError(t, err)
+	require.Error(t, a.Begin(0, []string{"a"}))
+}
+
+func Test_NormBounding(t *testing.T) {
+	for _, collective := range []bool{false, true} {
+		server := node.Create()
+		server.Replay = node.NewReplayCache(0)
+		server.Start()
+		clients := make([]*node.Node, 3)
+		for i := range clients {
+			n := node.Create()
+			clients[i] = &n
+			clients[i].Start()
+			clients[i].Join(server.Socket.GetAddress())
+		}
+		time.Sleep(time.Millisecond * 100)
+		length := len(clients[0].NeuralNetwork.Weights)
+		server.NormBound = math.Sqrt(float64(length))
+
+		if collective {
+			require.Error(t, server.StartNormKeyGeneration())
+			require.NoError(t, server.StartKeyGeneration())
+			time.Sleep(time.Millisecond * 500)
+			require.NoError(t, server.StartNormKeyGeneration())
+			// About 40 MB of shares per participant
+			time.Sleep(time.Second * 15)
+			require.True(t, server.Server.NormKeyGeneration.Done)
+		} else {
+			// Only the key holder decrypts the norms
+			require.NoError(t, server.DistributePublicKey())
+			time.Sleep(time.Millisecond * 100)
+		}
+
+		// Every contribution above the bound: the round fails, and starts over
+		for _, c := range clients {
+			for j := range c.NeuralNetwork.Weights {
+				c.NeuralNetwork.Weights[j] = 10
+			}
+			require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+		}
+		time.Sleep(time.Second * 2)
+		require.Equal(t, 0, server.Round, collective)
+		require.Empty(t, server.Pending, collective)
+		for _, c := range clients {
+			require.Equal(t, 1, len(c.GetPacketsByType(transport.RoundFailed)), collective)
+			require.Equal(t, 0, c.Rounds, collective)
+		}
+
+		expected := make([]float64, length)
+		for i, c := range clients {
+			for j := range c.NeuralNetwork.Weights {
+				if i == 0 {
+					// Norm 10 times the bound
+					c.NeuralNetwork.Weights[j] = 10
+				} else {
+					c.NeuralNetwork.Weights[j] = 0.1 * float64(i)
+					expected[j] += c.NeuralNetwork.Weights[j] / 2
+				}
+			}
+			require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+		}
+		time.Sleep(time.Second * 2)
+
+		for _, c := range clients {
+			require.Equal(t, 1, c.Rounds, collective)
+			for j := range expected {
+				require.InDelta(t, expected[j], c.NeuralNetwork.Weights[j], 1e-3, collective)
+			}
+		}
+	}
+}
+
+func Test_SignedPackets(t *testing.T) {
+	server := node.Create()
+	server.Start()
+	client := node.Create()
+	client.Start()
+	client.Join(server.Socket.GetAddress())
+	time.Sleep(time.Millisecond * 100)
+	require.Equal(t, client.Identity(), server.Identities[client.Socket.GetAddress()])
+	require.Equal(t, server.Identity(), client.Identities[server.Socket.GetAddress()])
+
+	// Tampered packets don't verify
+	pkt := transport.Packet{Source: client.Socket.GetAddress(), Destination: server.Socket.GetAddress(), Message: "weights", Type: transport.EncryptedChunk}
+	require.NoError(t, pkt.Sign(client.Socket.IdentityKey()))
+	require.NoError(t, pkt.Verify())
+	tampered := pkt
+	tampered.Message = "poisoned"
+	require.Error(t, tampered.Verify())
+	require.Error(t, server.OnReceive(tampered))
+
+	// Another host pretending to be the participant, in a single fragment
+	spoofer := node.Create()
+	spoofed := transport.Packet{
+		Source:      client.Socket.GetAddress(),
+		Destination: server.Socket.GetAddress(),
+		Message:     "poisoned",
+		Type:        transport.EncryptedChunk,
+	}
+	require.NoError(t, spoofer.Socket.Send(server.Socket.GetAddress(), spoofed))
+	spoofer.Socket.SetIdentity(nil)
+	require.NoError(t, spoofer.Socket.Send(server.Socket.GetAddress(), spoofed))
+	time.Sleep(time.Millisecond * 100)
+	require.Empty(t, server.GetPacketsByType(transport.EncryptedChunk))
+	require.Empty(t, server.Pending)
+
+	// Another host signing with its own identity: an unknown source for the
+	// server, not the server for the participant
+	stranger := node.Create()
+	upload := transport.Packet{Source: stranger.Socket.GetAddress(), Destination: server.Socket.GetAddress(), Message: "weights", Type: transport.EncryptedChunk}
+	require.NoError(t, upload.Sign(stranger.Socket.IdentityKey()))
+	require.Error(t, server.OnReceive(upload))
+	for _, typ := range []string{transport.Result, transport.PublicKey, transport.KeyGenRequest, transport.DecryptionRequest, transport.Evaluate} {
+		forged := transport.Packet{Source: stranger.Socket.GetAddress(), Destination: client.Socket.GetAddress(), Message: "forged", Type: typ}
+		require.NoError(t, forged.Sign(stranger.Socket.IdentityKey()))
+		require.Error(t, client.OnReceive(forged))
+
+		// Even from the address of the server
+		forged.Source = server.Socket.GetAddress()
+		require.NoError(t, forged.Sign(stranger.Socket.IdentityKey()))
+		require.Error(t, client.OnReceive(forged))
+		forged.Signer, forged.Signature = nil, nil
+		require.Error(t, client.OnReceive(forged))
+	}
+	require.NotNil(t, client.Client.SecretKey)
+	require.Empty(t, client.GetPacketsByType(transport.Result))
+
+	// Unsolicited acks, signed or not, are dropped without blocking the server
+	for i := 0; i < 3; i++ {
+		ack := transport.Packet{Source: spoofer.Socket.GetAddress(), Destination: server.Socket.GetAddress(), Message: transport.EncryptedChunk + "//0", Type: transport.Ack}
+		require.NoError(t, spoofer.Socket.Send(server.Socket.GetAddress(), ack))
+		ack.Source = stranger.Socket.GetAddress()
+		require.NoError(t, stranger.Socket.Send(server.Socket.GetAddress(), ack))
+	}
+
+	// The participant itself is accepted
+	require.NoError(t, client.SendWeights(server.Socket.GetAddress(), false))
+	time.Sleep(time.Millisecond * 200)
+	require.Equal(t, 1, server.Round)
+}
+
+func Test_EncryptedChannels(t *testing.T) {
+	server := node.Create()
+	server.Socket.SetEncrypted(true)
+	server.Start()
+	clients := make([]*node.Node, 2)
+	for i := range clients {
+		n := node.Create()
+		clients[i] = &n
+		clients[i].Socket.SetEncrypted(true)
+		clients[i].Start()
+		require.NoError(t, clients[i].Join(server.Socket.GetAddress()))
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// Identities proven by the handshake
+	for _, c := range clients {
+		require.Equal(t, c.Identity(), server.Socket.PeerIdentity(c.Socket.GetAddress()))
+		require.Equal(t, server.Identity(), c.Socket.PeerIdentity(server.Socket.GetAddress()))
+		require.Equal(t, 1, len(c.GetPacketsByType(transport.Params)))
+	}
+
+	// A round of fragmented packets
+	for _, c := range clients {
+		require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+	}
+	time.Sleep(time.Millisecond * 300)
+	require.Equal(t, 1, server.Round)
+	for _, c := range clients {
+		require.Equal(t, 1, c.Rounds)
+	}
+
+	// Packets in clear are rejected
+	plain := node.Create()
+	plain.Start()
+	require.NoError(t, plain.Join(server.Socket.GetAddress()))
+	time.Sleep(time.Millisecond * 100)
+	require.Equal(t, 2, len(server.Participants))
+	require.Nil(t, server.Socket.PeerIdentity(plain.Socket.GetAddress()))
+
+	// Signed by another identity than that of the channel, or without channel
+	for _, source := range []string{clients[0].Socket.GetAddress(), plain.Socket.GetAddress()} {
+		forged := transport.Packet{Source: source, Destination: server.Socket.GetAddress(), Type: transport.Join}
+		require.NoError(t, forged.Sign(plain.Socket.IdentityKey()))
+		require.Error(t, server.OnReceive(forged))
+	}
+	require.Equal(t, 2, len(server.Participants))
+
+	// Encrypting needs an identity
+	anonymous := node.Create()
+	anonymous.Socket.SetIdentity(nil)
+	anonymous.Socket.SetEncrypted(true)
+	require.Error(t, anonymous.Join(server.Socket.GetAddress()))
+}
+
+func Test_AdmissionControl(t *testing.T) {
+	server := node.Create()
+	server.Start()
+	nodes := make([]*node.Node, 7)
+	for i := range nodes {
+		n := node.Create()
+		nodes[i] = &n
+		nodes[i].Start()
+	}
+	address := func(i int) string { return nodes[i].Socket.GetAddress() }
+	server.Admission = &node.Admission{
+		Addresses:       []string{address(0), address(3)},
+		Identities:      []ed25519.PublicKey{nodes[1].Identity()},
+		MaxParticipants: 4,
+		Approve: func(req node.JoinRequest) error {
+			if req.Address == address(3) {
+				return errors.New("banned")
+			}
+			return nil
+		},
+	}
+	invitation, err := server.Admission.Invite(time.Minute)
+	require.NoError(t, err)
+	expired, err := server.Admission.Invite(-time.Second)
+	require.NoError(t, err)
+
+	join := func(i int, token string) {
+		require.NoError(t, nodes[i].JoinWithInvitation(server.Socket.GetAddress(), token))
+		time.Sleep(time.Millisecond * 50)
+	}
+	rejection := func(i int) string {
+		rejected := nodes[i].GetPacketsByType(transport.JoinRejected)
+		if len(rejected) == 0 {
+			return ""
+		}
+		return rejected[0].Message
+	}
+	join(0, "")         // by address
+	join(1, "")         // by identity
+	join(2, "")         // not listed
+	join(3, "")         // refused by the callback
+	join(4, expired)    // expired invitation
+	join(5, invitation) // invited
+	join(6, invitation) // invitation already used
+	require.Equal(t, []string{address(0), address(1), address(5)}, server.Participants)
+	for _, i := range []int{0, 1, 5} {
+		require.Empty(t, rejection(i))
+		require.Equal(t, 1, len(nodes[i].GetPacketsByType(transport.Params)))
+	}
+	require.Contains(t, rejection(2), "not allowed")
+	require.Contains(t, rejection(3), "banned")
+	require.Contains(t, rejection(4), "invalid or expired")
+	require.Contains(t, rejection(6), "invalid or expired")
+	require.Empty(t, nodes[2].GetPacketsByType(transport.Params))
+
+	// Up to the maximum
+	invitation, err = server.Admission.Invite(time.Minute)
+	require.NoError(t, err)
+	join(2, invitation)
+	require.Equal(t, 4, len(server.Participants))
+	invitation, err = server.Admission.Invite(time.Minute)
+	require.NoError(t, err)
+	join(4, invitation)
+	require.Contains(t, nodes[4].GetPacketsByType(transport.JoinRejected)[1].Message, "full")
+	require.Equal(t, 4, len(server.Participants))
+
+	// Joining again gets the parameters, once a participant
+	join(0, "")
+	require.Equal(t, 4, len(server.Participants))
+	require.Equal(t, 2, len(nodes[0].GetPacketsByType(transport.Params)))
+
+	// Not with another identity, nor the identity of another participant
+	forged := transport.Packet{Source: address(0), Destination: server.Socket.GetAddress(), Type: transport.Join}
+	require.NoError(t, forged.Sign(nodes[6].Socket.IdentityKey()))
+	require.Error(t, server.OnReceive(forged))
+	forged.Source = address(6)
+	require.NoError(t, forged.Sign(nodes[1].Socket.IdentityKey()))
+	require.Error(t, server.OnReceive(forged))
+	require.Equal(t, 4, len(server.Participants))
+	require.Equal(t, nodes[0].Identity(), server.Identities[address(0)])
+}
+
+func Test_ReplayProtection(t *testing.T) {
+	server := node.Create()
+	server.Replay = node.NewReplayCache(0)
+	server.Start()
+	clients := make([]*node.Node, 2)
+	for i := range clients {
+		n := node.Create()
+		clients[i] = &n
+		clients[i].Start()
+		require.NoError(t, clients[i].Join(server.Socket.GetAddress()))
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// Uploads are bound to the round of the server and a fresh nonce
+	require.NoError(t, clients[0].SendWeights(server.Socket.GetAddress(), false))
+	time.Sleep(time.Millisecond * 200)
+	captured := server.GetPacketsByType(transport.EncryptedChunk)[0]
+	require.Equal(t, 0, captured.Round)
+	require.Equal(t, node.NonceSize, len(captured.Nonce))
+
+	// Resent within the round, or a second contribution to it
+	require.Error(t, server.OnReceive(captured))
+	second := captured
+	second.Nonce = []byte("0123456789abcdef")
+	require.NoError(t, second.Sign(clients[0].Socket.IdentityKey()))
+	require.Error(t, server.OnReceive(second))
+	require.Equal(t, 1, len(server.Pending))
+	require.Equal(t, 0, server.Round)
+
+	require.NoError(t, clients[1].SendWeights(server.Socket.GetAddress(), false))
+	time.Sleep(time.Millisecond * 200)
+	require.Equal(t, 1, server.Round)
+	for _, c := range clients {
+		require.Equal(t, 1, c.ServerRound)
+	}
+
+	// Resent in a later round
+	require.Error(t, server.OnReceive(captured))
+	require.Empty(t, server.Pending)
+
+	// Ahead of the server, or without nonce, even when signed by the participant
+	future := captured
+	future.Round = 5
+	future.Nonce = []byte("0123456789abcdef")
+	require.NoError(t, future.Sign(clients[0].Socket.IdentityKey()))
+	require.Error(t, server.OnReceive(future))
+	unbound := captured
+	unbound.Round = 1
+	unbound.Nonce = nil
+	require.NoError(t, unbound.Sign(clients[0].Socket.IdentityKey()))
+	require.Error(t, server.OnReceive(unbound))
+	require.Empty(t, server.Pending)
+
+	// The next round goes through
+	for _, c := range clients {
+		require.NoError(t, c.SendWeights(server.Socket.GetAddress(), false))
+	}
+	time.Sleep(time.Millisecond * 300)
+	require.Equal(t, 2, server.Round)
+
+	// Late contributions within the window aren't aggregated
+	server.Replay.Window = 1
+	late := captured
+	late.Round = 1
+	late.Nonce = []byte("fedcba9876543210")
+	require.NoError(t, late.Sign(clients[0].Socket.IdentityKey()))
+	require.Error(t, server.OnReceive(late))
+	require.Empty(t, server.Pending)
+
+	cache := node.NewReplayCache(1)
+	nonce := []byte("fedcba9876543210")
+	require.NoError(t, cache.Check("a", 3, nonce, 4))
+	require.Error(t, cache.Check("a", 4, nonce, 4))
+	require.NoError(t, cache.Check("b", 4, nonce, 4))
+	require.Error(t, cache.Check("a", 2, []byte("0123456789abcdef"), 4))
+
+	// Contributing again once the round is forgotten, with a fresh nonce
+	require.Error(t, cache.Check("b", 4, []byte("0123456789abcdef"), 4))
+	cache.Forget("b", 4)
+	require.Error(t, cache.Check("b", 4, nonce, 4))
+	require.NoError(t, cache.Check("b", 4, []byte("0123456789abcdef"), 4))
+}
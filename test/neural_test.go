@@ -0,0 +1,191 @@
+package test
+
+import (
+	"encoding/json"
+	"federated/neural"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_EvaluateClassification(t *testing.T) {
+	nn := neural.CreateNetwork(2, 1, 1, 2, 0.01)
+	nn.AllocateWeights()
+	// hidden = (x0, x1), output = sigmoid(10*h0 - 10*h1)
+	nn.SetWeight(0, 0, 0, 10)
+	nn.SetWeight(0, 1, 1, 10)
+	nn.SetWeight(1, 0, 0, 10)
+	nn.SetWeight(1, 1, 0, -10)
+
+	dataset := neural.Dataset{
+		Inputs:  [][]float64{{1, 0}, {0, 1}, {1, 0}, {0, 1}},
+		Outputs: [][]float64{{1}, {0}, {0}, {0}},
+		Task:    neural.Classification,
+	}
+	metrics, err := nn.Evaluate(dataset)
+	require.NoError(t, err)
+
+	require.Equal(t, 4, metrics.Samples)
+	require.Equal(t, [][]int{{2, 1}, {0, 1}}, metrics.ConfusionMatrix)
+	require.InDelta(t, 0.75, metrics.Accuracy, 1e-9)
+	require.InDelta(t, 0.5, metrics.Precision, 1e-9)
+	require.InDelta(t, 1, metrics.Recall, 1e-9)
+	require.InDelta(t, 2.0/3.0, metrics.F1, 1e-9)
+	require.Greater(t, metrics.Loss, 0.0)
+
+	// Sums of two halves give the same metrics
+	sums1, err := nn.EvaluateSums(neural.Dataset{Inputs: dataset.Inputs[:2], Outputs: dataset.Outputs[:2], Task: neural.Classification})
+	require.NoError(t, err)
+	sums2, err := nn.EvaluateSums(neural.Dataset{Inputs: dataset.Inputs[2:], Outputs: dataset.Outputs[2:], Task: neural.Classification})
+	require.NoError(t, err)
+	sums1.Add(sums2)
+	merged := sums1.Metrics()
+	require.Equal(t, metrics.ConfusionMatrix, merged.ConfusionMatrix)
+	require.InDelta(t, metrics.Loss, merged.Loss, 1e-9)
+}
+
+func Test_EvaluateRegression(t *testing.T) {
+	nn := neural.CreateNetwork(1, 1, 1, 1, 0.01)
+	nn.AllocateWeights()
+	// output is always sigmoid(0) = 0.5
+	dataset := neural.Dataset{
+		Inputs:  [][]float64{{1}, {2}},
+		Outputs: [][]float64{{0.25}, {0.75}},
+		Task:    neural.Regression,
+	}
+	metrics, err := nn.Evaluate(dataset)
+	require.NoError(t, err)
+	require.InDelta(t, 0.0625, metrics.MSE, 1e-9)
+	require.InDelta(t, 0.25, metrics.MAE, 1e-9)
+	require.InDelta(t, 0, metrics.R2, 1e-9)
+	require.InDelta(t, metrics.MSE, metrics.Loss, 1e-9)
+
+	_, err = nn.Evaluate(neural.Dataset{Inputs: [][]float64{{1}}, Outputs: [][]float64{{1}}})
+	require.Error(t, err)
+}
+
+func Test_SaveLoadModel(t *testing.T) {
+	nn := neural.CreateNetwork(4, 2, 2, 3, 0.05)
+	nn.ActivationFunction = neural.ReluFunc
+	nn.Initialization = neural.HeNormalInit
+	nn.Rounds = 7
+	nn.InitiateWeightsFromSeed(3)
+
+	dir := t.TempDir()
+	for _, format := range []string{neural.JSONFormat, neural.BinaryFormat} {
+		path := filepath.Join(dir, "model."+format)
+		err := nn.Save(path, format)
+		require.NoError(t, err)
+
+		loaded, err := neural.Load(path)
+		require.NoError(t, err)
+		require.Equal(t, nn, loaded)
+	}
+
+	// Weights not matching the architecture are refused
+	data, err := nn.MarshalJSON()
+	require.NoError(t, err)
+	file := neural.ModelFile{}
+	require.NoError(t, json.Unmarshal(data, &file))
+	file.Weights = file.Weights[1:]
+	data, _ = json.Marshal(file)
+	path := filepath.Join(dir, "broken.json")
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+	_, err = neural.Load(path)
+	require.Error(t, err)
+
+	// So are invalid dimensions, before anything is allocated
+	for _, dims := range [][2]int{{-1, 3}, {0, 3}, {4, 1 << 40}} {
+		file.Weights = make([]float64, 23)
+		file.InputDimensions, file.NbNeurons = dims[0], dims[1]
+		data, _ = json.Marshal(file)
+		require.NoError(t, ioutil.WriteFile(path, data, 0644))
+		_, err = neural.Load(path)
+		require.Error(t, err)
+	}
+
+	// Truncated binary files too
+	data, _ = nn.MarshalBinary()
+	loaded := neural.NeuralNetwork{}
+	require.Error(t, loaded.UnmarshalBinary(data[:len(data)-10]))
+	require.Error(t, nn.Save(path, "xml"))
+}
+
+func Test_ServerOptimizers(t *testing.T) {
+	global := []float64{1, -1}
+	delta := []float64{0.5, -0.25}
+
+	fedAvg := &neural.FedAvg{LearningRate: 1}
+	require.Equal(t, []float64{1.5, -1.25}, fedAvg.Step(global, delta))
+
+	// Momentum accumulates the deltas
+	fedAvgM := &neural.FedAvgM{LearningRate: 1, Momentum: 0.5}
+	step1 := fedAvgM.Step(global, delta)
+	require.Equal(t, []float64{1.5, -1.25}, step1)
+	step2 := fedAvgM.Step(step1, delta)
+	require.InDeltaSlice(t, []float64{2.25, -1.625}, step2, 1e-12)
+
+	// Restored from its state, as from a checkpoint
+	restored := &neural.FedAvgM{LearningRate: 1, Momentum: 0.5}
+	require.NoError(t, restored.SetState(fedAvgM.State()))
+	require.Equal(t, fedAvgM.Step(step2, delta), restored.Step(step2, delta))
+	require.Error(t, restored.SetState(nil))
+
+	// Adam moves every weight by about the learning rate, whatever the delta
+	fedAdam := &neural.FedAdam{LearningRate: 0.01, Beta1: 0.9, Beta2: 0.99, Epsilon: 1e-8}
+	step := fedAdam.Step(global, delta)
+	require.Greater(t, step[0], global[0])
+	require.Less(t, step[1], global[1])
+	require.InDelta(t, math.Abs(step[0]-global[0]), math.Abs(step[1]-global[1]), 1e-6)
+}
+
+func Test_RobustAggregation(t *testing.T) {
+	honest := [][]float64{{1, 2}, {1.1, 2.1}, {0.9, 1.9}, {1, 2.2}, {1.05, 1.8}}
+	poisoned := append(append([][]float64{}, honest...), []float64{1000, -1000})
+
+	mean, err := neural.Mean{}.Aggregate(poisoned)
+	require.NoError(t, err)
+	require.Greater(t, math.Abs(mean[0]), 100.0)
+
+	rules := []neural.AggregationRule{
+		neural.CoordinateMedian{},
+		neural.TrimmedMean{Byzantine: 1},
+		neural.Krum{Byzantine: 1},
+		neural.Krum{Byzantine: 1, Selected: 3},
+		neural.GeometricMedian{},
+	}
+	for _, rule := range rules {
+		res, err := rule.Aggregate(poisoned)
+		require.NoError(t, err)
+		require.InDelta(t, 1, res[0], 0.1, "%T", rule)
+		require.InDelta(t, 2, res[1], 0.2, "%T", rule)
+	}
+
+	// A single huge update doesn't throw the geometric median off
+	huge := append(append([][]float64{}, honest...), []float64{1e200, 1e200})
+	geometric, err := neural.GeometricMedian{}.Aggregate(huge)
+	require.NoError(t, err)
+	require.InDelta(t, 1, geometric[0], 0.1)
+	require.InDelta(t, 2, geometric[1], 0.2)
+
+	median, err := neural.CoordinateMedian{}.Aggregate([][]float64{{1}, {3}, {10}, {2}})
+	require.NoError(t, err)
+	require.Equal(t, []float64{2.5}, median)
+	trimmed, err := neural.TrimmedMean{Byzantine: 1}.Aggregate([][]float64{{1}, {3}, {10}, {2}})
+	require.NoError(t, err)
+	require.Equal(t, []float64{2.5}, trimmed)
+	krum, err := neural.Krum{Byzantine: 1}.Aggregate(poisoned)
+	require.NoError(t, err)
+	require.Contains(t, honest, krum)
+
+	// Too many Byzantine participants assumed
+	_, err = neural.TrimmedMean{Byzantine: 3}.Aggregate(poisoned)
+	require.Error(t, err)
+	_, err = neural.Krum{Byzantine: 2}.Aggregate(poisoned)
+	require.Error(t, err)
+	_, err = neural.CoordinateMedian{}.Aggregate([][]float64{{1}, {1, 2}})
+	require.Error(t, err)
+}
@@ -0,0 +1,161 @@
+package test
+
+import (
+	"federated/privacy"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Clip(t *testing.T) {
+	require.InDeltaSlice(t, []float64{0.6, 0.8}, privacy.Clip([]float64{3, 4}, 1), 1e-12)
+	require.Equal(t, []float64{0.3, 0.4}, privacy.Clip([]float64{0.3, 0.4}, 1))
+	require.Equal(t, 5.0, privacy.Norm([]float64{3, 4}))
+}
+
+func Test_Accountant(t *testing.T) {
+	a := privacy.NewAccountant()
+	require.InDelta(t, math.Log(1e5)/255, a.Epsilon(1e-5), 1e-9)
+
+	// Gaussian with sigma = sensitivity: alpha / 2 per release, best at order 6
+	a.Spend(privacy.Gaussian, 1)
+	require.InDelta(t, 3+math.Log(1e5)/5, a.Epsilon(1e-5), 1e-9)
+	require.True(t, a.Allows(privacy.Gaussian, 1, 8, 1e-5))
+	require.False(t, a.Allows(privacy.Gaussian, 1, 7.5, 1e-5))
+	a.Spend(privacy.Gaussian, 1)
+	require.Equal(t, 2, a.Steps)
+
+	// Laplace tends to pure epsilon-DP, 1 / noise multiplier
+	for _, alpha := range privacy.Orders {
+		require.LessOrEqual(t, privacy.RDP(privacy.Laplace, 2, alpha), 0.5)
+	}
+	require.InDelta(t, 0.5, privacy.RDP(privacy.Laplace, 2, 1000), 1e-3)
+}
+
+func Test_LocalDP(t *testing.T) {
+	_, err := privacy.NewLocalDP(privacy.Config{NormBound: 1, NoiseMultiplier: 1, Epsilon: 1})
+	require.Error(t, err)
+	_, err = privacy.NewLocalDP(privacy.Config{Mechanism: "other", NormBound: 1, NoiseMultiplier: 1, Epsilon: 1, Delta: 1e-5})
+	require.Error(t, err)
+
+	update := make([]float64, 10000)
+	for i := range update {
+		update[i] = 1
+	}
+	for _, mechanism := range []string{privacy.Gaussian, privacy.Laplace} {
+		dp, err := privacy.NewLocalDPWithSeed(privacy.Config{
+			Mechanism:       mechanism,
+			NormBound:       10,
+			NoiseMultiplier: 0.01,
+			Epsilon:         1e9,
+			Delta:           1e-5,
+		}, 1)
+		require.NoError(t, err)
+		noisy, err := dp.Privatize(update)
+		require.NoError(t, err)
+
+		// Clipped to norm 10, each value is 0.1 plus noise of the
+		// sensitivity 20 of a replaced update
+		mean := 0.0
+		for _, x := range noisy {
+			mean += x / float64(len(noisy))
+		}
+		sigma := 0.2
+		if mechanism == privacy.Laplace {
+			// Scale sqrt(d) times larger, standard deviation sqrt(2) times the scale
+			sigma = 0.2 * 100 * math.Sqrt2
+		}
+		require.InDelta(t, 0.1, mean, 4*sigma/100)
+		require.InDelta(t, sigma, stddev(noisy), sigma*0.05)
+		require.Equal(t, 1, dp.Accountant.Steps)
+
+		// On the grid, no low-order bits of floating-point samples
+		for _, x := range noisy[:100] {
+			require.Equal(t, math.Round(x/privacy.DefaultGranularity), x/privacy.DefaultGranularity)
+		}
+	}
+
+	// Refuses once the budget is exhausted
+	dp, err := privacy.NewLocalDP(privacy.Config{NormBound: 1, NoiseMultiplier: 1, Epsilon: 6, Delta: 1e-5})
+	require.NoError(t, err)
+	_, err = dp.Privatize([]float64{1, 2})
+	require.NoError(t, err)
+	_, err = dp.Privatize([]float64{1, 2})
+	require.Equal(t, privacy.ErrBudgetExhausted, err)
+	require.Equal(t, 1, dp.Accountant.Steps)
+	require.InDelta(t, 5.3, dp.Spent(), 0.01)
+}
+
+func Test_CentralDP(t *testing.T) {
+	_, err := privacy.NewCentralDP(privacy.CentralConfig{Mode: privacy.DistributedNoise, NormBound: 1, NoiseMultiplier: 1, Delta: 1e-5})
+	require.Error(t, err)
+	_, err = privacy.NewCentralDP(privacy.CentralConfig{NormBound: 1, NoiseMultiplier: 1})
+	require.Error(t, err)
+
+	// Distributed: the shares of 4 participants add up to the noise of the sum
+	config := privacy.CentralConfig{Mode: privacy.DistributedNoise, NormBound: 1, NoiseMultiplier: 0.5, Delta: 1e-5, Participants: 4}
+	update := make([]float64, 5000)
+	sum := make([]float64, len(update))
+	for p := 0; p < 4; p++ {
+		dp, err := privacy.NewCentralDPWithSeed(config, int64(p))
+		require.NoError(t, err)
+		share := dp.Prepare(update)
+		for i, x := range share {
+			// Multiples of the granularity
+			require.Equal(t, math.Round(x/privacy.DefaultGranularity)*privacy.DefaultGranularity, x)
+			sum[i] += x
+		}
+		require.Equal(t, make([]float64, 10), dp.Noise(10, 4))
+	}
+	require.InDelta(t, 0.5, stddev(sum), 0.025)
+
+	// Server: noise of an average of 4 clipped updates
+	config.Mode = privacy.ServerNoise
+	dp, err := privacy.NewCentralDPWithSeed(config, 1)
+	require.NoError(t, err)
+	require.InDeltaSlice(t, []float64{0.6, 0.8}, dp.Prepare([]float64{3, 4}), 1e-12)
+	require.InDelta(t, 0.5/4, stddev(dp.Noise(5000, 4)), 0.01)
+
+	// Drawn from crypto/rand, on the grid
+	random, err := privacy.NewCentralDP(config)
+	require.NoError(t, err)
+	noise := random.Noise(5000, 4)
+	require.InDelta(t, 0.5/4, stddev(noise), 0.01)
+	for _, x := range noise[:100] {
+		require.Equal(t, math.Round(x/privacy.DefaultGranularity)*privacy.DefaultGranularity, x)
+	}
+
+	// Guarantee of the whole run
+	dp.Spend(4)
+	dp.Spend(2)
+	epsilon, delta := dp.Guarantee()
+	require.Equal(t, 1e-5, delta)
+	a := privacy.NewAccountant()
+	a.Spend(privacy.Gaussian, 0.5)
+	a.Spend(privacy.Gaussian, 0.5)
+	require.Equal(t, a.Epsilon(1e-5), epsilon)
+
+	// Distributed: 2 contributors of 4 only add half the variance
+	config.Mode = privacy.DistributedNoise
+	dp, err = privacy.NewCentralDPWithSeed(config, 1)
+	require.NoError(t, err)
+	dp.Spend(4)
+	dp.Spend(2)
+	epsilon, _ = dp.Guarantee()
+	a = privacy.NewAccountant()
+	a.Spend(privacy.Gaussian, 0.5)
+	a.Spend(privacy.Gaussian, 0.5/math.Sqrt2)
+	require.InDelta(t, a.Epsilon(1e-5), epsilon, 1e-9)
+}
+
+func stddev(values []float64) float64 {
+	mean, variance := 0.0, 0.0
+	for _, x := range values {
+		mean += x / float64(len(values))
+	}
+	for _, x := range values {
+		variance += (x - mean) * (x - mean) / float64(len(values))
+	}
+	return math.Sqrt(variance)
+}
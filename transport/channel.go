@@ -0,0 +1,498 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted channels, once enabled with SetEncrypted: on first contact with
+// a peer, a Noise-style handshake agrees on keys from ephemeral X25519 keys,
+// each side proving its Ed25519 identity by signing the transcript:
+//
+//	-> HandshakeInit:     id, e_i
+//	<- HandshakeResponse: id, e_r, AEAD(identity_r, sign_r(h))
+//	-> HandshakeFinish:   id, AEAD(identity_i, sign_i(h))
+//
+// h hashing id, e_i and e_r. Datagrams are then sealed with ChaCha20-Poly1305,
+// one key per direction, and the socket only accepts sealed ones.
+//
+// A peer handshaking again, after a restart, replaces its session. When two
+// peers initiate at once, the handshake of lower id goes on, the other
+// initiator answering it instead.
+
+// Time a handshake can take before Send gives up
+const HandshakeTimeout = 2 * time.Second
+
+// First byte of sealed datagrams, JSON ones starting with '{'
+const sealedMarker = 0x01
+
+const (
+	handshakeContext = "federated/transport handshake v1"
+	sessionIDSize    = 8
+	counterSize      = 8
+	sealedHeaderSize = 1 + sessionIDSize + counterSize
+	replayWindow     = 64
+	maxResponding    = 1024 // handshakes waiting for their finish
+)
+
+// Handshakes and sessions of a socket, shared by its copies
+type channels struct {
+	sync.Mutex
+	sessions   map[uint64]*session   // established, by id
+	peers      map[string]*session   // to send with, by address
+	initiated  map[string]*handshake // by address
+	responding map[uint64]*handshake // waiting for the finish, by id, expiring
+}
+
+// Keys agreed with a peer of verified identity
+type session struct {
+	id          uint64
+	peer        string
+	identity    ed25519.PublicKey
+	send        cipher.AEAD
+	recv        cipher.AEAD
+	established time.Time
+
+	mutex   sync.Mutex
+	counter uint64 // of the datagrams sent
+	highest uint64 // counter received
+	seen    uint64 // bitmap of the counters below highest
+}
+
+type handshake struct {
+	id         uint64
+	peer       string
+	ephemeral  []byte // private
+	transcript []byte // h
+	keys       handshakeKeys
+	done       chan struct{} // closed once session or err is set
+	session    *session
+	err        error
+	started    time.Time
+}
+
+type handshakeKeys struct {
+	initiator, responder     cipher.AEAD // of the handshake messages
+	toResponder, toInitiator cipher.AEAD
+}
+
+func newChannels() *channels {
+	return &channels{
+		sessions:   make(map[uint64]*session),
+		peers:      make(map[string]*session),
+		initiated:  make(map[string]*handshake),
+		responding: make(map[uint64]*handshake),
+	}
+}
+
+// SetEncrypted makes the socket run a handshake on first contact with each
+// peer, then seal every datagram, and reject those not sealed
+func (s *Socket) SetEncrypted(encrypted bool) {
+	s.encrypted = encrypted
+}
+
+// Encrypted returns whether the socket only exchanges sealed datagrams
+func (s *Socket) Encrypted() bool {
+	return s.encrypted
+}
+
+// PeerIdentity returns the identity the peer at address proved during the
+// handshake, nil without an encrypted channel
+func (s *Socket) PeerIdentity(address string) ed25519.PublicKey {
+	s.channels.Lock()
+	defer s.channels.Unlock()
+	if sess, ok := s.channels.peers[address]; ok {
+		return sess.identity
+	}
+	return nil
+}
+
+// Returns the session with dest, running the handshake if there is none
+func (s *Socket) session(dest string, addr net.Addr) (*session, error) {
+	if s.identity == nil {
+		return nil, errors.New("[transport.Socket.Send]: an identity is needed to encrypt")
+	}
+	c := s.channels
+	c.Lock()
+	if sess, ok := c.peers[dest]; ok {
+		c.Unlock()
+		return sess, nil
+	}
+	hs, started := c.initiated[dest]
+	if !started {
+		var err error
+		hs, err = newHandshake(dest)
+		if err != nil {
+			c.Unlock()
+			return nil, err
+		}
+		c.initiated[dest] = hs
+	}
+	c.Unlock()
+
+	if !started {
+		public, err := curve25519.X25519(hs.ephemeral, curve25519.Basepoint)
+		if err == nil {
+			err = s.writeHandshake(addr, HandshakeInit, append(encodeID(hs.id), public...))
+		}
+		if err != nil {
+			s.endHandshake(hs, nil, err)
+		}
+	}
+	select {
+	case <-hs.done:
+	case <-time.After(HandshakeTimeout):
+		s.endHandshake(hs, nil, errors.New("[transport.Socket.Send]: handshake with "+dest+" timed out"))
+		<-hs.done
+	}
+	return hs.session, hs.err
+}
+
+// Completes an initiated handshake, once
+func (s *Socket) endHandshake(hs *handshake, sess *session, err error) {
+	c := s.channels
+	c.Lock()
+	defer c.Unlock()
+	if c.initiated[hs.peer] != hs {
+		return
+	}
+	delete(c.initiated, hs.peer)
+	if err == nil {
+		c.sessions[sess.id] = sess
+		c.setPeer(sess)
+	}
+	hs.session, hs.err = sess, err
+	close(hs.done)
+}
+
+// Makes sess the session to send to its peer with, evicting the previous
+// one. Locked by the caller.
+func (c *channels) setPeer(sess *session) {
+	if old, ok := c.peers[sess.peer]; ok && old != sess {
+		delete(c.sessions, old.id)
+	}
+	c.peers[sess.peer] = sess
+}
+
+// Drops the handshakes answered without finish in time, and the oldest
+// one to make room for another. Inits are unauthenticated: a handshake
+// of a peer is only dropped for another once finished, see
+// dropResponding. Locked by the caller.
+func (c *channels) expireResponding() {
+	var oldest *handshake
+	for id, hs := range c.responding {
+		if time.Since(hs.started) > HandshakeTimeout {
+			delete(c.responding, id)
+		} else if oldest == nil || hs.started.Before(oldest.started) {
+			oldest = hs
+		}
+	}
+	if len(c.responding) >= maxResponding {
+		delete(c.responding, oldest.id)
+	}
+}
+
+// Drops the handshakes answered to peer, once one is finished. Locked by
+// the caller.
+func (c *channels) dropResponding(peer string) {
+	for id, hs := range c.responding {
+		if hs.peer == peer {
+			delete(c.responding, id)
+		}
+	}
+}
+
+// Handles a handshake message received from addr, in the receiving loop
+func (s *Socket) onHandshake(pkt Packet, from string, addr net.Addr) error {
+	data, err := base64.StdEncoding.DecodeString(pkt.Message)
+	if err != nil || len(data) < sessionIDSize {
+		return errors.New("malformed handshake")
+	}
+	id := binary.BigEndian.Uint64(data)
+	data = data[sessionIDSize:]
+	c := s.channels
+
+	switch pkt.Type {
+	case HandshakeInit:
+		// Responder: sends its ephemeral key and proves its identity
+		if s.identity == nil {
+			return errors.New("no identity to answer the handshake")
+		}
+		if len(data) != curve25519.PointSize {
+			return errors.New("malformed handshake init")
+		}
+		c.Lock()
+		mine, initiating := c.initiated[from]
+		c.expireResponding()
+		_, answered := c.responding[id]
+		c.Unlock()
+		if initiating && mine.id < id {
+			// Answered by the peer instead
+			return errors.New("simultaneous handshake, ours goes on")
+		}
+		if answered {
+			return errors.New("handshake id already in use")
+		}
+		hs, err := newHandshake(from)
+		if err != nil {
+			return err
+		}
+		hs.id = id
+		public, err := curve25519.X25519(hs.ephemeral, curve25519.Basepoint)
+		if err != nil {
+			return err
+		}
+		err = hs.agree(data, data, public)
+		if err != nil {
+			return err
+		}
+		proof := hs.prove(s.identity, "responder", hs.keys.responder)
+		c.Lock()
+		c.responding[id] = hs
+		c.Unlock()
+		return s.writeHandshake(addr, HandshakeResponse, append(append(encodeID(id), public...), proof...))
+
+	case HandshakeResponse:
+		// Initiator: checks the identity of the responder, proves its own
+		c.Lock()
+		hs, ok := c.initiated[from]
+		c.Unlock()
+		if !ok || hs.id != id {
+			return errors.New("unexpected handshake response")
+		}
+		if len(data) < curve25519.PointSize {
+			return errors.New("malformed handshake response")
+		}
+		public, err := curve25519.X25519(hs.ephemeral, curve25519.Basepoint)
+		if err != nil {
+			return err
+		}
+		err = hs.agree(data[:curve25519.PointSize], public, data[:curve25519.PointSize])
+		if err != nil {
+			return err
+		}
+		identity, err := hs.verify(data[curve25519.PointSize:], "responder", hs.keys.responder)
+		if err != nil {
+			s.endHandshake(hs, nil, err)
+			return err
+		}
+		err = s.writeHandshake(addr, HandshakeFinish, append(encodeID(id), hs.prove(s.identity, "initiator", hs.keys.initiator)...))
+		if err != nil {
+			s.endHandshake(hs, nil, err)
+			return err
+		}
+		s.endHandshake(hs, newSession(id, from, identity, hs.keys.toResponder, hs.keys.toInitiator), nil)
+		return nil
+
+	case HandshakeFinish:
+		// Responder: checks the identity of the initiator
+		c.Lock()
+		hs, ok := c.responding[id]
+		c.Unlock()
+		if !ok || hs.peer != from {
+			return errors.New("unexpected handshake finish")
+		}
+		identity, err := hs.verify(data, "initiator", hs.keys.initiator)
+		if err != nil {
+			return err
+		}
+		sess := newSession(id, from, identity, hs.keys.toInitiator, hs.keys.toResponder)
+		c.Lock()
+		defer c.Unlock()
+		// Authenticated, the other handshakes answered to the peer are stale
+		c.dropResponding(from)
+		if old, ok := c.peers[from]; ok && old.established.After(hs.started) {
+			// Both initiated, the other session was established meanwhile
+			return nil
+		}
+		c.sessions[id] = sess
+		c.setPeer(sess)
+		// Our own initiation lost, Send goes on with this session
+		if mine, ok := c.initiated[from]; ok {
+			delete(c.initiated, from)
+			mine.session = sess
+			close(mine.done)
+		}
+		return nil
+	}
+	return errors.New("unknown handshake message " + pkt.Type)
+}
+
+func (s *Socket) writeHandshake(addr net.Addr, t string, message []byte) error {
+	pkt := Packet{
+		Source:      s.GetAddress(),
+		Destination: addr.String(),
+		Message:     base64.StdEncoding.EncodeToString(message),
+		Type:        t,
+	}
+	return s.write(addr, pkt, nil)
+}
+
+func newHandshake(peer string) (*handshake, error) {
+	hs := &handshake{peer: peer, ephemeral: make([]byte, curve25519.ScalarSize), done: make(chan struct{}), started: time.Now()}
+	var id [sessionIDSize]byte
+	_, err := io.ReadFull(rand.Reader, id[:])
+	if err == nil {
+		_, err = io.ReadFull(rand.Reader, hs.ephemeral)
+	}
+	hs.id = binary.BigEndian.Uint64(id[:])
+	return hs, err
+}
+
+// Derives the keys from the shared secret with the peer's ephemeral key
+func (hs *handshake) agree(peer []byte, initiator []byte, responder []byte) error {
+	shared, err := curve25519.X25519(hs.ephemeral, peer)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	h.Write([]byte(handshakeContext))
+	h.Write(encodeID(hs.id))
+	h.Write(initiator)
+	h.Write(responder)
+	hs.transcript = h.Sum(nil)
+
+	kdf := hkdf.New(sha256.New, shared, hs.transcript, []byte(handshakeContext))
+	aeads := make([]cipher.AEAD, 4)
+	for i := range aeads {
+		key := make([]byte, chacha20poly1305.KeySize)
+		_, err = io.ReadFull(kdf, key)
+		if err != nil {
+			return err
+		}
+		aeads[i], err = chacha20poly1305.New(key)
+		if err != nil {
+			return err
+		}
+	}
+	hs.keys = handshakeKeys{initiator: aeads[0], responder: aeads[1], toResponder: aeads[2], toInitiator: aeads[3]}
+	return nil
+}
+
+// Identity and signature of the transcript, encrypted
+func (hs *handshake) prove(identity ed25519.PrivateKey, role string, aead cipher.AEAD) []byte {
+	proof := append([]byte(identity.Public().(ed25519.PublicKey)), ed25519.Sign(identity, append([]byte(role), hs.transcript...))...)
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), proof, hs.transcript)
+}
+
+func (hs *handshake) verify(sealed []byte, role string, aead cipher.AEAD) (ed25519.PublicKey, error) {
+	proof, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed, hs.transcript)
+	if err != nil || len(proof) != ed25519.PublicKeySize+ed25519.SignatureSize {
+		return nil, errors.New("invalid " + role + " proof")
+	}
+	identity := ed25519.PublicKey(proof[:ed25519.PublicKeySize])
+	if !ed25519.Verify(identity, append([]byte(role), hs.transcript...), proof[ed25519.PublicKeySize:]) {
+		return nil, errors.New("invalid " + role + " signature")
+	}
+	return identity, nil
+}
+
+func newSession(id uint64, peer string, identity ed25519.PublicKey, send cipher.AEAD, recv cipher.AEAD) *session {
+	return &session{id: id, peer: peer, identity: identity, send: send, recv: recv, established: time.Now()}
+}
+
+// Seals a datagram: marker, session id and counter, authenticated
+func (sess *session) seal(plain []byte) []byte {
+	sess.mutex.Lock()
+	sess.counter++
+	counter := sess.counter
+	sess.mutex.Unlock()
+
+	header := make([]byte, sealedHeaderSize, sealedHeaderSize+len(plain)+sess.send.Overhead())
+	header[0] = sealedMarker
+	binary.BigEndian.PutUint64(header[1:], sess.id)
+	binary.BigEndian.PutUint64(header[1+sessionIDSize:], counter)
+	return sess.send.Seal(header, nonce(counter), plain, header)
+}
+
+// Opens a sealed datagram received from the address from
+func (s *Socket) open(data []byte, from string) (Packet, *session, error) {
+	if len(data) < sealedHeaderSize {
+		return Packet{}, nil, errors.New("malformed sealed datagram")
+	}
+	id := binary.BigEndian.Uint64(data[1:])
+	counter := binary.BigEndian.Uint64(data[1+sessionIDSize:])
+	s.channels.Lock()
+	sess, ok := s.channels.sessions[id]
+	s.channels.Unlock()
+	if !ok || sess.peer != from {
+		return Packet{}, nil, errors.New("no session")
+	}
+	header := data[:sealedHeaderSize]
+	plain, err := sess.recv.Open(nil, nonce(counter), data[sealedHeaderSize:], header)
+	if err != nil {
+		return Packet{}, nil, errors.New("invalid sealed datagram")
+	}
+	if !sess.accept(counter) {
+		return Packet{}, nil, errors.New("replayed datagram")
+	}
+	pkt := Packet{}
+	err = json.Unmarshal(plain, &pkt)
+	if err != nil {
+		return Packet{}, nil, err
+	}
+	if pkt.Source != sess.peer {
+		return Packet{}, nil, fmt.Errorf("source %s doesn't match the channel", pkt.Source)
+	}
+	if pkt.Signed() && !bytes.Equal(pkt.Signer, sess.identity) {
+		return Packet{}, nil, errors.New("signed by another identity than the channel's")
+	}
+	return pkt, sess, nil
+}
+
+// Accepts each counter once, within a window below the highest received
+func (sess *session) accept(counter uint64) bool {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+	switch {
+	case counter == 0:
+		return false
+	case counter > sess.highest:
+		shift := counter - sess.highest
+		if shift > replayWindow {
+			sess.seen = 0
+		} else {
+			sess.seen = sess.seen<<shift | 1<<(shift-1)
+		}
+		sess.highest = counter
+		return true
+	case sess.highest-counter > replayWindow:
+		return false
+	case counter == sess.highest:
+		return false
+	}
+	bit := uint64(1) << (sess.highest - counter - 1)
+	if sess.seen&bit != 0 {
+		return false
+	}
+	sess.seen |= bit
+	return true
+}
+
+func nonce(counter uint64) []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(n[chacha20poly1305.NonceSize-counterSize:], counter)
+	return n
+}
+
+func encodeID(id uint64) []byte {
+	b := make([]byte, sessionIDSize)
+	binary.BigEndian.PutUint64(b, id)
+	return b
+}
@@ -7,6 +7,14 @@ type Packet struct {
 	Type        string
 	ID          string
 	Params      Parameters
+
+	// Uploads, round of the server they are for and a fresh nonce
+	Round int    `json:",omitempty"`
+	Nonce []byte `json:",omitempty"`
+
+	// Ed25519 identity of the sender and its signature, see Sign
+	Signer    []byte `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
 }
 
 type Parameters struct {
@@ -18,16 +26,92 @@ type Parameters struct {
 	NbIterations       int
 	ActivationFunction string
 	BatchSize          int
+	Initialization     string
+	Seed               int64 // 0 -> clients draw their own initial weights
+	Encoding           string
+	LogSlots           int
+	CKKS               string // encryption parameters, base64
+	Aggregation        string // "" for CKKS, see node.NewAggregator
+	Round              int    // of the server, that uploads are for
 }
 
 const (
 	EncryptedChunk = "encryptedChunk"
+	EncryptedDelta = "encryptedDelta"
 	Ack            = "acknowlegdement"
 	Result         = "result"
 	Join           = "join"
+	JoinRejected   = "joinRejected" // with the reason
 	Params         = "params"
+	Resume         = "resume"
+	RoundFailed    = "roundFailed" // with the reason, contributions can be sent again
+
+	// Plaintext aggregation, for debugging
+	PlainWeights = "plainWeights"
+	PlainDelta   = "plainDelta"
+	PlainResult  = "plainResult"
+
+	// Evaluation rounds
+	Evaluate         = "evaluate"
+	EncryptedMetrics = "encryptedMetrics"
+
+	// Collective key generation
+	KeyGenRequest       = "keyGenRequest"
+	KeyGenShare         = "keyGenShare"
+	CollectivePublicKey = "collectivePublicKey"
+
+	// Collective generation of the keys computing norms
+	NormKeyRequest  = "normKeyRequest"
+	NormKeyShares   = "normKeyShares"
+	RelinKeyRequest = "relinKeyRequest"
+	RelinKeyShare   = "relinKeyShare"
+
+	// Public key of the party that decrypts
+	PublicKey = "publicKey"
+
+	// Collective decryption
+	ThresholdSetup    = "thresholdSetup"
+	SharingKey        = "sharingKey"
+	SharingKeys       = "sharingKeys"
+	SealedShares      = "sealedShares"
+	DecryptionRequest = "decryptionRequest"
+	DecryptionShare   = "decryptionShare"
+	DecryptedResult   = "decryptedResult"
+
+	// Secure aggregation by pairwise masking
+	MaskingRequest = "maskingRequest"
+	MaskingKeys    = "maskingKeys"
+	MaskingShares  = "maskingShares"
+	MaskedInput    = "maskedInput"
+	UnmaskRequest  = "unmaskRequest"
+	UnmaskShares   = "unmaskShares"
+	MaskedResult   = "maskedResult"
+
+	// Key exchange of encrypted channels, handled by the socket
+	HandshakeInit     = "handshakeInit"
+	HandshakeResponse = "handshakeResponse"
+	HandshakeFinish   = "handshakeFinish"
 )
 
+// Handshake returns whether packets of type t belong to the key exchange
+func Handshake(t string) bool {
+	return t == HandshakeInit || t == HandshakeResponse || t == HandshakeFinish
+}
+
+// Fragmented returns whether packets of type t can exceed the UDP size,
+// in which case they are sent in acknowledged fragments.
+func Fragmented(t string) bool {
+	switch t {
+	case EncryptedChunk, EncryptedDelta, Result, EncryptedMetrics, KeyGenShare, CollectivePublicKey, PublicKey,
+		NormKeyShares, RelinKeyRequest, RelinKeyShare,
+		SealedShares, DecryptionRequest, DecryptionShare, DecryptedResult,
+		MaskingKeys, MaskingShares, MaskedInput, UnmaskShares, MaskedResult,
+		PlainWeights, PlainDelta, PlainResult:
+		return true
+	}
+	return false
+}
+
 func (p *Packet) String() string {
 	return "[" + p.Source + "] -> [" + p.Destination + "], message=\"" + p.Message + "\""
 }
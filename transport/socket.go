@@ -1,25 +1,56 @@
 package transport
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 type Socket struct {
 	address    string
 	connection net.PacketConn
-	chanAck    chan bool
+	acks       *acks
+	partial    map[string][]string // fragments received so far, per message
+	identity   ed25519.PrivateKey  // signs the packets sent
+	encrypted  bool                // see SetEncrypted
+	channels   *channels
 }
 
+// CreateSocket returns a socket signing with a new identity
 func CreateSocket() (Socket, error) {
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return Socket{}, err
+	}
 	pktConn, err := net.ListenPacket("udp", "127.0.0.1:0")
 	if err != nil {
 		return Socket{}, err
 	}
-	return Socket{connection: pktConn, chanAck: make(chan bool, 1)}, nil
+	return Socket{connection: pktConn, acks: &acks{pending: make(map[string]chan struct{})}, partial: make(map[string][]string), identity: identity, channels: newChannels()}, nil
+}
+
+// SetIdentity makes the socket sign with key, a long-term identity
+func (s *Socket) SetIdentity(key ed25519.PrivateKey) {
+	s.identity = key
+}
+
+// IdentityKey returns the private key the socket signs with
+func (s *Socket) IdentityKey() ed25519.PrivateKey {
+	return s.identity
+}
+
+// Identity returns the public key identifying the socket
+func (s *Socket) Identity() ed25519.PublicKey {
+	if s.identity == nil {
+		return nil
+	}
+	return s.identity.Public().(ed25519.PublicKey)
 }
 
 func (s *Socket) Send(dest string, pkt Packet) error {
@@ -27,59 +58,72 @@ func (s *Socket) Send(dest string, pkt Packet) error {
 	if err != nil {
 		return err
 	}
+	var sess *session
+	if s.encrypted {
+		sess, err = s.session(addr.String(), addr)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Decompose packet
 	sendingPkt := Packet{
 		Source:      pkt.Source,
 		Destination: pkt.Destination,
 		Type:        pkt.Type,
+		ID:          pkt.ID,
+		Round:       pkt.Round,
+		Nonce:       pkt.Nonce,
 	}
-
-	// Prepare pkt according to type
-	switch pkt.Type {
-	case Ack:
-		sendingPkt.Message = pkt.Message
-	case Params:
+	if pkt.Type == Params {
 		sendingPkt.Params = pkt.Params
-	case EncryptedChunk, Result:
+	} else {
+		sendingPkt.Message = pkt.Message
+	}
+	// Signed as received once reassembled
+	if s.identity != nil {
+		err = sendingPkt.Sign(s.identity)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Fragments of at most 50000 bytes
+	if Fragmented(pkt.Type) {
 		i := 50000
 		for i < len(pkt.Message) {
 			sendingPkt.Message = pkt.Message[i-50000 : i]
 
-			// Marshal and send current packet
-			bytes, err := json.Marshal(sendingPkt)
-			if err != nil {
-				fmt.Println(err)
-				return err
-			}
-			n, err := s.connection.WriteTo(bytes, addr)
+			// Marshal and send current packet, expecting its ack
+			fragment := fragmentKey(pkt.Type, pkt.ID, i/50000-1)
+			acked := s.acks.expect(addr.String(), fragment)
+			err = s.write(addr, sendingPkt, sess)
 			if err != nil {
+				s.acks.cancel(addr.String(), fragment)
 				fmt.Println(err)
 				return err
 			}
-			if n < len(bytes) {
-				fmt.Println("[transport.Socket.Send]: not all bytes were written")
-				return errors.New("[transport.Socket.Send]: not all bytes were written")
-			}
 
 			i += 50000
 
 			// waits for ack before sending next packet
-			//time.Sleep(time.Millisecond * 10)
-			<-s.chanAck
-			// fmt.Println(b)
+			<-acked
 		}
 		// Marshal and send last packet
 		sendingPkt.Message = pkt.Message[i-50000:]
-
-	default:
-		sendingPkt.Message = pkt.Message
 	}
+	return s.write(addr, sendingPkt, sess)
+}
 
-	bytes, err := json.Marshal(sendingPkt)
+// Writes a single datagram, sealed if there is a session
+func (s *Socket) write(addr net.Addr, pkt Packet, sess *session) error {
+	bytes, err := json.Marshal(pkt)
 	if err != nil {
 		return err
 	}
+	if sess != nil {
+		bytes = sess.seal(bytes)
+	}
 	n, err := s.connection.WriteTo(bytes, addr)
 	if err != nil {
 		return err
@@ -91,90 +135,139 @@ func (s *Socket) Send(dest string, pkt Packet) error {
 }
 
 func (s *Socket) Recv() (Packet, error) {
-	var messageFull string
-
-	buffer := make([]byte, 65000)
-	n, _, err := s.connection.ReadFrom(buffer)
-	if err != nil {
-		fmt.Println(err)
-		return Packet{}, err
-	}
-	pkt := Packet{}
-	err = json.Unmarshal(buffer[0:n], &pkt)
-	if err != nil {
-		fmt.Println(err)
-		return Packet{}, err
-	}
-	messageFull += pkt.Message
-
-	switch pkt.Type {
-	case Ack:
-		s.chanAck <- true
-	case EncryptedChunk, Result:
-		count := 0
-		// send ack
-		pktAck := Packet{
-			Source:      s.GetAddress(),
-			Destination: pkt.Source,
-			Message:     strconv.Itoa(count),
-			Type:        Ack,
+	for {
+		// Reads up to 65000
+		// -> Sender needs to wait for acknowlegdement before sending next packets
+		buffer := make([]byte, 65000)
+		n, addr, err := s.connection.ReadFrom(buffer)
+		if err != nil {
+			fmt.Println(err)
+			return Packet{}, err
 		}
-		count += 1
-		s.Send(pkt.Source, pktAck)
-
-		currentSource := pkt.Source
-
-		// Waiting for other packets
-		for {
-			// Reads up to 65000
-			// -> Sender needs to wait for acknowlegdement before sending next packets
-			buffer := make([]byte, 65000)
-			n, _, err := s.connection.ReadFrom(buffer)
+		from := addr.String()
+		pkt := Packet{}
+		if n > 0 && buffer[0] == sealedMarker {
+			pkt, _, err = s.open(buffer[:n], from)
 			if err != nil {
-				fmt.Println(err)
-				return Packet{}, err
+				fmt.Println("[transport.Socket.Recv]: datagram of", from, "rejected:", err)
+				continue
 			}
-			pkt := Packet{}
+		} else {
 			err = json.Unmarshal(buffer[0:n], &pkt)
 			if err != nil {
 				fmt.Println(err)
 				return Packet{}, err
 			}
-			messageFull += pkt.Message
-
-			// Check pkt is from the same message
-			if pkt.Source != currentSource || pkt.Type != EncryptedChunk {
-				// TODO : start new recv process or ignore ?
-				// TODO : add rng ID to make sure it is from unique message
+			switch {
+			case Handshake(pkt.Type):
+				err = s.onHandshake(pkt, from, addr)
+				if err != nil {
+					fmt.Println("[transport.Socket.Recv]: handshake of", from, "failed:", err)
+				}
+				continue
+			case s.encrypted:
+				fmt.Println("[transport.Socket.Recv]:", pkt.Type, "packet of", from, "rejected: not encrypted")
+				continue
 			}
+		}
 
-			// send ack
-			pktAck := Packet{
-				Source:      s.GetAddress(),
-				Destination: pkt.Source,
-				Message:     strconv.Itoa(count),
-				Type:        Ack,
+		switch {
+		case pkt.Type == Ack:
+			if s.rejected(pkt) {
+				continue
 			}
-			count += 1
-			s.Send(pkt.Source, pktAck)
+			// Only acks of a fragment sent to their source, signed once
+			// identities are in use, release a send
+			if s.identity != nil && !pkt.Signed() {
+				fmt.Println("[transport.Socket.Recv]: unsigned ack of", from, "dropped")
+				continue
+			}
+			if !s.acks.release(from, pkt.Message) {
+				fmt.Println("[transport.Socket.Recv]: unexpected ack of", from, "dropped")
+				continue
+			}
+		case Fragmented(pkt.Type):
+			// Fragments of several senders can interleave,
+			// messages are reassembled per source.
+			key := pkt.Source + "/" + pkt.Type + "/" + pkt.ID
+			s.partial[key] = append(s.partial[key], pkt.Message)
 
 			// TODO use terminal token or 'end' field in packet
-			if len(pkt.Message) != 50000 {
-				break
+			if len(pkt.Message) == 50000 {
+				s.ack(pkt, len(s.partial[key])-1)
+				continue
 			}
+			pkt.Message = strings.Join(s.partial[key], "")
+			delete(s.partial, key)
 		}
-	default:
 
+		if s.rejected(pkt) {
+			continue
+		}
+		return pkt, nil
 	}
+}
 
-	pktFinal := Packet{
-		Source:      pkt.Source,
-		Destination: pkt.Destination,
-		Message:     messageFull,
-		Type:        pkt.Type,
-		Params:      pkt.Params,
+// Acks fragment i of a message, every fragment but the last: the sender
+// only waits for acks between fragments.
+func (s *Socket) ack(pkt Packet, i int) {
+	pktAck := Packet{
+		Source:      s.GetAddress(),
+		Destination: pkt.Source,
+		Message:     fragmentKey(pkt.Type, pkt.ID, i),
+		Type:        Ack,
+	}
+	s.Send(pkt.Source, pktAck)
+}
+
+// Sends waiting for the ack of a fragment, by peer and fragment, shared by
+// the copies of the socket
+type acks struct {
+	sync.Mutex
+	pending map[string]chan struct{}
+}
+
+// Identifies fragment i of a message, carried by its ack
+func fragmentKey(t string, id string, i int) string {
+	return t + "/" + id + "/" + strconv.Itoa(i)
+}
+
+func (a *acks) expect(peer string, fragment string) chan struct{} {
+	a.Lock()
+	defer a.Unlock()
+	acked := make(chan struct{}, 1)
+	a.pending[peer+" "+fragment] = acked
+	return acked
+}
+
+func (a *acks) cancel(peer string, fragment string) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.pending, peer+" "+fragment)
+}
+
+// Releases the send waiting for the ack of the fragment sent to peer,
+// returns false if none is
+func (a *acks) release(peer string, fragment string) bool {
+	a.Lock()
+	defer a.Unlock()
+	acked, ok := a.pending[peer+" "+fragment]
+	if !ok {
+		return false
+	}
+	delete(a.pending, peer+" "+fragment)
+	acked <- struct{}{}
+	return true
+}
+
+// Logs and drops the packets of invalid signature
+func (s *Socket) rejected(pkt Packet) bool {
+	err := pkt.Verify()
+	if err != nil {
+		fmt.Println("[transport.Socket.Recv]: packet of", pkt.Source, "rejected:", err)
+		return true
 	}
-	return pktFinal, nil
+	return false
 }
 
 func (s *Socket) GetAddress() string {